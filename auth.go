@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	gitssh "github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	cryptossh "golang.org/x/crypto/ssh"
+)
+
+// How to authenticate the clones.
+const (
+	// SSH with the key if one is given, then the agent, then the default keys, and
+	// HTTPS with the token from the environment, then netrc.
+	AuthAuto     = "auto"
+	AuthSSHAgent = "ssh-agent"
+	AuthSSHKey   = "ssh-key"
+	AuthHTTPS    = "https"
+	AuthNetrc    = "netrc"
+	AuthNone     = "none"
+)
+
+// The known_hosts policy.  Anything else is a known_hosts file.
+const (
+	KnownHostsStrict = "strict"
+	KnownHostsIgnore = "ignore"
+)
+
+// The credentials for cloning from a provider, declared in the project config
+// under `auth.<provider>`.  Secrets are never in the config, only the names of
+// the environment variables (or files) that have them, so that they can be
+// injected in CI:
+//
+//	auth:
+//	  bitbucket:
+//	    method: ssh-key
+//	    ssh_key: /run/secrets/deploy_key
+//	    ssh_key_passphrase_env: DEPLOY_KEY_PASSPHRASE
+//	    known_hosts: /run/secrets/known_hosts
+//	  github:
+//	    method: https
+//	    password_env: GITHUB_TOKEN
+type AuthConfig struct {
+	// One of `auto` (the default), `ssh-agent`, `ssh-key`, `https`, `netrc` or `none`.
+	Method string `yaml:"method"`
+	// Defaults to `git`.
+	SSHUser string `yaml:"ssh_user"`
+	SSHKey  string `yaml:"ssh_key"`
+	// Defaults to `SSH_KEY_PASSPHRASE`.
+	SSHKeyPassphraseEnv string `yaml:"ssh_key_passphrase_env"`
+	// `strict` (the default) checks `~/.ssh/known_hosts` (or `$SSH_KNOWN_HOSTS`),
+	// `ignore` doesn't check at all, and anything else is the known_hosts file.
+	KnownHosts string `yaml:"known_hosts"`
+	// The HTTPS username (or the variable that has it) and the variable with the
+	// password or token.  These default to the provider's, e.g. `GITHUB_TOKEN`.
+	Username    string `yaml:"username"`
+	UsernameEnv string `yaml:"username_env"`
+	PasswordEnv string `yaml:"password_env"`
+	// Defaults to `$NETRC` or `~/.netrc`.
+	Netrc string `yaml:"netrc"`
+}
+
+// The HTTPS credentials for each provider default to the same ones used for its API.
+var providerHTTPSCredentials = map[string]struct{ username, usernameEnv, passwordEnv string }{
+	"":          {"", "BITBUCKET_USERNAME", "BITBUCKET_PASSWORD"},
+	"bitbucket": {"", "BITBUCKET_USERNAME", "BITBUCKET_PASSWORD"},
+	"github":    {"x-access-token", "", "GITHUB_TOKEN"},
+	"gitlab":    {"oauth2", "", "GITLAB_TOKEN"},
+	"gitea":     {"git", "", "GITEA_TOKEN"},
+}
+
+// Fill in whatever isn't set from `defaults`.
+func (a *AuthConfig) merge(defaults *AuthConfig) *AuthConfig {
+	merged := *a
+	if defaults == nil {
+		return &merged
+	}
+	for _, field := range []struct {
+		to   *string
+		from string
+	}{
+		{&merged.Method, defaults.Method},
+		{&merged.SSHUser, defaults.SSHUser},
+		{&merged.SSHKey, defaults.SSHKey},
+		{&merged.SSHKeyPassphraseEnv, defaults.SSHKeyPassphraseEnv},
+		{&merged.KnownHosts, defaults.KnownHosts},
+		{&merged.Username, defaults.Username},
+		{&merged.UsernameEnv, defaults.UsernameEnv},
+		{&merged.PasswordEnv, defaults.PasswordEnv},
+		{&merged.Netrc, defaults.Netrc},
+	} {
+		if *field.to == "" {
+			*field.to = field.from
+		}
+	}
+	return &merged
+}
+
+// The credentials are resolved (and the key parsed) once and shared by all of
+// the clones.
+type CloneAuth struct {
+	config *AuthConfig
+
+	once    sync.Once
+	ssh     transport.AuthMethod
+	sshErr  error
+	https   transport.AuthMethod
+	httpErr error
+}
+
+func NewCloneAuth(provider string, config *AuthConfig) (*CloneAuth, error) {
+	if config == nil {
+		config = &AuthConfig{}
+	}
+	defaults := providerHTTPSCredentials[provider]
+	config = config.merge(&AuthConfig{
+		Method:              AuthAuto,
+		SSHUser:             "git",
+		SSHKeyPassphraseEnv: "SSH_KEY_PASSPHRASE",
+		KnownHosts:          KnownHostsStrict,
+		Username:            defaults.username,
+		UsernameEnv:         defaults.usernameEnv,
+		PasswordEnv:         defaults.passwordEnv,
+	})
+	switch config.Method {
+	case AuthAuto, AuthSSHAgent, AuthHTTPS, AuthNetrc, AuthNone:
+	case AuthSSHKey:
+		if config.SSHKey == "" {
+			return nil, errors.New("The `ssh-key` auth method needs the key (`ssh_key` or `--ssh-key`)")
+		}
+	default:
+		return nil, fmt.Errorf("Unknown auth method `%s`", config.Method)
+	}
+	return &CloneAuth{config: config}, nil
+}
+
+// The auth for cloning from the URL.  Local clones don't need any, and nil means
+// go-git's defaults.
+func (c *CloneAuth) Method(rawURL string) (transport.AuthMethod, error) {
+	if c == nil || c.config.Method == AuthNone {
+		return nil, nil
+	}
+	endpoint, err := transport.NewEndpoint(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	c.once.Do(c.resolve)
+	switch endpoint.Protocol {
+	case "ssh":
+		return c.ssh, c.sshErr
+	case "http", "https":
+		if c.https == nil && c.httpErr == nil && c.config.Method != AuthHTTPS {
+			return c.netrc(endpoint.Host)
+		}
+		return c.https, c.httpErr
+	}
+	return nil, nil
+}
+
+func (c *CloneAuth) resolve() {
+	a := c.config
+	if a.Method == AuthAuto || a.Method == AuthSSHKey || a.Method == AuthSSHAgent {
+		c.ssh, c.sshErr = c.sshAuth()
+	}
+	if a.Method == AuthAuto || a.Method == AuthHTTPS {
+		username := a.Username
+		if a.UsernameEnv != "" && os.Getenv(a.UsernameEnv) != "" {
+			username = os.Getenv(a.UsernameEnv)
+		}
+		password := os.Getenv(a.PasswordEnv)
+		if password != "" {
+			if username == "" {
+				username = "git"
+			}
+			c.https = &githttp.BasicAuth{Username: username, Password: password}
+		} else if a.Method == AuthHTTPS {
+			c.httpErr = fmt.Errorf("The `https` auth method needs a password or token in `%s`", a.PasswordEnv)
+		}
+	}
+}
+
+func (c *CloneAuth) sshAuth() (transport.AuthMethod, error) {
+	a := c.config
+	key := expandHome(a.SSHKey)
+	if a.Method == AuthAuto && key == "" && os.Getenv("SSH_AUTH_SOCK") == "" {
+		// Without an agent, try the usual keys.
+		for _, name := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+			if f := expandHome(filepath.Join("~", ".ssh", name)); checkFileExists(f) {
+				key = f
+				break
+			}
+		}
+	}
+	if a.Method == AuthSSHAgent || (a.Method == AuthAuto && key == "") {
+		if os.Getenv("SSH_AUTH_SOCK") == "" {
+			if a.Method == AuthSSHAgent {
+				return nil, errors.New("The `ssh-agent` auth method needs an agent (`SSH_AUTH_SOCK` isn't set)")
+			}
+			return nil, nil
+		}
+		auth, err := gitssh.NewSSHAgentAuth(a.SSHUser)
+		if err != nil {
+			return nil, err
+		}
+		auth.HostKeyCallback, err = a.hostKeyCallback()
+		return auth, err
+	}
+	auth, err := gitssh.NewPublicKeysFromFile(a.SSHUser, key, os.Getenv(a.SSHKeyPassphraseEnv))
+	if err != nil {
+		return nil, fmt.Errorf("Could not read the SSH key `%s`: %w", key, err)
+	}
+	auth.HostKeyCallback, err = a.hostKeyCallback()
+	return auth, err
+}
+
+func (a *AuthConfig) hostKeyCallback() (cryptossh.HostKeyCallback, error) {
+	switch a.KnownHosts {
+	case KnownHostsIgnore:
+		return cryptossh.InsecureIgnoreHostKey(), nil
+	case KnownHostsStrict, "":
+		return gitssh.NewKnownHostsCallback()
+	}
+	return gitssh.NewKnownHostsCallback(expandHome(a.KnownHosts))
+}
+
+// Look up the host in the netrc file.  A missing file or host isn't an error,
+// the clone just doesn't have any credentials.
+func (c *CloneAuth) netrc(host string) (transport.AuthMethod, error) {
+	filename := c.config.Netrc
+	if filename == "" {
+		filename = os.Getenv("NETRC")
+	}
+	if filename == "" {
+		filename = filepath.Join("~", ".netrc")
+	}
+	login, password, err := readNetrc(expandHome(filename), host)
+	if err != nil || password == "" {
+		return nil, err
+	}
+	return &githttp.BasicAuth{Username: login, Password: password}, nil
+}
+
+// Find the `machine` (or the `default`) entry for the host.
+func readNetrc(filename, host string) (string, string, error) {
+	f, err := os.Open(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", "", nil
+	}
+	if err != nil {
+		return "", "", err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Split(bufio.ScanWords)
+	var tokens []string
+	for scanner.Scan() {
+		tokens = append(tokens, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return "", "", err
+	}
+
+	var login, password, defaultLogin, defaultPassword string
+	var machine string
+	var found, inDefault bool
+	for i := 0; i < len(tokens); i++ {
+		next := func() string {
+			if i+1 < len(tokens) {
+				i++
+				return tokens[i]
+			}
+			return ""
+		}
+		switch tokens[i] {
+		case "machine":
+			if found {
+				return login, password, nil
+			}
+			machine = next()
+			found = machine == host
+			inDefault = false
+		case "default":
+			if found {
+				return login, password, nil
+			}
+			inDefault = true
+		case "login":
+			value := next()
+			if found {
+				login = value
+			} else if inDefault {
+				defaultLogin = value
+			}
+		case "password":
+			value := next()
+			if found {
+				password = value
+			} else if inDefault {
+				defaultPassword = value
+			}
+		case "macdef":
+			// Macros run to the end of the file as far as we care.
+			i = len(tokens)
+		}
+	}
+	if found {
+		return login, password, nil
+	}
+	return defaultLogin, defaultPassword, nil
+}
+
+func expandHome(path string) string {
+	if path == "~" || strings.HasPrefix(path, "~/") {
+		if home, err := os.UserHomeDir(); err == nil {
+			return filepath.Join(home, path[1:])
+		}
+	}
+	return path
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v3"
+	"sigs.k8s.io/kustomize/api/krusty"
+	"sigs.k8s.io/kustomize/api/resmap"
+	"sigs.k8s.io/kustomize/kyaml/filesys"
+)
+
+// An overlay that `kustomize build` can't render.
+type BuildError struct {
+	Environment string `json:"environment"`
+	Dir         string `json:"dir"`
+	Error       string `json:"error"`
+}
+
+// The resources that an environment's overlay was built into, or why it couldn't be.
+type builtOverlay struct {
+	Environment string
+	Dir         string
+	Resources   resmap.ResMap
+	Err         error
+}
+
+// The same as `kustomize build DIR`, but in-process, so it doesn't need to be
+// installed.  A Kustomizer isn't safe to share, so every build gets its own.
+func buildOverlay(dir string) (resmap.ResMap, error) {
+	k := krusty.MakeKustomizer(krusty.MakeDefaultOptions())
+	return k.Run(filesys.MakeFsOnDisk(), dir)
+}
+
+// The objects that the overlay is built into, with the hashes taken off the names
+// of the ConfigMaps and Secrets that it generates (see `unhash`), and the names
+// that they had.
+func buildObjects(dir string) (objects, map[string]string, error) {
+	resources, err := buildOverlay(dir)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Could not build the overlay: %w", err)
+	}
+	built := objects{}
+	for _, resource := range resources.Resources() {
+		b, err := resource.AsYAML()
+		if err == nil {
+			err = built.parse(b)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	generated, err := generatedNames(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	return built, built.unhash(generated), nil
+}
+
+// Only what's needed to know which names Kustomize hashes.
+type kustomizationFile struct {
+	Resources          []string `yaml:"resources"`
+	Bases              []string `yaml:"bases"`
+	ConfigMapGenerator []struct {
+		Name string `yaml:"name"`
+	} `yaml:"configMapGenerator"`
+	SecretGenerator []struct {
+		Name string `yaml:"name"`
+	} `yaml:"secretGenerator"`
+}
+
+// The names of the ConfigMaps and Secrets that the Kustomize directory (or any of
+// the directories that it includes) generates.
+func generatedNames(dir string) ([]string, error) {
+	var names []string
+	visited := map[string]bool{}
+	var walk func(dir string) error
+	walk = func(dir string) error {
+		dir = filepath.Clean(dir)
+		if visited[dir] {
+			return nil
+		}
+		visited[dir] = true
+		var b []byte
+		for _, name := range []string{"kustomization.yaml", "kustomization.yml", "Kustomization"} {
+			var err error
+			if b, err = os.ReadFile(filepath.Join(dir, name)); err == nil {
+				break
+			}
+		}
+		k := kustomizationFile{}
+		if err := yaml.Unmarshal(b, &k); err != nil {
+			return fmt.Errorf("%s: %w", dir, err)
+		}
+		for _, generator := range k.ConfigMapGenerator {
+			names = append(names, generator.Name)
+		}
+		for _, generator := range k.SecretGenerator {
+			names = append(names, generator.Name)
+		}
+		for _, resource := range append(k.Resources, k.Bases...) {
+			path := filepath.Join(dir, resource)
+			if info, err := os.Stat(path); err == nil && info.IsDir() {
+				if err := walk(path); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	return names, walk(dir)
+}
+
+// Build the overlay of every environment that has one.
+func (m *Migrator) buildOverlays(dir string) []*builtOverlay {
+	var overlays []*builtOverlay
+	for _, env := range m.Environments {
+		overlayDir := fmt.Sprintf("%s/overlays/%s", dir, env.Name)
+		if !checkFileExists(overlayDir) {
+			continue
+		}
+		resources, err := buildOverlay(overlayDir)
+		overlays = append(overlays, &builtOverlay{
+			Environment: env.Name,
+			Dir:         overlayDir,
+			Resources:   resources,
+			Err:         err,
+		})
+	}
+	return overlays
+}
+
+// Check every resource that the overlay was built into against the schemas of
+// the target Kubernetes version.
+func (m *Migrator) checkSchemas(overlay *builtOverlay) ([]*SchemaError, error) {
+	var errs []*SchemaError
+	for _, resource := range overlay.Resources.Resources() {
+		b, err := resource.AsYAML()
+		if err != nil {
+			return nil, err
+		}
+		resourceErrs, err := m.Schema.check(b)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range resourceErrs {
+			e.Environment = overlay.Environment
+		}
+		errs = append(errs, resourceErrs...)
+	}
+	return errs, nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	gitconfig "github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+)
+
+// The cache has a bare copy of the branches and tags of every repository that's
+// been cloned, e.g., `CACHE_DIR/github/github.com/btoll/aion-nginx.git`, so that
+// later runs only fetch what's changed, and `--offline` runs don't fetch at all.
+// The repositories are then cloned from the cache.
+var cacheRefSpecs = []gitconfig.RefSpec{
+	"+refs/heads/*:refs/heads/*",
+	"+refs/tags/*:refs/tags/*",
+}
+
+func (m *Migrator) cachePath(url string) (string, error) {
+	endpoint, err := transport.NewEndpoint(url)
+	if err != nil {
+		return "", err
+	}
+	provider := m.Project.ProviderName
+	if provider == "" {
+		provider = "bitbucket"
+	}
+	path := strings.TrimSuffix(strings.Trim(endpoint.Path, "/"), ".git")
+	// It's cloned from with a `file://` URL, so it can't be relative.
+	cacheDir, err := filepath.Abs(m.Project.CacheDir)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(cacheDir, provider, endpoint.Host, fmt.Sprintf("%s.git", path)), nil
+}
+
+// Where to clone the repository from, and the refs that it has.  Without a cache,
+// that's the remote.  Otherwise, it's the cache, which is brought up to date with
+// the remote first (unless it's offline).
+type cloneSource struct {
+	url  string
+	auth transport.AuthMethod
+	refs remoteRefs
+	// The number of times that it had to be retried.
+	retries int
+}
+
+func (m *Migrator) source(ctx context.Context, url string, auth transport.AuthMethod, w io.Writer) (*cloneSource, error) {
+	what := fmt.Sprintf("list the refs of `%s`", url)
+	if m.Project.CacheDir == "" {
+		source := &cloneSource{url: url, auth: auth}
+		attempts, err := retry(ctx, m.Retry, w, what, func(ctx context.Context) error {
+			var err error
+			source.refs, err = listRemoteRefs(ctx, url, auth)
+			return err
+		})
+		source.retries = attempts - 1
+		return source, err
+	}
+	dir, err := m.cachePath(url)
+	if err != nil {
+		return &cloneSource{}, &PermanentError{Err: err}
+	}
+	source := &cloneSource{url: fmt.Sprintf("file://%s", filepath.ToSlash(dir))}
+	if m.Project.Offline {
+		if !checkFileExists(dir) {
+			return &cloneSource{}, &PermanentError{Err: fmt.Errorf("`%s` isn't in the cache", url)}
+		}
+		source.refs, err = listRemoteRefs(ctx, source.url, nil)
+		if err == nil {
+			now := time.Now()
+			err = os.Chtimes(dir, now, now)
+		}
+		return source, err
+	}
+	attempts, err := retry(ctx, m.Retry, w, what, func(ctx context.Context) error {
+		var err error
+		source.refs, err = listRemoteRefs(ctx, url, auth)
+		if err != nil {
+			return err
+		}
+		if err := refreshCache(ctx, dir, url, auth, source.refs); err != nil {
+			return fmt.Errorf("Could not update the cache `%s`: %w", dir, err)
+		}
+		return nil
+	})
+	source.retries = attempts - 1
+	return source, err
+}
+
+// Fetch what's changed into the cache (or everything, the first time), and make
+// it look like the remote, i.e., drop the branches and tags that it doesn't have
+// anymore and point HEAD where it does.
+func refreshCache(ctx context.Context, dir, url string, auth transport.AuthMethod, refs remoteRefs) error {
+	repo, err := git.PlainOpen(dir)
+	if errors.Is(err, git.ErrRepositoryNotExists) {
+		repo, err = git.PlainInit(dir, true)
+		if err == nil {
+			_, err = repo.CreateRemote(&gitconfig.RemoteConfig{
+				Name:  "origin",
+				URLs:  []string{url},
+				Fetch: cacheRefSpecs,
+			})
+		}
+	}
+	if err != nil {
+		return err
+	}
+	err = repo.FetchContext(ctx, &git.FetchOptions{
+		RemoteName: "origin",
+		RemoteURL:  url,
+		RefSpecs:   cacheRefSpecs,
+		Auth:       auth,
+		Tags:       git.NoTags,
+		Force:      true,
+	})
+	if err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
+		return err
+	}
+
+	iter, err := repo.References()
+	if err != nil {
+		return err
+	}
+	var stale []plumbing.ReferenceName
+	err = iter.ForEach(func(ref *plumbing.Reference) error {
+		if name := ref.Name(); (name.IsBranch() || name.IsTag()) && refs[name] == nil {
+			stale = append(stale, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, name := range stale {
+		if err := repo.Storer.RemoveReference(name); err != nil {
+			return err
+		}
+	}
+	if head := refs.head(); head != "" {
+		err := repo.Storer.SetReference(plumbing.NewSymbolicReference(plumbing.HEAD, plumbing.NewBranchReferenceName(head)))
+		if err != nil {
+			return err
+		}
+	}
+	// The modification time is when it was last used, see `pruneCache`.
+	now := time.Now()
+	return os.Chtimes(dir, now, now)
+}
+
+// Delete the repositories in the cache that haven't been used since `before`,
+// returning the ones that were (or would be, if it's a dry run).
+func pruneCache(cacheDir string, before time.Time, dryRun bool) ([]string, error) {
+	var pruned []string
+	err := filepath.WalkDir(cacheDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() || path == cacheDir || !isGitRepository(path) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if info.ModTime().Before(before) {
+			pruned = append(pruned, path)
+			if !dryRun {
+				if err := os.RemoveAll(path); err != nil {
+					return err
+				}
+			}
+		}
+		return filepath.SkipDir
+	})
+	return pruned, err
+}
@@ -1,83 +1,271 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"log"
+	"io"
 	"os"
+	"strings"
 
 	"github.com/btoll/migrator/color"
 	"github.com/go-git/go-git/v5"
 	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/transport"
 )
 
 type Cloner struct {
+	// The full URL to clone from, e.g. `git@bitbucket.org:pecteam/aion-nginx.git`.
 	URL        string
 	Repository string
 	Branch     string
-	CloneDir   string
+	// Takes precedence over the branch, e.g., a tag or `HEAD` for the remote's HEAD.
+	Reference plumbing.ReferenceName
+	CloneDir  string
+	Auth      transport.AuthMethod
+	// Only fetch this many commits (0 fetches all of them) of only the one branch.
+	Depth        int
+	SingleBranch bool
+	// Only check out these directories, e.g., `.kube`.
+	Sparse []string
 }
 
-func clone(c *Cloner) (*git.Repository, error) {
+func clone(ctx context.Context, c *Cloner) (*git.Repository, error) {
+	if c.Repository == "" {
+		return nil, &PermanentError{Err: errors.New("The repository can't be undefined")}
+	}
 	if c.URL == "" {
-		c.URL = "git@github.com"
+		c.URL = fmt.Sprintf("git@github.com:%s.git", c.Repository)
 	}
-	if c.Branch == "" {
-		c.Branch = "master"
+	if c.Reference == "" {
+		if c.Branch == "" {
+			c.Branch = "master"
+		}
+		c.Reference = plumbing.NewBranchReferenceName(c.Branch)
 	}
 	if c.CloneDir == "" {
 		c.CloneDir = "."
 	}
-	if c.Repository == "" {
-		fmt.Fprintln(os.Stderr, "Repository cannot be undefined.")
-		os.Exit(1)
-	}
-	return git.PlainClone(c.CloneDir, false, &git.CloneOptions{
-		URL:           fmt.Sprintf("%s/%s.git", c.URL, c.Repository),
+	repo, err := git.PlainCloneContext(ctx, c.CloneDir, false, &git.CloneOptions{
+		URL:           c.URL,
+		Auth:          c.Auth,
 		Progress:      nil,
-		ReferenceName: plumbing.ReferenceName(fmt.Sprintf("refs/heads/%s", c.Branch)),
+		ReferenceName: c.Reference,
+		Depth:         c.Depth,
+		SingleBranch:  c.SingleBranch,
+		NoCheckout:    len(c.Sparse) > 0,
 	})
+	if err != nil || len(c.Sparse) == 0 {
+		return repo, err
+	}
+	if err := checkoutSparsely(repo, c.Sparse); err != nil {
+		os.RemoveAll(c.CloneDir)
+		return nil, err
+	}
+	return repo, nil
+}
+
+// Check out only the directories of what HEAD points to.
+func checkoutSparsely(repo *git.Repository, dirs []string) error {
+	head, err := repo.Head()
+	if err != nil {
+		return err
+	}
+	wt, err := repo.Worktree()
+	if err != nil {
+		return err
+	}
+	// go-git only skips the entries that are already in the index, and after a
+	// clone without a checkout there aren't any, so the index is reset first.
+	err = wt.ResetSparsely(&git.ResetOptions{
+		Commit: head.Hash(),
+		Mode:   git.MixedReset,
+	}, dirs)
+	if err != nil {
+		return err
+	}
+	return wt.ResetSparsely(&git.ResetOptions{
+		Commit: head.Hash(),
+		Mode:   git.HardReset,
+	}, dirs)
 }
 
-func (m *Migrator) clone(serviceName string) {
+// Clone the service's repository.  Since the services are cloned concurrently, all
+// of the output is written to `w` so that it can be printed in order.  If it's
+// interrupted, the clone is rolled back and there's no result.
+func (m *Migrator) clone(ctx context.Context, serviceName string, w io.Writer) *CloneResult {
 	clonedAppDir := fmt.Sprintf("%s/%s/%s", m.Dirs.Cloned, m.Project.Name, serviceName)
-	tmpClonedDir := fmt.Sprintf("%s", clonedAppDir)
 
-	cloner := &Cloner{
-		URL:        "git@bitbucket.org:pecteam",
-		Repository: serviceName,
-		Branch:     "development",
-		CloneDir:   tmpClonedDir,
+	url := m.Project.Provider.CloneURL(serviceName)
+	auth, err := m.Auth.Method(url)
+	if err != nil {
+		fmt.Fprintln(w, fmt.Sprintf("%s Could not get the credentials to clone the `%s` repository: %s", color.Error(), serviceName, err))
+		return newCloneError(serviceName, &PermanentError{Err: err}, 0)
+	}
+	source, err := m.source(ctx, url, auth, w)
+	if ctx.Err() != nil {
+		return nil
 	}
-
-	// Get the `development` branch first, if there is one and fall back to the `master` branch.
-	_, err := clone(cloner)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, fmt.Sprintf("%s Could not clone the `%s` branch for the `%s` repository, trying master...", color.Warning(), cloner.Branch, cloner.Repository))
-		cloner.Branch = "master"
-		_, err := clone(cloner)
-		if err != nil {
-			fmt.Fprintln(os.Stderr, fmt.Sprintf("%s Could not clone the `%s` branch for the `%s` repository", color.Warning(), cloner.Branch, cloner.Repository))
-			fmt.Printf("%s err %s\n", serviceName, err)
-			m.Debug.Files["error"] = append(m.Debug.Files["error"], cloner.Repository)
-		} else {
-			fmt.Fprintln(os.Stderr, fmt.Sprintf("   %s Cloned the %s branch for the %s repository", color.Info(), color.Branch(cloner.Branch), color.Repository(cloner.Repository)))
-			m.Debug.Files["master"] = append(m.Debug.Files["master"], cloner.Repository)
+		fmt.Fprintln(w, fmt.Sprintf("%s Could not list the refs of the `%s` repository: %s", color.Error(), serviceName, err))
+		return newCloneError(serviceName, err, source.retries)
+	}
+	retries := source.retries
+	defaultBranch := func() (string, error) {
+		if m.Project.Offline {
+			return "", errors.New("The provider can't be asked when offline")
 		}
-	} else {
-		m.Debug.Files["development"] = append(m.Debug.Files["development"], serviceName)
-		fmt.Fprintln(os.Stderr, fmt.Sprintf("   %s Cloned the %s branch for the %s repository", color.Info(), color.Branch(cloner.Branch), color.Repository(serviceName)))
+		return m.Project.Provider.DefaultBranch(serviceName)
+	}
+	// It's only ever a copy of what's in the repository (or the cache).
+	if err := os.RemoveAll(clonedAppDir); err != nil {
+		fmt.Fprintln(w, fmt.Sprintf("%s Could not remove the previous clone of the `%s` repository: %s", color.Error(), serviceName, err))
+		return newCloneError(serviceName, &PermanentError{Err: err}, retries)
 	}
 
-	ansibleDeployersDir := fmt.Sprintf("%s/ansible-deployers", m.Dirs.Build)
-	if !checkFileExists(ansibleDeployersDir) {
-		cloner.Repository = "ansible-deployers"
-		cloner.Branch = "master"
-		cloner.CloneDir = ansibleDeployersDir
-		_, err := clone(cloner)
+	// Clone the first of the refs that the repository has, e.g., the `development`
+	// branch if there is one and then the `master` branch and then whatever the
+	// remote says the default branch is.
+	refs := m.refs(serviceName)
+	var cloneErr error
+	for i, ref := range refs {
+		next := "giving up"
+		if i+1 < len(refs) {
+			next = fmt.Sprintf("trying %s...", refs[i+1])
+		}
+		name, ok := source.refs.resolve(ref, defaultBranch)
+		if !ok {
+			fmt.Fprintln(w, fmt.Sprintf("%s The `%s` repository doesn't have %s, %s", color.Warning(), serviceName, ref, next))
+			continue
+		}
+		cloner := m.cloner(serviceName)
+		cloner.URL = source.url
+		cloner.Reference = name
+		cloner.CloneDir = clonedAppDir
+		cloner.Auth = source.auth
+		if ref.Kind == RefCommit {
+			// The commit could be anywhere in the history of any of the branches.
+			cloner.Reference = plumbing.HEAD
+			cloner.Depth = 0
+			cloner.SingleBranch = false
+		}
+		var head plumbing.Hash
+		attempts, err := retry(ctx, m.Retry, w, fmt.Sprintf("clone %s of the `%s` repository", ref, serviceName), func(ctx context.Context) error {
+			repo, err := clone(ctx, cloner)
+			if err != nil {
+				return err
+			}
+			head, err = checkoutRef(repo, ref, cloner.Sparse)
+			if err != nil {
+				os.RemoveAll(clonedAppDir)
+				return &PermanentError{Err: err}
+			}
+			return nil
+		})
+		retries += attempts - 1
+		if ctx.Err() != nil {
+			// The clone was rolled back, and it isn't reported since it wasn't done.
+			fmt.Fprintln(w, fmt.Sprintf("%s Stopped cloning the `%s` repository", color.Warning(), serviceName))
+			return nil
+		}
 		if err != nil {
-			fmt.Println("err", err)
-			fmt.Fprintln(os.Stderr, fmt.Sprintf("%s Could not clone `ansible-deployers`", color.Error()))
-			log.Fatal(err)
+			fmt.Fprintln(w, fmt.Sprintf("%s Could not clone %s of the `%s` repository: %s, %s", color.Warning(), ref, serviceName, err, next))
+			cloneErr = err
+			continue
 		}
+		result := &CloneResult{
+			Repository: serviceName,
+			Ref:        name.String(),
+			Commit:     head.String(),
+			Retries:    retries,
+		}
+		desc := ref.String()
+		switch {
+		case name.IsBranch():
+			result.Branch = name.Short()
+			desc = fmt.Sprintf("the %s branch", color.Branch(result.Branch))
+		case ref.Kind == RefCommit:
+			result.Ref = head.String()
+		}
+		fmt.Fprintln(w, fmt.Sprintf("   %s Cloned %s (%s) for the %s repository", color.Info(), desc, head.String()[:7], color.Repository(serviceName)))
+		return result
+	}
+	var tried []string
+	for _, ref := range refs {
+		tried = append(tried, ref.String())
+	}
+	err = fmt.Errorf("Could not clone %s", strings.Join(tried, " or "))
+	fmt.Fprintln(w, fmt.Sprintf("%s %s of the `%s` repository", color.Error(), err, serviceName))
+	if cloneErr != nil {
+		// Whether it's worth trying again depends on why the last clone failed.
+		err = fmt.Errorf("%w: %w", err, cloneErr)
+	} else {
+		err = &PermanentError{Err: err}
+	}
+	return newCloneError(serviceName, err, retries)
+}
+
+func newCloneError(repository string, err error, retries int) *CloneResult {
+	return &CloneResult{
+		Repository: repository,
+		Error:      err.Error(),
+		Retryable:  isRetryable(err),
+		Retries:    retries,
+	}
+}
+
+// Unless it's a full clone, only the latest commit of the ref is fetched and only
+// the `kube_dir` is checked out, since that's all that's transformed.
+func (m *Migrator) cloner(serviceName string) *Cloner {
+	cloner := &Cloner{Repository: serviceName}
+	if m.Project.FullClone {
+		return cloner
+	}
+	cloner.Depth = m.Config.Clone.Depth
+	cloner.SingleBranch = m.Config.Clone.SingleBranch
+	if m.Config.Clone.Sparse {
+		cloner.Sparse = []string{m.Config.KubeDir}
+	}
+	return cloner
+}
+
+// The overrides and vars in `ansible-deployers` (or whatever the project config
+// calls it) are shared by every service, so it's only cloned once, before any of
+// the services.  Nothing can be transformed without it, so it's an error that
+// stops the run (and it's in the report).
+func (m *Migrator) cloneAnsibleDeployers(ctx context.Context) error {
+	if checkFileExists(m.Dirs.AnsibleDeployers) {
+		return nil
+	}
+	retries, err := m.cloneAnsibleDeployersRepository(ctx)
+	if err != nil {
+		m.AnsibleDeployersClone = newCloneError(m.Config.AnsibleDeployers, err, retries)
+	}
+	return err
+}
+
+func (m *Migrator) cloneAnsibleDeployersRepository(ctx context.Context) (int, error) {
+	url := m.Project.Provider.CloneURL(m.Config.AnsibleDeployers)
+	auth, err := m.Auth.Method(url)
+	if err != nil {
+		return 0, &PermanentError{Err: fmt.Errorf("Could not get the credentials to clone `%s`: %w", m.Config.AnsibleDeployers, err)}
+	}
+	source, err := m.source(ctx, url, auth, os.Stderr)
+	if err != nil {
+		return source.retries, fmt.Errorf("Could not list the refs of `%s`: %w", m.Config.AnsibleDeployers, err)
+	}
+	attempts, err := retry(ctx, m.Retry, os.Stderr, fmt.Sprintf("clone `%s`", m.Config.AnsibleDeployers), func(ctx context.Context) error {
+		_, err := clone(ctx, &Cloner{
+			URL:        source.url,
+			Repository: m.Config.AnsibleDeployers,
+			Branch:     "master",
+			CloneDir:   m.Dirs.AnsibleDeployers,
+			Auth:       source.auth,
+		})
+		return err
+	})
+	if err != nil {
+		return source.retries + attempts - 1, fmt.Errorf("Could not clone `%s`: %w", m.Config.AnsibleDeployers, err)
 	}
+	return source.retries + attempts - 1, nil
 }
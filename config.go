@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// The project config is read from this file in the current directory if it exists
+// and `--config` isn't given.
+const defaultConfigFile = "migrator.yaml"
+
+// The conventions of the project's repositories and of `ansible-deployers`.  The
+// defaults are AION's, and a `migrator.yaml` only needs to declare what's different:
+//
+//	template_extension: .jinja
+//	defaults_file: "{name}-defaults.yaml"
+//	projects:
+//	  aion:
+//	    foreground_services: vars/aion_foreground_services.yml
+//
+// Anything under `projects.<name>` only applies to that project and takes precedence.
+type Config struct {
+	// The location of the templates used to generate the kustomization files.
+	Templates string `yaml:"templates"`
+	// The repository that has the shared vars and overrides, cloned into the build directory.
+	AnsibleDeployers string `yaml:"ansible_deployers"`
+	// These are relative to the `ansible-deployers` repository.
+	ForegroundServices string `yaml:"foreground_services"`
+	Certificates       string `yaml:"certificates"`
+	Overrides          string `yaml:"overrides"`
+	// The directory in each service's repository that has the manifest templates, and the
+	// directory in that (and in the overrides) that has the values files.
+	KubeDir   string `yaml:"kube_dir"`
+	ValuesDir string `yaml:"values_dir"`
+	// Only the files in the `kube_dir` with this extension are rendered.
+	TemplateExtension string `yaml:"template_extension"`
+	// The names of the values files, where `{name}` is the service name without
+	// hyphens.  The values file is the default for environments that don't declare one.
+	DefaultsFile string `yaml:"defaults_file"`
+	ValuesFile   string `yaml:"values_file"`
+	// The vars from `ansible-deployers` that the manifest templates reference.
+	Vars ManifestValues `yaml:"vars"`
+	// The refs to clone, in order of preference, and the ones for particular
+	// repositories, see `refs.go`.
+	Refs           []string            `yaml:"refs"`
+	RepositoryRefs map[string][]string `yaml:"repository_refs"`
+	// Where the repositories are cached between runs, see `cache.go`.  `--cache-dir`
+	// takes precedence.
+	CacheDir string `yaml:"cache_dir"`
+	// How much of each repository is cloned, see `CloneConfig`.
+	Clone CloneConfig `yaml:"clone"`
+	// How the clones are retried, see `retry.go`.  `--retries` and `--timeout`
+	// take precedence.
+	Retry *RetryPolicy `yaml:"retry"`
+	// The credentials for cloning, by provider, see `auth.go`.
+	Auth map[string]*AuthConfig `yaml:"auth"`
+	// The Kubernetes version that the built overlays are checked against, e.g.
+	// `1.29`, see `schema.go`.  Defaults to the latest that there's a schema for.
+	// `--kubernetes-version` takes precedence.
+	KubernetesVersion string `yaml:"kubernetes_version"`
+	// See `environment.go`.  The `--environments` file takes precedence.
+	Environments []*Environment `yaml:"environments"`
+	// Where `publish` commits the output, see `GitopsConfig`.
+	Gitops GitopsConfig `yaml:"gitops"`
+
+	Projects map[string]yaml.Node `yaml:"projects"`
+}
+
+// Only the `kube_dir` of each repository is transformed, so by default that's all
+// that's checked out, of only the latest commit.  `--full-clone` ignores this.
+type CloneConfig struct {
+	// The number of commits to fetch, 0 for all of them.
+	Depth int `yaml:"depth"`
+	// Only fetch the ref that's cloned.
+	SingleBranch bool `yaml:"single_branch"`
+	// Only check out the `kube_dir`.
+	Sparse bool `yaml:"sparse"`
+}
+
+// The gitops repository that `publish` commits the services to, on a new branch
+// for every run, see `publish.go`:
+//
+//	gitops:
+//	  url: git@github.com:btoll/gitops.git
+//	  path: apps/{project}/{service}
+//	  auth:
+//	    method: https
+//	    password_env: GITOPS_TOKEN
+type GitopsConfig struct {
+	// The repository to clone.  `--gitops-url` takes precedence, and `--gitops-dir`
+	// uses a working copy instead.
+	URL string `yaml:"url"`
+	// The branch that each run's branch is created from.  Defaults to the remote's HEAD.
+	Branch string `yaml:"branch"`
+	// Where each service goes in the repository, where `{project}` and `{service}`
+	// are the names.  `{service}` has to be a directory of its own.
+	Path string `yaml:"path"`
+	// Each run's branch is this followed by the project and the time, e.g.
+	// `migrator/aion-20240102-150405`.
+	BranchPrefix string `yaml:"branch_prefix"`
+	// Defaults to the git config's `user.name` and `user.email`.
+	AuthorName  string `yaml:"author_name"`
+	AuthorEmail string `yaml:"author_email"`
+	// The credentials for cloning and pushing, like the `auth` of a provider.
+	Auth *AuthConfig `yaml:"auth"`
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Templates:          "tpl",
+		AnsibleDeployers:   "ansible-deployers",
+		ForegroundServices: "vars/aion_foreground_services.yml",
+		Certificates:       "vars/certificates.yml",
+		Overrides:          "files/kubernetes_environment_overrides",
+		KubeDir:            ".kube",
+		ValuesDir:          "environments",
+		TemplateExtension:  ".j2",
+		DefaultsFile:       "defaults-{name}.yaml",
+		ValuesFile:         defaultValuesFile,
+		Refs:               append([]string{}, defaultRefs...),
+		Retry:              defaultRetryPolicy(),
+		Clone: CloneConfig{
+			Depth:        1,
+			SingleBranch: true,
+			Sparse:       true,
+		},
+		Vars: ManifestValues{
+			"secrets_reader_config_map": "kubernetes-container-user",
+		},
+		Gitops: GitopsConfig{
+			Path:         "{project}/{service}",
+			BranchPrefix: "migrator/",
+		},
+	}
+}
+
+// Read the config for the project, falling back to the defaults for anything that
+// isn't declared.
+func loadConfig(filename, project string) (*Config, error) {
+	config := defaultConfig()
+	if filename == "" || (filename == defaultConfigFile && !checkFileExists(filename)) {
+		return config, config.validate(filename)
+	}
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(b))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(config); err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	if node, ok := config.Projects[project]; ok {
+		if err := node.Decode(config); err != nil {
+			return nil, fmt.Errorf("%s: projects.%s: %w", filename, project, err)
+		}
+	}
+	config.Projects = nil
+	return config, config.validate(filename)
+}
+
+func (c *Config) validate(filename string) error {
+	if c.TemplateExtension != "" && !strings.HasPrefix(c.TemplateExtension, ".") {
+		c.TemplateExtension = fmt.Sprintf(".%s", c.TemplateExtension)
+	}
+	for field, value := range map[string]string{
+		"templates":          c.Templates,
+		"ansible_deployers":  c.AnsibleDeployers,
+		"kube_dir":           c.KubeDir,
+		"template_extension": c.TemplateExtension,
+	} {
+		if value == "" {
+			return fmt.Errorf("%s: `%s` can't be empty", filename, field)
+		}
+	}
+	for field, value := range map[string]string{
+		"defaults_file": c.DefaultsFile,
+		"values_file":   c.ValuesFile,
+	} {
+		if !strings.Contains(value, "{name}") {
+			return fmt.Errorf("%s: `%s` must contain `{name}`", filename, field)
+		}
+	}
+	if err := c.Retry.validate(); err != nil {
+		return fmt.Errorf("%s: %w", filename, err)
+	}
+	if c.Clone.Depth < 0 {
+		return fmt.Errorf("%s: `clone.depth` can't be negative", filename)
+	}
+	if _, err := parseRefs(c.Refs); err != nil {
+		return fmt.Errorf("%s: refs: %w", filename, err)
+	}
+	for repository, refs := range c.RepositoryRefs {
+		if _, err := parseRefs(refs); err != nil {
+			return fmt.Errorf("%s: repository_refs.%s: %w", filename, repository, err)
+		}
+	}
+	if err := c.Gitops.validate(); err != nil {
+		return fmt.Errorf("%s: %w", filename, err)
+	}
+	if len(c.Environments) > 0 {
+		return validateEnvironments(filename, c.Environments, c.ValuesFile)
+	}
+	return nil
+}
+
+// The name of the service's defaults values file.
+func (c *Config) defaultsFile(name string) string {
+	return strings.ReplaceAll(c.DefaultsFile, "{name}", name)
+}
+
+func (g *GitopsConfig) validate() error {
+	if filepath.IsAbs(g.Path) {
+		return errors.New("`gitops.path` must be relative to the repository")
+	}
+	parts := strings.Split(filepath.ToSlash(g.Path), "/")
+	if slices.Contains(parts, "..") {
+		return errors.New("`gitops.path` can't be outside of the repository")
+	}
+	if !slices.Contains(parts, "{service}") {
+		return errors.New("`gitops.path` must have `{service}` as one of its directories")
+	}
+	return nil
+}
+
+// Where the service goes in the gitops repository.
+func (g *GitopsConfig) servicePath(project, service string) string {
+	return filepath.FromSlash(strings.NewReplacer("{project}", project, "{service}", service).Replace(g.Path))
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	_ "embed"
+	"fmt"
+	"html/template"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The dashboard is embedded so that it's there no matter which `templates` the
+// project config points at.
+//
+//go:embed dashboard.html
+var dashboardTemplate string
+
+type dashboardRow struct {
+	*RepositoryReport
+	Status string
+	// The branch, tag or commit that was cloned, and the (abbreviated) commit.
+	Ref    string
+	Commit string
+	// The generated files, relative to the dashboard so the links work wherever
+	// the build directory ends up.
+	Links []dashboardLink
+}
+
+type dashboardLink struct {
+	Href string
+	Name string
+}
+
+// The status is also the CSS class of the badge.
+func (r *RepositoryReport) status() string {
+	switch {
+	case r.Clone != nil && r.Clone.Error != "":
+		return "clone-error"
+	case r.Kustomize == nil:
+		return "cloned"
+	case r.Kustomize.NoKube:
+		return "no-kube"
+	case !r.Kustomize.Success:
+		return "failed"
+	case len(r.Kustomize.Unmatched) > 0 || len(r.Kustomize.MissingValuesFiles) > 0 || len(r.Kustomize.Warnings) > 0:
+		return "warnings"
+	}
+	return "ok"
+}
+
+// The dashboard goes next to the report, e.g. `build/report.html`.
+func dashboardFile(reportFile string) string {
+	return fmt.Sprintf("%s.html", strings.TrimSuffix(reportFile, filepath.Ext(reportFile)))
+}
+
+// Write a static HTML page with a sortable table of the services in the report.
+func writeDashboard(r *Report, filename string) error {
+	tpl, err := template.New("dashboard").Parse(dashboardTemplate)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(filename)
+	rows := []*dashboardRow{}
+	for _, repository := range r.Repositories {
+		row := &dashboardRow{
+			RepositoryReport: repository,
+			Status:           repository.status(),
+		}
+		if clone := repository.Clone; clone != nil {
+			row.Ref = clone.Branch
+			if row.Ref == "" {
+				row.Ref = strings.TrimPrefix(clone.Ref, "refs/tags/")
+			}
+			if len(clone.Commit) >= 7 {
+				row.Commit = clone.Commit[:7]
+			}
+			// A pinned commit.
+			if clone.Ref == clone.Commit {
+				row.Ref, row.Commit = row.Commit, ""
+			}
+		}
+		if repository.Kustomize != nil {
+			for _, output := range repository.Kustomize.Outputs {
+				href, err := filepath.Rel(dir, output)
+				if err != nil {
+					href = output
+				}
+				row.Links = append(row.Links, dashboardLink{
+					Href: filepath.ToSlash(href),
+					Name: outputName(repository.Name, output),
+				})
+			}
+		}
+		rows = append(rows, row)
+	}
+
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return tpl.Execute(f, map[string]interface{}{
+		"Report": r,
+		"Rows":   rows,
+	})
+}
+
+// Only show the part of the path after the service, e.g. `overlays/beta/env`.
+func outputName(repository, output string) string {
+	slashed := filepath.ToSlash(output)
+	if _, after, ok := strings.Cut(slashed, "/"+repository+"/"); ok {
+		return after
+	}
+	return filepath.Base(output)
+}
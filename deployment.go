@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Anything that couldn't be resolved when rendering is still in the manifest as
+// `{{ expression }}`, which isn't valid YAML, so these are swapped out for
+// placeholders while the manifest is parsed and then put back.
+var reUnresolved = regexp.MustCompile(`{{.*?}}`)
+
+var imagePullPolicies = []string{"Always", "IfNotPresent", "Never"}
+
+// These are the changes that are made to every Deployment in a rendered manifest.
+type DeploymentPatch struct {
+	// The name of the ConfigMap generated from the overlay's `env` file.
+	ConfigMapName string
+	NodeSelector  map[string]string
+}
+
+// Parse the rendered manifest and apply the patch to each Deployment in it.  The
+// transformations are applied to the pod spec and to every container in it, so it
+// doesn't matter how the template was indented or how many containers there are.
+func rewriteDeployment(manifest string, patch *DeploymentPatch) (string, error) {
+	return rewriteManifest(manifest, "Deployment", func(deployment *yaml.Node) error {
+		return patchDeployment(deployment, patch)
+	})
+}
+
+// Parse the (possibly multi-document) manifest and call `patch` with the root of
+// every document of the given kind.
+func rewriteManifest(manifest, kind string, patch func(*yaml.Node) error) (string, error) {
+	placeholders := map[string]string{}
+	protected := reUnresolved.ReplaceAllStringFunc(manifest, func(s string) string {
+		placeholder := fmt.Sprintf("__migrator_unresolved_%d__", len(placeholders))
+		placeholders[placeholder] = s
+		return placeholder
+	})
+
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	decoder := yaml.NewDecoder(strings.NewReader(fixTabIndentation(protected)))
+	for {
+		doc := &yaml.Node{}
+		err := decoder.Decode(doc)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		if len(doc.Content) == 0 {
+			continue
+		}
+		root := doc.Content[0]
+		if scalarValue(mappingGet(root, "kind")) == kind {
+			if err := patch(root); err != nil {
+				return "", err
+			}
+		}
+		if err := encoder.Encode(doc); err != nil {
+			return "", err
+		}
+	}
+	if err := encoder.Close(); err != nil {
+		return "", err
+	}
+
+	rewritten := buf.String()
+	for placeholder, s := range placeholders {
+		rewritten = strings.ReplaceAll(rewritten, placeholder, s)
+	}
+	return rewritten, nil
+}
+
+func patchDeployment(deployment *yaml.Node, patch *DeploymentPatch) error {
+	podSpec := mappingPath(deployment, "spec", "template", "spec")
+	if podSpec == nil || podSpec.Kind != yaml.MappingNode {
+		return errors.New("Deployment has no `spec.template.spec`")
+	}
+
+	if len(patch.NodeSelector) > 0 {
+		nodeSelector := mappingGet(podSpec, "nodeSelector")
+		if nodeSelector == nil || nodeSelector.Kind != yaml.MappingNode {
+			nodeSelector = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+			mappingSet(podSpec, "nodeSelector", nodeSelector)
+		}
+		for _, k := range sortedKeys(patch.NodeSelector) {
+			mappingSet(nodeSelector, k, scalarNode(patch.NodeSelector[k]))
+		}
+	}
+
+	containers := mappingGet(podSpec, "containers")
+	if containers == nil || containers.Kind != yaml.SequenceNode {
+		return nil
+	}
+	for _, container := range containers.Content {
+		if container.Kind != yaml.MappingNode {
+			continue
+		}
+		if patch.ConfigMapName != "" {
+			useConfigMapForEnv(container, patch.ConfigMapName)
+		}
+		fixImagePullPolicy(container)
+	}
+	return nil
+}
+
+// The env vars are generated into a ConfigMap in each overlay, so the container
+// gets an `envFrom` that references it.  The `env` entries that are in the
+// template itself (rather than from the values files) aren't in the ConfigMap, so
+// they're left alone, as are the ones that can't be expressed in an env file
+// (i.e., `valueFrom`).
+func useConfigMapForEnv(container *yaml.Node, configMapName string) {
+	// The loop over the values' env vars leaves an empty `env` behind.
+	if env := mappingGet(container, "env"); env != nil && len(env.Content) == 0 {
+		mappingDelete(container, "env")
+	}
+
+	envFrom := mappingGet(container, "envFrom")
+	if envFrom == nil || envFrom.Kind != yaml.SequenceNode {
+		envFrom = &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+		mappingSet(container, "envFrom", envFrom)
+	}
+	for _, item := range envFrom.Content {
+		if scalarValue(mappingPath(item, "configMapRef", "name")) == configMapName {
+			return
+		}
+	}
+	configMapRef := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	mappingSet(configMapRef, "name", scalarNode(configMapName))
+	ref := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	mappingSet(ref, "configMapRef", configMapRef)
+	envFrom.Content = append(envFrom.Content, ref)
+}
+
+// Some templates have the policy in the wrong case (`always`) or quoted oddly.
+func fixImagePullPolicy(container *yaml.Node) {
+	policy := mappingGet(container, "imagePullPolicy")
+	if policy == nil || policy.Kind != yaml.ScalarNode {
+		return
+	}
+	for _, p := range imagePullPolicies {
+		if strings.EqualFold(strings.TrimSpace(policy.Value), p) {
+			policy.Value = p
+			policy.Style = 0
+			return
+		}
+	}
+}
+
+// At least one deployment has tabs that confuse the yaml parser and throws an exception.
+// Fix it by indenting the line to match the one before it, which is what the author
+// intended...we hope...
+// JARNTUY: Just Another Reason Not To Use YAML
+func fixTabIndentation(manifest string) string {
+	lines := strings.Split(manifest, "\n")
+	var previousIndent string
+	for i, line := range lines {
+		trimmed := strings.TrimLeft(line, " \t")
+		indent := line[:len(line)-len(trimmed)]
+		if strings.Contains(indent, "\t") {
+			lines[i] = previousIndent + trimmed
+			continue
+		}
+		if trimmed != "" {
+			previousIndent = indent
+			// A sequence item's keys are indented past the dash.
+			if strings.HasPrefix(trimmed, "- ") {
+				previousIndent += "  "
+			}
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func scalarNode(value string) *yaml.Node {
+	return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value}
+}
+
+func scalarValue(n *yaml.Node) string {
+	if n == nil || n.Kind != yaml.ScalarNode {
+		return ""
+	}
+	return n.Value
+}
+
+func mappingGet(n *yaml.Node, key string) *yaml.Node {
+	if n == nil || n.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == key {
+			return n.Content[i+1]
+		}
+	}
+	return nil
+}
+
+func mappingPath(n *yaml.Node, keys ...string) *yaml.Node {
+	for _, key := range keys {
+		n = mappingGet(n, key)
+	}
+	return n
+}
+
+func mappingSet(n *yaml.Node, key string, value *yaml.Node) {
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == key {
+			n.Content[i+1] = value
+			return
+		}
+	}
+	n.Content = append(n.Content, scalarNode(key), value)
+}
+
+func mappingDelete(n *yaml.Node, key string) {
+	if n == nil || n.Kind != yaml.MappingNode {
+		return
+	}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == key {
+			n.Content = append(n.Content[:i], n.Content[i+2:]...)
+			return
+		}
+	}
+}
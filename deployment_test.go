@@ -0,0 +1,67 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRewriteDeploymentEnv(t *testing.T) {
+	tests := []struct {
+		name string
+		env  string
+		want string
+	}{
+		{
+			name: "no env vars in the template",
+			env:  "          env:\n",
+			want: `          envFrom:
+            - configMapRef:
+                name: env-aion-foo
+`,
+		},
+		{
+			name: "literal and valueFrom env vars",
+			env: `          env:
+            - name: LOG_LEVEL
+              value: "debug"
+            - name: POD_NAME
+              valueFrom:
+                fieldRef:
+                  fieldPath: metadata.name
+`,
+			want: `          env:
+            - name: LOG_LEVEL
+              value: "debug"
+            - name: POD_NAME
+              valueFrom:
+                fieldRef:
+                  fieldPath: metadata.name
+          envFrom:
+            - configMapRef:
+                name: env-aion-foo
+`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manifest := `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: aion-foo
+spec:
+  template:
+    spec:
+      containers:
+        - name: aion-foo
+          image: repo/aion-foo:1.0
+` + tt.env
+			got, err := rewriteDeployment(manifest, &DeploymentPatch{ConfigMapName: "env-aion-foo"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasSuffix(got, "image: repo/aion-foo:1.0\n"+tt.want) {
+				t.Errorf("got\n%s\nwant the container to end with\n%s", got, tt.want)
+			}
+		})
+	}
+}
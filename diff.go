@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+)
+
+const (
+	FileAdded    = "A"
+	FileRemoved  = "D"
+	FileModified = "M"
+)
+
+// A file that's different in the two trees, relative to the root of each.
+type FileDiff struct {
+	Path   string
+	Status string
+}
+
+func listFiles(root string) (map[string]string, error) {
+	files := map[string]string{}
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if d.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		files[filepath.ToSlash(rel)] = path
+		return nil
+	})
+	return files, err
+}
+
+// Compare the files in `to` with those in `from`, like `git diff --name-status`.
+func diffTrees(from, to string) ([]*FileDiff, error) {
+	fromFiles, err := listFiles(from)
+	if err != nil {
+		return nil, err
+	}
+	toFiles, err := listFiles(to)
+	if err != nil {
+		return nil, err
+	}
+
+	var diffs []*FileDiff
+	for rel, path := range toFiles {
+		fromPath, ok := fromFiles[rel]
+		if !ok {
+			diffs = append(diffs, &FileDiff{Path: rel, Status: FileAdded})
+			continue
+		}
+		a, err := os.ReadFile(fromPath)
+		if err != nil {
+			return nil, err
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(a, b) {
+			diffs = append(diffs, &FileDiff{Path: rel, Status: FileModified})
+		}
+	}
+	for rel := range fromFiles {
+		if _, ok := toFiles[rel]; !ok {
+			diffs = append(diffs, &FileDiff{Path: rel, Status: FileRemoved})
+		}
+	}
+	sort.Slice(diffs, func(i, j int) bool {
+		return diffs[i].Path < diffs[j].Path
+	})
+	return diffs, nil
+}
+
+// How a service in the new output differs from the one in the gitops repository,
+// as the objects that each overlay is built into.
+type ServiceDiff struct {
+	Service string
+	Status  string
+	// By overlay, e.g. `production`, or `api/production` for a service with more
+	// than one Deployment.
+	Overlays map[string][]*ObjectDiff
+	// The overlays that couldn't be built, on either side.
+	Errors map[string]string
+}
+
+// A change to an object, and the overlays that it's in.
+type ServiceChange struct {
+	Object   string
+	Status   string
+	Field    *FieldDiff
+	Overlays []string
+}
+
+// The changes, with the ones that are the same in more than one overlay (e.g.,
+// anything in the base) only listed once.
+func (d *ServiceDiff) Changes() []*ServiceChange {
+	var changes []*ServiceChange
+	byKey := map[string]*ServiceChange{}
+	add := func(overlay string, change *ServiceChange) {
+		key := fmt.Sprintf("%s %s %v", change.Status, change.Object, change.Field)
+		if existing, ok := byKey[key]; ok {
+			existing.Overlays = append(existing.Overlays, overlay)
+			return
+		}
+		change.Overlays = []string{overlay}
+		byKey[key] = change
+		changes = append(changes, change)
+	}
+	for _, overlay := range sortedKeys(d.Overlays) {
+		for _, object := range d.Overlays[overlay] {
+			if len(object.Fields) == 0 {
+				add(overlay, &ServiceChange{Object: object.Object, Status: object.Status})
+			}
+			for _, field := range object.Fields {
+				add(overlay, &ServiceChange{Object: object.Object, Status: field.Status, Field: field})
+			}
+		}
+	}
+	return changes
+}
+
+// The services in the directory, i.e., its directories that have been kustomized.
+func listServices(dir string) (map[string]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	services := map[string]string{}
+	for _, entry := range entries {
+		if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		if dirs, err := kustomizedDirs(path); err == nil && len(dirs) > 0 {
+			services[entry.Name()] = path
+		}
+	}
+	return services, nil
+}
+
+// The overlays under the service's directory, relative to it.
+func listOverlays(serviceDir string) ([]string, error) {
+	if !checkFileExists(serviceDir) {
+		return nil, nil
+	}
+	dirs, err := kustomizedDirs(serviceDir)
+	if err != nil {
+		return nil, err
+	}
+	var overlays []string
+	for _, dir := range dirs {
+		envs, err := os.ReadDir(filepath.Join(dir, "overlays"))
+		if err != nil {
+			continue
+		}
+		for _, env := range envs {
+			if !env.IsDir() {
+				continue
+			}
+			rel, err := filepath.Rel(serviceDir, filepath.Join(dir, "overlays", env.Name()))
+			if err != nil {
+				return nil, err
+			}
+			overlays = append(overlays, filepath.ToSlash(rel))
+		}
+	}
+	return overlays, nil
+}
+
+// Compare each service in `to` with the one in `from` by building their overlays,
+// so that only what would be deployed differently matters, not how it's written.
+// `from` and `to` are the directories of each service.
+func diffServices(from, to map[string]string) ([]*ServiceDiff, error) {
+	services := sortedKeys(to)
+	for service := range from {
+		if _, ok := to[service]; !ok {
+			services = append(services, service)
+		}
+	}
+	sort.Strings(services)
+
+	var diffs []*ServiceDiff
+	for _, service := range services {
+		fromDir, inFrom := from[service]
+		toDir, inTo := to[service]
+		if !inFrom {
+			diffs = append(diffs, &ServiceDiff{Service: service, Status: FileAdded})
+			continue
+		}
+		if !inTo {
+			diffs = append(diffs, &ServiceDiff{Service: service, Status: FileRemoved})
+			continue
+		}
+		d := &ServiceDiff{Service: service, Status: FileModified, Overlays: map[string][]*ObjectDiff{}, Errors: map[string]string{}}
+		fromOverlays, err := listOverlays(fromDir)
+		if err != nil {
+			return nil, err
+		}
+		toOverlays, err := listOverlays(toDir)
+		if err != nil {
+			return nil, err
+		}
+		overlays := append([]string{}, toOverlays...)
+		for _, overlay := range fromOverlays {
+			if !slices.Contains(overlays, overlay) {
+				overlays = append(overlays, overlay)
+			}
+		}
+		for _, overlay := range overlays {
+			a, b := objects{}, objects{}
+			var err error
+			if slices.Contains(fromOverlays, overlay) {
+				a, _, err = buildObjects(filepath.Join(fromDir, overlay))
+			}
+			if err == nil && slices.Contains(toOverlays, overlay) {
+				b, _, err = buildObjects(filepath.Join(toDir, overlay))
+			}
+			if err != nil {
+				d.Errors[overlay] = err.Error()
+				continue
+			}
+			for _, o := range []objects{a, b} {
+				for _, object := range o {
+					pruneEmpty(object)
+				}
+			}
+			if objectDiffs := diffObjects(a, b); len(objectDiffs) > 0 {
+				d.Overlays[overlay] = objectDiffs
+			}
+		}
+		if len(d.Overlays) > 0 || len(d.Errors) > 0 {
+			diffs = append(diffs, d)
+		}
+	}
+	return diffs, nil
+}
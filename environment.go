@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// The default naming of the environment-specific values files, both in the
+// service's `.kube/environments` directory and in the `ansible-deployers` overrides.
+// See `values_file` in the project config.
+const defaultValuesFile = "{environment}-{name}.yaml"
+
+// The environment is the name of a directory and goes into the names of things,
+// so it's held to what Kubernetes allows for most names.
+// See https://kubernetes.io/docs/concepts/overview/working-with-objects/names/#dns-label-names.
+var reDNSLabel = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]{0,61}[a-z0-9])?$`)
+
+// See https://kubernetes.io/docs/concepts/overview/working-with-objects/labels/#syntax-and-character-set.
+var reLabelValue = regexp.MustCompile(`^[A-Za-z0-9]([-A-Za-z0-9_.]{0,61}[A-Za-z0-9])?$`)
+
+// An environment is an overlay in the kustomized directory structure.
+type Environment struct {
+	Name      string `yaml:"name"`
+	Namespace string `yaml:"namespace"`
+	// Everything in the overlay is labeled with the cluster (`cluster`).
+	Cluster string `yaml:"cluster"`
+	// Whether the resource requests and limits are patched into the Deployment.
+	ResourcePatches bool   `yaml:"resource_patches"`
+	IngressClass    string `yaml:"ingress_class"`
+	// The name of the values file, where `{environment}` is the name of the
+	// environment and `{name}` is the service name without hyphens.
+	ValuesFile string `yaml:"values_file"`
+}
+
+type EnvironmentsConfig struct {
+	Environments []*Environment `yaml:"environments"`
+}
+
+// These are the environments that AION has always had.
+func defaultEnvironments(valuesFile string) []*Environment {
+	return []*Environment{
+		{Name: "production", ResourcePatches: true, ValuesFile: valuesFile},
+		{Name: "beta", ResourcePatches: true, ValuesFile: valuesFile},
+		{Name: "development", ValuesFile: valuesFile},
+	}
+}
+
+// Read the environments from the config file.
+//
+//	environments:
+//	  - name: staging
+//	    namespace: aion-staging
+//	    cluster: us-east-1-nonprod
+//	    resource_patches: true
+//	    ingress_class: nginx-internal
+//	    values_file: "{environment}-{name}.yaml"
+//
+// An environment without a values file gets `valuesFile`.
+func loadEnvironments(filename, valuesFile string) ([]*Environment, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var config EnvironmentsConfig
+	decoder := yaml.NewDecoder(bytes.NewReader(b))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&config); err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	if len(config.Environments) == 0 {
+		return nil, fmt.Errorf("%s: no environments", filename)
+	}
+	return config.Environments, validateEnvironments(filename, config.Environments, valuesFile)
+}
+
+func validateEnvironments(filename string, environments []*Environment, valuesFile string) error {
+	seen := map[string]bool{}
+	for _, env := range environments {
+		if env.Name == "" {
+			return fmt.Errorf("%s: every environment needs a name", filename)
+		}
+		if !reDNSLabel.MatchString(env.Name) {
+			return fmt.Errorf("%s: `%s` isn't a valid environment name (lowercase letters, digits and `-`)", filename, env.Name)
+		}
+		if env.Cluster != "" && !reLabelValue.MatchString(env.Cluster) {
+			return fmt.Errorf("%s: the cluster of `%s` can't be used as a label", filename, env.Name)
+		}
+		if seen[env.Name] {
+			return fmt.Errorf("%s: the `%s` environment is declared more than once", filename, env.Name)
+		}
+		seen[env.Name] = true
+		if env.ValuesFile == "" {
+			env.ValuesFile = valuesFile
+		}
+		if !strings.Contains(env.ValuesFile, "{name}") {
+			return fmt.Errorf("%s: the values file for `%s` must contain `{name}`", filename, env.Name)
+		}
+	}
+	return nil
+}
+
+// The name of the environment's values file for the service.
+func (e *Environment) valuesFile(name string) string {
+	return strings.NewReplacer("{environment}", e.Name, "{name}", name).Replace(e.ValuesFile)
+}
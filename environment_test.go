@@ -0,0 +1,76 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateEnvironments(t *testing.T) {
+	tests := []struct {
+		name         string
+		environments []*Environment
+		want         string
+	}{
+		{"the defaults", defaultEnvironments(defaultValuesFile), ""},
+		{"a name with a dash", []*Environment{{Name: "qa-eu"}}, ""},
+		{"no name", []*Environment{{Name: ""}}, "every environment needs a name"},
+		{"dot", []*Environment{{Name: "."}}, "`.` isn't a valid environment name"},
+		{"dot dot", []*Environment{{Name: ".."}}, "`..` isn't a valid environment name"},
+		{"slash", []*Environment{{Name: "qa/eu"}}, "`qa/eu` isn't a valid environment name"},
+		{"backslash", []*Environment{{Name: `qa\eu`}}, "isn't a valid environment name"},
+		{"uppercase", []*Environment{{Name: "Production"}}, "`Production` isn't a valid environment name"},
+		{"underscore", []*Environment{{Name: "qa_eu"}}, "`qa_eu` isn't a valid environment name"},
+		{"leading dash", []*Environment{{Name: "-qa"}}, "`-qa` isn't a valid environment name"},
+		{"too long", []*Environment{{Name: strings.Repeat("a", 64)}}, "isn't a valid environment name"},
+		{"a cluster that isn't a label", []*Environment{{Name: "qa", Cluster: "us east"}}, "the cluster of `qa` can't be used as a label"},
+		{"declared twice", []*Environment{{Name: "qa"}, {Name: "qa"}}, "the `qa` environment is declared more than once"},
+		{"a values file without the name", []*Environment{{Name: "qa", ValuesFile: "qa.yaml"}}, "the values file for `qa` must contain `{name}`"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateEnvironments("environments.yaml", tt.environments, defaultValuesFile)
+			if tt.want == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("got no error, want `%s`", tt.want)
+			}
+			if !strings.HasPrefix(err.Error(), "environments.yaml: ") || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got `%s`, want `%s`", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadEnvironments(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "environments.yaml")
+	writeTestFile(t, filename, `environments:
+  - name: staging
+    namespace: aion-staging
+    cluster: us-east-1-nonprod
+  - name: qa-eu
+    values_file: "qa-{name}.yaml"
+`)
+	environments, err := loadEnvironments(filename, defaultValuesFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(environments) != 2 {
+		t.Fatalf("got %d environments, want 2", len(environments))
+	}
+	if got := environments[0].valuesFile("aion-foo"); got != "staging-aion-foo.yaml" {
+		t.Errorf("got values file %s, want staging-aion-foo.yaml", got)
+	}
+	if got := environments[1].valuesFile("aion-foo"); got != "qa-aion-foo.yaml" {
+		t.Errorf("got values file %s, want qa-aion-foo.yaml", got)
+	}
+
+	writeTestFile(t, filename, "environments:\n  - name: ..\n")
+	if _, err := loadEnvironments(filename, defaultValuesFile); err == nil || !strings.Contains(err.Error(), "`..` isn't a valid environment name") {
+		t.Errorf("got %v, want `..` to be rejected", err)
+	}
+}
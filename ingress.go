@@ -0,0 +1,21 @@
+package main
+
+import "gopkg.in/yaml.v3"
+
+// Set the `ingressClassName` of each Ingress in the rendered manifest.  This also
+// removes the old `kubernetes.io/ingress.class` annotation, since the two can't
+// both be set.
+func rewriteIngress(manifest, ingressClass string) (string, error) {
+	return rewriteManifest(manifest, "Ingress", func(ingress *yaml.Node) error {
+		spec := mappingGet(ingress, "spec")
+		if spec == nil || spec.Kind != yaml.MappingNode {
+			spec = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+			mappingSet(ingress, "spec", spec)
+		}
+		mappingSet(spec, "ingressClassName", scalarNode(ingressClass))
+		if annotations := mappingPath(ingress, "metadata", "annotations"); annotations != nil && annotations.Kind == yaml.MappingNode {
+			mappingDelete(annotations, "kubernetes.io/ingress.class")
+		}
+		return nil
+	})
+}
@@ -0,0 +1,846 @@
+package jinja
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// undefined is the value of any name, attribute or subscript that doesn't
+// resolve.  Like Jinja's `ChainableUndefined`, looking anything up on it
+// yields another undefined rather than an error so that a missing
+// `certificates_by_domain_and_region[apex_domain]` can still be reported
+// with the full expression.
+type undefined struct {
+	name string
+}
+
+// scope is a chain of variable maps.  Loops and `set` write to the
+// innermost one.
+type scope struct {
+	vars   map[string]interface{}
+	parent *scope
+}
+
+func (s *scope) lookup(name string) (interface{}, bool) {
+	for sc := s; sc != nil; sc = sc.parent {
+		if v, ok := sc.vars[name]; ok {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+type renderer struct {
+	out       strings.Builder
+	undefined []Undefined
+}
+
+func (r *renderer) render(nodes []node, sc *scope) error {
+	for _, n := range nodes {
+		switch n := n.(type) {
+		case *textNode:
+			r.out.WriteString(n.text)
+		case *outputNode:
+			v, err := eval(n.expr, sc)
+			if err != nil {
+				return fmt.Errorf("line %d: %w", n.line, err)
+			}
+			// Leave anything that couldn't be resolved in the output so that
+			// it's obvious in the generated manifest and can be reported.
+			if _, ok := v.(undefined); ok {
+				r.undefined = append(r.undefined, Undefined{Expression: n.src, Line: n.line})
+				r.out.WriteString("{{ " + n.src + " }}")
+				continue
+			}
+			r.out.WriteString(toString(v))
+		case *ifNode:
+			matched := false
+			for _, b := range n.branches {
+				v, err := eval(b.cond, sc)
+				if err != nil {
+					return err
+				}
+				if truthy(v) {
+					matched = true
+					if err := r.render(b.body, sc); err != nil {
+						return err
+					}
+					break
+				}
+			}
+			if !matched {
+				if err := r.render(n.orElse, sc); err != nil {
+					return err
+				}
+			}
+		case *forNode:
+			if err := r.renderFor(n, sc); err != nil {
+				return err
+			}
+		case *setNode:
+			v, err := eval(n.expr, sc)
+			if err != nil {
+				return err
+			}
+			sc.vars[n.name] = v
+		}
+	}
+	return nil
+}
+
+func (r *renderer) renderFor(n *forNode, sc *scope) error {
+	v, err := eval(n.iter, sc)
+	if err != nil {
+		return fmt.Errorf("line %d: %w", n.line, err)
+	}
+	items, err := iterate(v)
+	if err != nil {
+		return fmt.Errorf("line %d: %w", n.line, err)
+	}
+
+	inner := &scope{vars: map[string]interface{}{}, parent: sc}
+	bind := func(item interface{}) error {
+		if len(n.targets) == 1 {
+			inner.vars[n.targets[0]] = item
+			return nil
+		}
+		values, err := iterate(item)
+		if err != nil || len(values) != len(n.targets) {
+			return fmt.Errorf("line %d: cannot unpack `%s` into %d variables", n.line, toString(item), len(n.targets))
+		}
+		for i, target := range n.targets {
+			inner.vars[target] = values[i]
+		}
+		return nil
+	}
+
+	if n.cond != nil {
+		var filtered []interface{}
+		for _, item := range items {
+			if err := bind(item); err != nil {
+				return err
+			}
+			ok, err := eval(n.cond, inner)
+			if err != nil {
+				return err
+			}
+			if truthy(ok) {
+				filtered = append(filtered, item)
+			}
+		}
+		items = filtered
+	}
+
+	if len(items) == 0 {
+		return r.render(n.orElse, sc)
+	}
+	for i, item := range items {
+		if err := bind(item); err != nil {
+			return err
+		}
+		inner.vars["loop"] = map[string]interface{}{
+			"index":     i + 1,
+			"index0":    i,
+			"revindex":  len(items) - i,
+			"revindex0": len(items) - i - 1,
+			"first":     i == 0,
+			"last":      i == len(items)-1,
+			"length":    len(items),
+		}
+		if err := r.render(n.body, inner); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func eval(e expr, sc *scope) (interface{}, error) {
+	switch e := e.(type) {
+	case *literal:
+		return e.value, nil
+	case *name:
+		if v, ok := sc.lookup(e.name); ok {
+			return v, nil
+		}
+		return undefined{name: e.name}, nil
+	case *listExpr:
+		l := make([]interface{}, 0, len(e.items))
+		for _, item := range e.items {
+			v, err := eval(item, sc)
+			if err != nil {
+				return nil, err
+			}
+			l = append(l, v)
+		}
+		return l, nil
+	case *dictExpr:
+		d := make(map[string]interface{}, len(e.keys))
+		for i := range e.keys {
+			k, err := eval(e.keys[i], sc)
+			if err != nil {
+				return nil, err
+			}
+			v, err := eval(e.values[i], sc)
+			if err != nil {
+				return nil, err
+			}
+			d[toString(k)] = v
+		}
+		return d, nil
+	case *attrExpr:
+		obj, err := eval(e.object, sc)
+		if err != nil {
+			return nil, err
+		}
+		return getItem(obj, e.attr), nil
+	case *indexExpr:
+		obj, err := eval(e.object, sc)
+		if err != nil {
+			return nil, err
+		}
+		idx, err := eval(e.index, sc)
+		if err != nil {
+			return nil, err
+		}
+		return getItem(obj, idx), nil
+	case *sliceExpr:
+		return evalSlice(e, sc)
+	case *callExpr:
+		return evalCall(e, sc)
+	case *filterExpr:
+		obj, err := eval(e.object, sc)
+		if err != nil {
+			return nil, err
+		}
+		args, kwargs, err := evalArgs(e.args, e.kwargs, sc)
+		if err != nil {
+			return nil, err
+		}
+		f, ok := filters[e.name]
+		if !ok {
+			return nil, fmt.Errorf("no filter named `%s`", e.name)
+		}
+		// Whatever a filter would make of an undefined value (`0`, `null`, an
+		// empty string) would hide it, so it's left undefined to be reported.
+		if u, ok := obj.(undefined); ok && !undefinedFilters[e.name] {
+			return u, nil
+		}
+		return f(obj, args, kwargs)
+	case *testExpr:
+		obj, err := eval(e.object, sc)
+		if err != nil {
+			return nil, err
+		}
+		args, _, err := evalArgs(e.args, nil, sc)
+		if err != nil {
+			return nil, err
+		}
+		t, ok := tests[e.name]
+		if !ok {
+			return nil, fmt.Errorf("no test named `%s`", e.name)
+		}
+		return t(obj, args) != e.negate, nil
+	case *unaryExpr:
+		v, err := eval(e.operand, sc)
+		if err != nil {
+			return nil, err
+		}
+		if e.op == "not" {
+			return !truthy(v), nil
+		}
+		switch n := v.(type) {
+		case int:
+			return -n, nil
+		case float64:
+			return -n, nil
+		}
+		return nil, fmt.Errorf("bad operand for unary -: `%s`", describe(v))
+	case *binaryExpr:
+		return evalBinary(e, sc)
+	case *condExpr:
+		cond, err := eval(e.cond, sc)
+		if err != nil {
+			return nil, err
+		}
+		if truthy(cond) {
+			return eval(e.then, sc)
+		}
+		if e.orElse == nil {
+			return undefined{name: "inline if"}, nil
+		}
+		return eval(e.orElse, sc)
+	}
+	return nil, fmt.Errorf("unknown expression %T", e)
+}
+
+func evalArgs(argExprs []expr, kwargExprs map[string]expr, sc *scope) ([]interface{}, map[string]interface{}, error) {
+	args := make([]interface{}, 0, len(argExprs))
+	for _, a := range argExprs {
+		v, err := eval(a, sc)
+		if err != nil {
+			return nil, nil, err
+		}
+		args = append(args, v)
+	}
+	kwargs := make(map[string]interface{}, len(kwargExprs))
+	for k, a := range kwargExprs {
+		v, err := eval(a, sc)
+		if err != nil {
+			return nil, nil, err
+		}
+		kwargs[k] = v
+	}
+	return args, kwargs, nil
+}
+
+func evalBinary(e *binaryExpr, sc *scope) (interface{}, error) {
+	left, err := eval(e.left, sc)
+	if err != nil {
+		return nil, err
+	}
+	// Short circuit, returning the operand itself like Python does.
+	switch e.op {
+	case "and":
+		if !truthy(left) {
+			return left, nil
+		}
+		return eval(e.right, sc)
+	case "or":
+		if truthy(left) {
+			return left, nil
+		}
+		return eval(e.right, sc)
+	}
+
+	right, err := eval(e.right, sc)
+	if err != nil {
+		return nil, err
+	}
+	switch e.op {
+	case "==":
+		return equal(left, right), nil
+	case "!=":
+		return !equal(left, right), nil
+	case "in":
+		return contains(right, left)
+	case "not in":
+		ok, err := contains(right, left)
+		return !ok, err
+	case "~":
+		// Half of a name is as wrong as none of it, so it's reported.
+		for _, v := range []interface{}{left, right} {
+			if u, ok := v.(undefined); ok {
+				return u, nil
+			}
+		}
+		return toString(left) + toString(right), nil
+	case "<", "<=", ">", ">=":
+		c, err := compare(left, right)
+		if err != nil {
+			return nil, err
+		}
+		switch e.op {
+		case "<":
+			return c < 0, nil
+		case "<=":
+			return c <= 0, nil
+		case ">":
+			return c > 0, nil
+		}
+		return c >= 0, nil
+	}
+	return arithmetic(e.op, left, right)
+}
+
+func arithmetic(op string, left, right interface{}) (interface{}, error) {
+	if op == "+" {
+		switch l := left.(type) {
+		case string:
+			if r, ok := right.(string); ok {
+				return l + r, nil
+			}
+		case []interface{}:
+			if r, ok := right.([]interface{}); ok {
+				return append(append([]interface{}{}, l...), r...), nil
+			}
+		}
+	}
+	if op == "*" {
+		if s, ok := left.(string); ok {
+			if n, ok := right.(int); ok && n >= 0 {
+				return strings.Repeat(s, n), nil
+			}
+		}
+	}
+
+	li, lIsInt := left.(int)
+	ri, rIsInt := right.(int)
+	lf, lok := toFloat(left)
+	rf, rok := toFloat(right)
+	if !lok || !rok {
+		return nil, fmt.Errorf("unsupported operand types for %s: `%s` and `%s`", op, describe(left), describe(right))
+	}
+	bothInt := lIsInt && rIsInt
+	switch op {
+	case "+":
+		if bothInt {
+			return li + ri, nil
+		}
+		return lf + rf, nil
+	case "-":
+		if bothInt {
+			return li - ri, nil
+		}
+		return lf - rf, nil
+	case "*":
+		if bothInt {
+			return li * ri, nil
+		}
+		return lf * rf, nil
+	case "/":
+		if rf == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		return lf / rf, nil
+	case "//":
+		if rf == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		if bothInt {
+			return int(math.Floor(lf / rf)), nil
+		}
+		return math.Floor(lf / rf), nil
+	case "%":
+		if rf == 0 {
+			return nil, fmt.Errorf("modulo by zero")
+		}
+		if bothInt {
+			return ((li % ri) + ri) % ri, nil
+		}
+		return math.Mod(lf, rf), nil
+	}
+	return nil, fmt.Errorf("unknown operator `%s`", op)
+}
+
+func evalSlice(e *sliceExpr, sc *scope) (interface{}, error) {
+	obj, err := eval(e.object, sc)
+	if err != nil {
+		return nil, err
+	}
+	bound := func(b expr, def, length int) (int, error) {
+		if b == nil {
+			return def, nil
+		}
+		v, err := eval(b, sc)
+		if err != nil {
+			return 0, err
+		}
+		n, ok := v.(int)
+		if !ok {
+			return 0, fmt.Errorf("slice indices must be integers")
+		}
+		if n < 0 {
+			n += length
+		}
+		return max(0, min(n, length)), nil
+	}
+	var length int
+	switch o := obj.(type) {
+	case string:
+		length = len(o)
+	case []interface{}:
+		length = len(o)
+	default:
+		return undefined{name: "slice"}, nil
+	}
+	start, err := bound(e.start, 0, length)
+	if err != nil {
+		return nil, err
+	}
+	stop, err := bound(e.stop, length, length)
+	if err != nil {
+		return nil, err
+	}
+	if stop < start {
+		stop = start
+	}
+	if s, ok := obj.(string); ok {
+		return s[start:stop], nil
+	}
+	return obj.([]interface{})[start:stop], nil
+}
+
+func evalCall(e *callExpr, sc *scope) (interface{}, error) {
+	args, kwargs, err := evalArgs(e.args, e.kwargs, sc)
+	if err != nil {
+		return nil, err
+	}
+	switch callee := e.callee.(type) {
+	case *attrExpr:
+		obj, err := eval(callee.object, sc)
+		if err != nil {
+			return nil, err
+		}
+		return callMethod(obj, callee.attr, args)
+	case *name:
+		if f, ok := globals[callee.name]; ok {
+			return f(args, kwargs)
+		}
+		return nil, fmt.Errorf("no function named `%s`", callee.name)
+	}
+	return nil, fmt.Errorf("expression is not callable")
+}
+
+// callMethod supports the handful of Python `dict` and `str` methods that
+// show up in templates.
+func callMethod(obj interface{}, method string, args []interface{}) (interface{}, error) {
+	arg := func(i int) interface{} {
+		if i < len(args) {
+			return args[i]
+		}
+		return nil
+	}
+	if d, ok := toMap(obj); ok {
+		switch method {
+		case "items":
+			var items []interface{}
+			for _, k := range sortedKeys(d) {
+				items = append(items, []interface{}{k, d[k]})
+			}
+			return items, nil
+		case "keys":
+			var keys []interface{}
+			for _, k := range sortedKeys(d) {
+				keys = append(keys, k)
+			}
+			return keys, nil
+		case "values":
+			var values []interface{}
+			for _, k := range sortedKeys(d) {
+				values = append(values, d[k])
+			}
+			return values, nil
+		case "get":
+			if v, ok := d[toString(arg(0))]; ok {
+				return v, nil
+			}
+			return arg(1), nil
+		}
+	}
+	if s, ok := obj.(string); ok {
+		switch method {
+		case "lower":
+			return strings.ToLower(s), nil
+		case "upper":
+			return strings.ToUpper(s), nil
+		case "strip":
+			return strings.TrimSpace(s), nil
+		case "startswith":
+			return strings.HasPrefix(s, toString(arg(0))), nil
+		case "endswith":
+			return strings.HasSuffix(s, toString(arg(0))), nil
+		case "replace":
+			return strings.ReplaceAll(s, toString(arg(0)), toString(arg(1))), nil
+		case "split":
+			var parts []string
+			if len(args) == 0 {
+				parts = strings.Fields(s)
+			} else {
+				parts = strings.Split(s, toString(arg(0)))
+			}
+			l := make([]interface{}, len(parts))
+			for i, p := range parts {
+				l[i] = p
+			}
+			return l, nil
+		}
+	}
+	if u, ok := obj.(undefined); ok {
+		return u, nil
+	}
+	return nil, fmt.Errorf("`%s` has no method `%s`", describe(obj), method)
+}
+
+var globals = map[string]func([]interface{}, map[string]interface{}) (interface{}, error){
+	"range": func(args []interface{}, _ map[string]interface{}) (interface{}, error) {
+		bounds := []int{0, 0, 1}
+		switch len(args) {
+		case 1:
+			bounds[1], _ = args[0].(int)
+		case 2, 3:
+			for i, a := range args {
+				bounds[i], _ = a.(int)
+			}
+		default:
+			return nil, fmt.Errorf("range expects 1 to 3 arguments")
+		}
+		if bounds[2] == 0 {
+			return nil, fmt.Errorf("range step cannot be zero")
+		}
+		var l []interface{}
+		for i := bounds[0]; (bounds[2] > 0 && i < bounds[1]) || (bounds[2] < 0 && i > bounds[1]); i += bounds[2] {
+			l = append(l, i)
+		}
+		return l, nil
+	},
+}
+
+func getItem(obj interface{}, key interface{}) interface{} {
+	if u, ok := obj.(undefined); ok {
+		return u
+	}
+	if d, ok := toMap(obj); ok {
+		if v, ok := d[toString(key)]; ok {
+			return v
+		}
+		return undefined{name: toString(key)}
+	}
+	if l, ok := obj.([]interface{}); ok {
+		i, ok := key.(int)
+		if !ok {
+			if s, isString := key.(string); isString {
+				i, ok = atoi(s)
+			}
+		}
+		if ok {
+			if i < 0 {
+				i += len(l)
+			}
+			if i >= 0 && i < len(l) {
+				return l[i]
+			}
+		}
+	}
+	return undefined{name: toString(key)}
+}
+
+func atoi(s string) (int, bool) {
+	n, err := strconv.Atoi(s)
+	return n, err == nil
+}
+
+func iterate(v interface{}) ([]interface{}, error) {
+	switch v := v.(type) {
+	case undefined, nil:
+		return nil, nil
+	case []interface{}:
+		return v, nil
+	case string:
+		var l []interface{}
+		for _, r := range v {
+			l = append(l, string(r))
+		}
+		return l, nil
+	}
+	if d, ok := toMap(v); ok {
+		var keys []interface{}
+		for _, k := range sortedKeys(d) {
+			keys = append(keys, k)
+		}
+		return keys, nil
+	}
+	return nil, fmt.Errorf("`%s` is not iterable", describe(v))
+}
+
+func contains(container, item interface{}) (bool, error) {
+	switch c := container.(type) {
+	case string:
+		return strings.Contains(c, toString(item)), nil
+	case []interface{}:
+		for _, v := range c {
+			if equal(v, item) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case undefined:
+		return false, nil
+	}
+	if d, ok := toMap(container); ok {
+		_, ok := d[toString(item)]
+		return ok, nil
+	}
+	return false, fmt.Errorf("argument of type `%s` is not iterable", describe(container))
+}
+
+func equal(a, b interface{}) bool {
+	if af, ok := toFloat(a); ok {
+		if bf, ok := toFloat(b); ok {
+			return af == bf
+		}
+	}
+	_, aUndefined := a.(undefined)
+	_, bUndefined := b.(undefined)
+	if aUndefined || bUndefined {
+		return aUndefined && bUndefined
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func compare(a, b interface{}) (int, error) {
+	if af, ok := toFloat(a); ok {
+		if bf, ok := toFloat(b); ok {
+			switch {
+			case af < bf:
+				return -1, nil
+			case af > bf:
+				return 1, nil
+			}
+			return 0, nil
+		}
+	}
+	as, aok := a.(string)
+	bs, bok := b.(string)
+	if aok && bok {
+		return strings.Compare(as, bs), nil
+	}
+	return 0, fmt.Errorf("cannot compare `%s` and `%s`", describe(a), describe(b))
+}
+
+func truthy(v interface{}) bool {
+	switch v := v.(type) {
+	case nil, undefined:
+		return false
+	case bool:
+		return v
+	case int:
+		return v != 0
+	case float64:
+		return v != 0
+	case string:
+		return v != ""
+	case []interface{}:
+		return len(v) > 0
+	}
+	if d, ok := toMap(v); ok {
+		return len(d) > 0
+	}
+	return true
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case float64:
+		return n, true
+	case bool:
+		if n {
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// toMap normalizes the map types that yaml.v3 can produce.
+func toMap(v interface{}) (map[string]interface{}, bool) {
+	switch m := v.(type) {
+	case map[string]interface{}:
+		return m, true
+	case map[string]string:
+		d := make(map[string]interface{}, len(m))
+		for k, v := range m {
+			d[k] = v
+		}
+		return d, true
+	case map[interface{}]interface{}:
+		d := make(map[string]interface{}, len(m))
+		for k, v := range m {
+			d[toString(k)] = v
+		}
+		return d, true
+	case nil, undefined, string, bool, int, float64, []interface{}:
+		return nil, false
+	}
+	// Named map types, e.g. a `ManifestValues` whose nested maps yaml.v3
+	// decodes into the same named type.
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Map {
+		return nil, false
+	}
+	d := make(map[string]interface{}, rv.Len())
+	iter := rv.MapRange()
+	for iter.Next() {
+		d[toString(iter.Key().Interface())] = iter.Value().Interface()
+	}
+	return d, true
+}
+
+func sortedKeys(d map[string]interface{}) []string {
+	keys := make([]string, 0, len(d))
+	for k := range d {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// toString renders a value the way Python's `str()` would.
+func toString(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "None"
+	case undefined:
+		return ""
+	case string:
+		return v
+	case bool:
+		if v {
+			return "True"
+		}
+		return "False"
+	case int:
+		return strconv.Itoa(v)
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) < 1e16 {
+			return strconv.FormatFloat(v, 'f', 1, 64)
+		}
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+	return repr(v)
+}
+
+// repr renders a value the way Python's `repr()` would, which is what ends
+// up in the output when a list or dict is printed directly.
+func repr(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return "'" + strings.ReplaceAll(v, "'", `\'`) + "'"
+	case []interface{}:
+		parts := make([]string, len(v))
+		for i, item := range v {
+			parts[i] = repr(item)
+		}
+		return "[" + strings.Join(parts, ", ") + "]"
+	}
+	if d, ok := toMap(v); ok {
+		parts := make([]string, 0, len(d))
+		for _, k := range sortedKeys(d) {
+			parts = append(parts, repr(k)+": "+repr(d[k]))
+		}
+		return "{" + strings.Join(parts, ", ") + "}"
+	}
+	if _, ok := v.(undefined); ok {
+		return ""
+	}
+	switch v.(type) {
+	case nil, bool, int, float64:
+		return toString(v)
+	}
+	return fmt.Sprint(v)
+}
+
+func describe(v interface{}) string {
+	if u, ok := v.(undefined); ok {
+		return fmt.Sprintf("undefined (%s)", u.name)
+	}
+	if v == nil {
+		return "None"
+	}
+	return fmt.Sprintf("%T", v)
+}
@@ -0,0 +1,483 @@
+package jinja
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+type filterFunc func(v interface{}, args []interface{}, kwargs map[string]interface{}) (interface{}, error)
+
+// arg returns the positional argument at `i`, or the keyword argument
+// `name`, falling back to `def`.
+func arg(args []interface{}, kwargs map[string]interface{}, i int, name string, def interface{}) interface{} {
+	if i < len(args) {
+		return args[i]
+	}
+	if v, ok := kwargs[name]; ok {
+		return v
+	}
+	return def
+}
+
+// These are the Jinja builtins and Ansible filters that have been seen in
+// the `.kube` templates, plus a few that are cheap to support.
+var filters map[string]filterFunc
+
+func init() {
+	filters = map[string]filterFunc{
+		"default":    filterDefault,
+		"d":          filterDefault,
+		"lower":      stringFilter(strings.ToLower),
+		"upper":      stringFilter(strings.ToUpper),
+		"trim":       stringFilter(strings.TrimSpace),
+		"capitalize": stringFilter(capitalize),
+		"title":      stringFilter(title),
+		"quote":      stringFilter(quote),
+		"b64encode":  stringFilter(func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }),
+		"string": func(v interface{}, _ []interface{}, _ map[string]interface{}) (interface{}, error) {
+			return toString(v), nil
+		},
+		"b64decode":     filterB64Decode,
+		"int":           filterInt,
+		"float":         filterFloat,
+		"bool":          filterBool,
+		"length":        filterLength,
+		"count":         filterLength,
+		"join":          filterJoin,
+		"first":         filterFirst,
+		"last":          filterLast,
+		"list":          filterList,
+		"sort":          filterSort,
+		"unique":        filterUnique,
+		"replace":       filterReplace,
+		"regex_replace": filterRegexReplace,
+		"indent":        filterIndent,
+		"dict2items":    filterDict2Items,
+		"mandatory":     filterMandatory,
+		"to_json":       filterToJSON,
+		"to_nice_json":  filterToNiceJSON,
+		"to_yaml":       filterToYAML,
+		"to_nice_yaml":  filterToYAML,
+	}
+}
+
+// The filters that are given an undefined value, rather than passing it through
+// (see `eval`).
+var undefinedFilters = map[string]bool{
+	"default":   true,
+	"d":         true,
+	"mandatory": true,
+}
+
+func stringFilter(f func(string) string) filterFunc {
+	return func(v interface{}, _ []interface{}, _ map[string]interface{}) (interface{}, error) {
+		return f(toString(v)), nil
+	}
+}
+
+func filterDefault(v interface{}, args []interface{}, kwargs map[string]interface{}) (interface{}, error) {
+	def := arg(args, kwargs, 0, "default_value", "")
+	boolean := truthy(arg(args, kwargs, 1, "boolean", false))
+	if _, ok := v.(undefined); ok {
+		return def, nil
+	}
+	if boolean && !truthy(v) {
+		return def, nil
+	}
+	return v, nil
+}
+
+func filterMandatory(v interface{}, args []interface{}, kwargs map[string]interface{}) (interface{}, error) {
+	if u, ok := v.(undefined); ok {
+		msg := toString(arg(args, kwargs, 0, "msg", fmt.Sprintf("mandatory variable `%s` not defined", u.name)))
+		return nil, fmt.Errorf("%s", msg)
+	}
+	return v, nil
+}
+
+func capitalize(s string) string {
+	if s == "" {
+		return s
+	}
+	return strings.ToUpper(s[:1]) + strings.ToLower(s[1:])
+}
+
+func title(s string) string {
+	words := strings.Fields(s)
+	for i, w := range words {
+		words[i] = capitalize(w)
+	}
+	return strings.Join(words, " ")
+}
+
+// quote is Ansible's shell quoting filter.
+func quote(s string) string {
+	if s != "" && strings.Trim(s, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789@%+=:,./-_") == "" {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'"'"'`) + "'"
+}
+
+func filterB64Decode(v interface{}, _ []interface{}, _ map[string]interface{}) (interface{}, error) {
+	b, err := base64.StdEncoding.DecodeString(toString(v))
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+func filterInt(v interface{}, args []interface{}, kwargs map[string]interface{}) (interface{}, error) {
+	def := arg(args, kwargs, 0, "default", 0)
+	switch n := v.(type) {
+	case int:
+		return n, nil
+	case float64:
+		return int(n), nil
+	case bool:
+		if n {
+			return 1, nil
+		}
+		return 0, nil
+	case string:
+		if i, err := strconv.Atoi(strings.TrimSpace(n)); err == nil {
+			return i, nil
+		}
+		if f, err := strconv.ParseFloat(strings.TrimSpace(n), 64); err == nil {
+			return int(f), nil
+		}
+	}
+	return def, nil
+}
+
+func filterFloat(v interface{}, args []interface{}, kwargs map[string]interface{}) (interface{}, error) {
+	def := arg(args, kwargs, 0, "default", 0.0)
+	if f, ok := toFloat(v); ok {
+		return f, nil
+	}
+	if s, ok := v.(string); ok {
+		if f, err := strconv.ParseFloat(strings.TrimSpace(s), 64); err == nil {
+			return f, nil
+		}
+	}
+	return def, nil
+}
+
+// filterBool follows Ansible's `bool` filter rather than Python's `bool()`.
+func filterBool(v interface{}, _ []interface{}, _ map[string]interface{}) (interface{}, error) {
+	switch b := v.(type) {
+	case bool:
+		return b, nil
+	case string:
+		switch strings.ToLower(strings.TrimSpace(b)) {
+		case "yes", "on", "1", "true", "y", "t":
+			return true, nil
+		}
+		return false, nil
+	}
+	if f, ok := toFloat(v); ok {
+		return f == 1, nil
+	}
+	return false, nil
+}
+
+func filterLength(v interface{}, _ []interface{}, _ map[string]interface{}) (interface{}, error) {
+	switch c := v.(type) {
+	case string:
+		return len([]rune(c)), nil
+	case []interface{}:
+		return len(c), nil
+	}
+	if d, ok := toMap(v); ok {
+		return len(d), nil
+	}
+	return nil, fmt.Errorf("object of type `%s` has no length", describe(v))
+}
+
+func filterJoin(v interface{}, args []interface{}, kwargs map[string]interface{}) (interface{}, error) {
+	items, err := iterate(v)
+	if err != nil {
+		return nil, err
+	}
+	parts := make([]string, len(items))
+	for i, item := range items {
+		parts[i] = toString(item)
+	}
+	return strings.Join(parts, toString(arg(args, kwargs, 0, "d", ""))), nil
+}
+
+func filterFirst(v interface{}, _ []interface{}, _ map[string]interface{}) (interface{}, error) {
+	items, err := iterate(v)
+	if err != nil {
+		return nil, err
+	}
+	if len(items) == 0 {
+		return undefined{name: "first"}, nil
+	}
+	return items[0], nil
+}
+
+func filterLast(v interface{}, _ []interface{}, _ map[string]interface{}) (interface{}, error) {
+	items, err := iterate(v)
+	if err != nil {
+		return nil, err
+	}
+	if len(items) == 0 {
+		return undefined{name: "last"}, nil
+	}
+	return items[len(items)-1], nil
+}
+
+func filterList(v interface{}, _ []interface{}, _ map[string]interface{}) (interface{}, error) {
+	items, err := iterate(v)
+	if err != nil {
+		return nil, err
+	}
+	if items == nil {
+		items = []interface{}{}
+	}
+	return items, nil
+}
+
+func filterSort(v interface{}, args []interface{}, kwargs map[string]interface{}) (interface{}, error) {
+	items, err := iterate(v)
+	if err != nil {
+		return nil, err
+	}
+	sorted := append([]interface{}{}, items...)
+	reverse := truthy(arg(args, kwargs, 0, "reverse", false))
+	var sortErr error
+	sort.SliceStable(sorted, func(i, j int) bool {
+		c, err := compare(sorted[i], sorted[j])
+		if err != nil {
+			sortErr = err
+		}
+		if reverse {
+			return c > 0
+		}
+		return c < 0
+	})
+	return sorted, sortErr
+}
+
+func filterUnique(v interface{}, _ []interface{}, _ map[string]interface{}) (interface{}, error) {
+	items, err := iterate(v)
+	if err != nil {
+		return nil, err
+	}
+	var unique []interface{}
+	for _, item := range items {
+		if ok, _ := contains(unique, item); !ok {
+			unique = append(unique, item)
+		}
+	}
+	return unique, nil
+}
+
+func filterReplace(v interface{}, args []interface{}, kwargs map[string]interface{}) (interface{}, error) {
+	if len(args) < 2 {
+		return nil, fmt.Errorf("replace expects 2 arguments")
+	}
+	s := toString(v)
+	n := -1
+	if c, ok := arg(args, kwargs, 2, "count", -1).(int); ok {
+		n = c
+	}
+	return strings.Replace(s, toString(args[0]), toString(args[1]), n), nil
+}
+
+func filterRegexReplace(v interface{}, args []interface{}, kwargs map[string]interface{}) (interface{}, error) {
+	re, err := regexp.Compile(toString(arg(args, kwargs, 0, "pattern", "")))
+	if err != nil {
+		return nil, err
+	}
+	// Python uses `\1` for backreferences.
+	repl := regexp.MustCompile(`\\(\d+)`).ReplaceAllString(toString(arg(args, kwargs, 1, "replacement", "")), "$${$1}")
+	return re.ReplaceAllString(toString(v), repl), nil
+}
+
+func filterIndent(v interface{}, args []interface{}, kwargs map[string]interface{}) (interface{}, error) {
+	width := 4
+	if w, ok := arg(args, kwargs, 0, "width", 4).(int); ok {
+		width = w
+	}
+	first := truthy(arg(args, kwargs, 1, "first", false))
+	blank := truthy(arg(args, kwargs, 2, "blank", false))
+	pad := strings.Repeat(" ", width)
+	lines := strings.Split(toString(v), "\n")
+	for i, line := range lines {
+		if (i == 0 && !first) || (line == "" && !blank) {
+			continue
+		}
+		lines[i] = pad + line
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+func filterDict2Items(v interface{}, args []interface{}, kwargs map[string]interface{}) (interface{}, error) {
+	d, ok := toMap(v)
+	if !ok {
+		return nil, fmt.Errorf("dict2items requires a dictionary, got `%s`", describe(v))
+	}
+	keyName := toString(arg(args, kwargs, 0, "key_name", "key"))
+	valueName := toString(arg(args, kwargs, 1, "value_name", "value"))
+	var items []interface{}
+	for _, k := range sortedKeys(d) {
+		items = append(items, map[string]interface{}{keyName: k, valueName: d[k]})
+	}
+	return items, nil
+}
+
+func filterToJSON(v interface{}, _ []interface{}, _ map[string]interface{}) (interface{}, error) {
+	b, err := json.Marshal(jsonable(v))
+	if err != nil {
+		return nil, err
+	}
+	// Python's json.dumps separates items with ", " and keys with ": ".
+	return pythonJSONSpacing(string(b)), nil
+}
+
+func filterToNiceJSON(v interface{}, args []interface{}, kwargs map[string]interface{}) (interface{}, error) {
+	indent := 4
+	if i, ok := arg(args, kwargs, 0, "indent", 4).(int); ok {
+		indent = i
+	}
+	b, err := json.MarshalIndent(jsonable(v), "", strings.Repeat(" ", indent))
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+func filterToYAML(v interface{}, _ []interface{}, _ map[string]interface{}) (interface{}, error) {
+	b, err := yaml.Marshal(jsonable(v))
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+// jsonable converts undefined values to nil and normalizes map types.
+func jsonable(v interface{}) interface{} {
+	switch v := v.(type) {
+	case undefined:
+		return nil
+	case []interface{}:
+		l := make([]interface{}, len(v))
+		for i, item := range v {
+			l[i] = jsonable(item)
+		}
+		return l
+	}
+	if d, ok := toMap(v); ok {
+		m := make(map[string]interface{}, len(d))
+		for k, item := range d {
+			m[k] = jsonable(item)
+		}
+		return m
+	}
+	return v
+}
+
+func pythonJSONSpacing(s string) string {
+	var b strings.Builder
+	inString := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		b.WriteByte(c)
+		if inString {
+			if c == '\\' && i+1 < len(s) {
+				i++
+				b.WriteByte(s[i])
+			} else if c == '"' {
+				inString = false
+			}
+			continue
+		}
+		switch c {
+		case '"':
+			inString = true
+		case ',', ':':
+			b.WriteByte(' ')
+		}
+	}
+	return b.String()
+}
+
+type testFunc func(v interface{}, args []interface{}) bool
+
+var tests = map[string]testFunc{
+	"defined": func(v interface{}, _ []interface{}) bool {
+		_, ok := v.(undefined)
+		return !ok
+	},
+	"undefined": func(v interface{}, _ []interface{}) bool {
+		_, ok := v.(undefined)
+		return ok
+	},
+	"none": func(v interface{}, _ []interface{}) bool {
+		return v == nil
+	},
+	"string": func(v interface{}, _ []interface{}) bool {
+		_, ok := v.(string)
+		return ok
+	},
+	"number": func(v interface{}, _ []interface{}) bool {
+		switch v.(type) {
+		case int, float64:
+			return true
+		}
+		return false
+	},
+	"integer": func(v interface{}, _ []interface{}) bool {
+		_, ok := v.(int)
+		return ok
+	},
+	"mapping": func(v interface{}, _ []interface{}) bool {
+		_, ok := toMap(v)
+		return ok
+	},
+	"sequence": isIterable,
+	"iterable": isIterable,
+	"true": func(v interface{}, _ []interface{}) bool {
+		b, ok := v.(bool)
+		return ok && b
+	},
+	"false": func(v interface{}, _ []interface{}) bool {
+		b, ok := v.(bool)
+		return ok && !b
+	},
+	"even": func(v interface{}, _ []interface{}) bool {
+		n, ok := v.(int)
+		return ok && n%2 == 0
+	},
+	"odd": func(v interface{}, _ []interface{}) bool {
+		n, ok := v.(int)
+		return ok && n%2 != 0
+	},
+	"in": func(v interface{}, args []interface{}) bool {
+		if len(args) == 0 {
+			return false
+		}
+		ok, _ := contains(args[0], v)
+		return ok
+	},
+	"eq": func(v interface{}, args []interface{}) bool {
+		return len(args) > 0 && equal(v, args[0])
+	},
+}
+
+func isIterable(v interface{}, _ []interface{}) bool {
+	switch v.(type) {
+	case string, []interface{}:
+		return true
+	}
+	_, ok := toMap(v)
+	return ok
+}
@@ -0,0 +1,166 @@
+package jinja
+
+import (
+	"testing"
+)
+
+func TestFilters(t *testing.T) {
+	vars := map[string]interface{}{
+		"name":     "aion-foo",
+		"empty":    "",
+		"replicas": 2,
+		"ratio":    1.5,
+		"ports":    []interface{}{8080, 80, 8080},
+		"labels":   map[string]interface{}{"tier": "web", "app": "aion-foo"},
+		"encoded":  "YWlvbg==",
+		"script":   "line one\nline two\n\nline four",
+		"quoted":   "it's",
+		"nothing":  nil,
+		"yes":      "yes",
+	}
+	tests := []struct {
+		name     string
+		template string
+		want     string
+	}{
+		{"default undefined", "{{ missing | default('x') }}", "x"},
+		{"default defined", "{{ name | default('x') }}", "aion-foo"},
+		{"default empty", "{{ empty | default('x') }}", ""},
+		{"default empty with boolean", "{{ empty | default('x', true) }}", "x"},
+		{"default keyword", "{{ empty | default(default_value='x', boolean=true) }}", "x"},
+		{"d", "{{ missing | d(2) }}", "2"},
+		{"default none", "{{ nothing | default('x') }}", "None"},
+		{"mandatory", "{{ name | mandatory }}", "aion-foo"},
+		{"lower", "{{ 'AION' | lower }}", "aion"},
+		{"upper", "{{ name | upper }}", "AION-FOO"},
+		{"trim", "{{ '  aion  ' | trim }}", "aion"},
+		{"capitalize", "{{ 'aION foo' | capitalize }}", "Aion foo"},
+		{"title", "{{ 'aion foo' | title }}", "Aion Foo"},
+		{"quote safe", "{{ name | quote }}", "aion-foo"},
+		{"quote", "{{ quoted | quote }}", `'it'"'"'s'`},
+		{"b64encode", "{{ 'aion' | b64encode }}", "YWlvbg=="},
+		{"b64decode", "{{ encoded | b64decode }}", "aion"},
+		{"string", "{{ replicas | string }}", "2"},
+		{"int", "{{ '42' | int + 1 }}", "43"},
+		{"int float string", "{{ '4.7' | int }}", "4"},
+		{"int default", "{{ 'x' | int(7) }}", "7"},
+		{"float", "{{ replicas | float }}", "2.0"},
+		{"float default", "{{ 'x' | float }}", "0.0"},
+		{"bool yes", "{{ yes | bool }}", "True"},
+		{"bool no", "{{ 'no' | bool }}", "False"},
+		{"bool number", "{{ 1 | bool }}", "True"},
+		{"length", "{{ ports | length }}", "3"},
+		{"length string", "{{ name | length }}", "8"},
+		{"length mapping", "{{ labels | count }}", "2"},
+		{"join", "{{ ports | join(',') }}", "8080,80,8080"},
+		{"first", "{{ ports | first }}", "8080"},
+		{"last", "{{ ports | last }}", "8080"},
+		{"list", "{{ name | list | first }}", "a"},
+		{"sort", "{{ ports | sort | join(' ') }}", "80 8080 8080"},
+		{"sort reverse", "{{ ports | sort(reverse=true) | join(' ') }}", "8080 8080 80"},
+		{"unique", "{{ ports | unique | join(' ') }}", "8080 80"},
+		{"replace", "{{ name | replace('-', '_') }}", "aion_foo"},
+		{"replace count", "{{ 'a-b-c' | replace('-', '_', 1) }}", "a_b-c"},
+		{"regex_replace", `{{ name | regex_replace('^(\\w+)-(\\w+)$', '\\2.\\1') }}`, "foo.aion"},
+		{"indent", "{{ script | indent(2) }}", "line one\n  line two\n\n  line four"},
+		{"indent first", "{{ script | indent(2, true) }}", "  line one\n  line two\n\n  line four"},
+		{"indent blank", "{{ script | indent(width=2, blank=true) }}", "line one\n  line two\n  \n  line four"},
+		{"dict2items", "{% for item in labels | dict2items %}{{ item.key }}={{ item.value }} {% endfor %}", "app=aion-foo tier=web "},
+		{"dict2items names", "{% for item in labels | dict2items('k', 'v') %}{{ item.k }} {% endfor %}", "app tier "},
+		{"to_json", "{{ labels | to_json }}", `{"app": "aion-foo", "tier": "web"}`},
+		{"to_json list", "{{ [1, 'a', true, none] | to_json }}", `[1, "a", true, null]`},
+		{"to_json string", `{{ 'a, b: c' | to_json }}`, `"a, b: c"`},
+		{"to_nice_json", "{{ {'a': [1]} | to_nice_json(indent=2) }}", "{\n  \"a\": [\n    1\n  ]\n}"},
+		{"to_yaml", "{{ labels | to_yaml }}", "app: aion-foo\ntier: web\n"},
+		{"chained", "{{ missing | default(name) | upper | replace('-', '') }}", "AIONFOO"},
+		{"ratio", "{{ ratio }}", "1.5"},
+		{"print list", "{{ ports }}", "[8080, 80, 8080]"},
+		{"print mapping", "{{ labels }}", "{'app': 'aion-foo', 'tier': 'web'}"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, undefined, err := Render("test.j2", tt.template, vars)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(undefined) > 0 {
+				t.Errorf("got undefined %v", undefined)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFilterErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		want     string
+	}{
+		{"unknown filter", "a: 1\nb: {{ name | shout }}", "test.j2: line 2: no filter named `shout`"},
+		{"mandatory", "{{ missing | mandatory }}", "test.j2: line 1: mandatory variable `missing` not defined"},
+		{"mandatory message", "{{ missing | mandatory('set it') }}", "test.j2: line 1: set it"},
+		{"replace arguments", "{{ 'a' | replace('a') }}", "test.j2: line 1: replace expects 2 arguments"},
+		{"dict2items", "{{ 'a' | dict2items }}", "test.j2: line 1: dict2items requires a dictionary, got `string`"},
+		{"length", "{{ 1 | length }}", "test.j2: line 1: object of type `int` has no length"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := Render("test.j2", tt.template, map[string]interface{}{"name": "aion-foo"})
+			if err == nil {
+				t.Fatal("got no error")
+			}
+			if err.Error() != tt.want {
+				t.Errorf("got %q, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestTests(t *testing.T) {
+	vars := map[string]interface{}{
+		"name":    "aion-foo",
+		"ports":   []interface{}{80, 443},
+		"labels":  map[string]interface{}{"app": "aion-foo"},
+		"nothing": nil,
+		"enabled": true,
+	}
+	tests := []struct {
+		name     string
+		template string
+		want     string
+	}{
+		{"defined", "{{ name is defined }}", "True"},
+		{"not defined", "{{ missing is not defined }}", "True"},
+		{"undefined", "{{ missing is undefined }}", "True"},
+		{"none", "{{ nothing is none }}", "True"},
+		{"string", "{{ name is string }}", "True"},
+		{"number", "{{ 1.5 is number }}", "True"},
+		{"integer", "{{ 1.5 is integer }}", "False"},
+		{"mapping", "{{ labels is mapping }}", "True"},
+		{"sequence", "{{ ports is sequence }}", "True"},
+		{"iterable", "{{ 1 is iterable }}", "False"},
+		{"true", "{{ enabled is true }}", "True"},
+		{"false", "{{ 'False' is false }}", "False"},
+		{"even", "{{ 4 is even }}", "True"},
+		{"odd", "{{ 4 is odd }}", "False"},
+		{"in", "{{ 443 is in(ports) }}", "True"},
+		{"literal argument", "{{ name is eq 'aion-foo' }}", "True"},
+		{"eq", "{{ name is eq('aion-foo') }}", "True"},
+		{"in operator", "{{ 'app' in labels }}", "True"},
+		{"not in operator", "{{ 8080 not in ports }}", "True"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, _, err := Render("test.j2", tt.template, vars)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
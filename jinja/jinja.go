@@ -0,0 +1,62 @@
+// Package jinja renders the subset of Jinja2 that the `.kube/*.j2`
+// manifest templates use: expressions with filters, tests and subscripts,
+// `if`/`elif`/`else`, `for` loops and `set`.
+//
+// Templates are rendered the way Ansible renders them (`trim_blocks`), and
+// `lstrip_blocks` is also enabled so that block tags on their own line leave
+// no trace in the output.
+//
+// Any `{{ }}` expression that doesn't resolve is left in the output verbatim
+// and reported to the caller rather than being rendered as an empty string.
+package jinja
+
+import (
+	"fmt"
+)
+
+type Template struct {
+	Name  string
+	nodes []node
+}
+
+// Undefined describes an output expression that could not be resolved.
+type Undefined struct {
+	Expression string
+	Line       int
+}
+
+func (u Undefined) String() string {
+	return fmt.Sprintf("line %d: {{ %s }}", u.Line, u.Expression)
+}
+
+func Parse(name, source string) (*Template, error) {
+	chunks, err := splitChunks(source)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	nodes, err := parseNodes(chunks)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return &Template{Name: name, nodes: nodes}, nil
+}
+
+// Render evaluates the template against `vars`.  The returned slice lists
+// every output expression that was left unresolved, in order.
+func (t *Template) Render(vars map[string]interface{}) (string, []Undefined, error) {
+	r := &renderer{}
+	sc := &scope{vars: map[string]interface{}{}, parent: &scope{vars: vars}}
+	if err := r.render(t.nodes, sc); err != nil {
+		return "", nil, fmt.Errorf("%s: %w", t.Name, err)
+	}
+	return r.out.String(), r.undefined, nil
+}
+
+// Render is a convenience for parsing and rendering a template in one go.
+func Render(name, source string, vars map[string]interface{}) (string, []Undefined, error) {
+	t, err := Parse(name, source)
+	if err != nil {
+		return "", nil, err
+	}
+	return t.Render(vars)
+}
@@ -0,0 +1,292 @@
+package jinja
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestUndefined(t *testing.T) {
+	vars := map[string]interface{}{
+		"service_name": "aion-foo",
+		"apex_domain":  "example.com",
+		"certificates_by_domain_and_region": map[string]interface{}{
+			"example.com": map[string]interface{}{"us-east-1": "arn:aws:acm:cert"},
+		},
+		"region":  "eu-west-1",
+		"enabled": true,
+	}
+	tests := []struct {
+		name      string
+		template  string
+		want      string
+		undefined []Undefined
+	}{
+		{
+			name:     "left in the output verbatim",
+			template: "name: {{ service_name }}\nimage: {{container_image}}\n",
+			want:     "name: aion-foo\nimage: {{ container_image }}\n",
+			undefined: []Undefined{
+				{Expression: "container_image", Line: 2},
+			},
+		},
+		{
+			name:     "the full expression is reported",
+			template: "arn: {{ certificates_by_domain_and_region[apex_domain][region] }}\n",
+			want:     "arn: {{ certificates_by_domain_and_region[apex_domain][region] }}\n",
+			undefined: []Undefined{
+				{Expression: "certificates_by_domain_and_region[apex_domain][region]", Line: 1},
+			},
+		},
+		{
+			name:     "chained attributes",
+			template: "{{ missing.foo.bar }}",
+			want:     "{{ missing.foo.bar }}",
+			undefined: []Undefined{
+				{Expression: "missing.foo.bar", Line: 1},
+			},
+		},
+		{
+			name:     "string filters keep it undefined",
+			template: "{{ missing | upper }}",
+			want:     "{{ missing | upper }}",
+			undefined: []Undefined{
+				{Expression: "missing | upper", Line: 1},
+			},
+		},
+		{
+			name:     "concatenation keeps it undefined",
+			template: "{{ missing ~ '-svc' }}",
+			want:     "{{ missing ~ '-svc' }}",
+			undefined: []Undefined{
+				{Expression: "missing ~ '-svc'", Line: 1},
+			},
+		},
+		{
+			name:     "concatenation on the right keeps it undefined",
+			template: "{{ service_name ~ '.' ~ missing }}",
+			want:     "{{ service_name ~ '.' ~ missing }}",
+			undefined: []Undefined{
+				{Expression: "service_name ~ '.' ~ missing", Line: 1},
+			},
+		},
+		{
+			name:     "int keeps it undefined",
+			template: "{{ missing | int }}",
+			want:     "{{ missing | int }}",
+			undefined: []Undefined{
+				{Expression: "missing | int", Line: 1},
+			},
+		},
+		{
+			name:     "to_json keeps it undefined",
+			template: "{{ missing | to_json }}",
+			want:     "{{ missing | to_json }}",
+			undefined: []Undefined{
+				{Expression: "missing | to_json", Line: 1},
+			},
+		},
+		{
+			name:     "replace keeps it undefined",
+			template: "{{ missing | replace('a','b') }}",
+			want:     "{{ missing | replace('a','b') }}",
+			undefined: []Undefined{
+				{Expression: "missing | replace('a','b')", Line: 1},
+			},
+		},
+		{
+			name:     "join keeps it undefined",
+			template: "{{ missing | join(',') }}",
+			want:     "{{ missing | join(',') }}",
+			undefined: []Undefined{
+				{Expression: "missing | join(',')", Line: 1},
+			},
+		},
+		{
+			name:     "length keeps it undefined",
+			template: "{{ missing | length }}",
+			want:     "{{ missing | length }}",
+			undefined: []Undefined{
+				{Expression: "missing | length", Line: 1},
+			},
+		},
+		{
+			name:     "an inline if without an else",
+			template: "{{ 'x' if not enabled }}",
+			want:     "{{ 'x' if not enabled }}",
+			undefined: []Undefined{
+				{Expression: "'x' if not enabled", Line: 1},
+			},
+		},
+		{
+			name:     "a default resolves it",
+			template: "{{ missing | default('x') }}",
+			want:     "x",
+		},
+		{
+			name:     "line numbers after blocks and comments",
+			template: "{# a\ncomment #}\n{% if enabled %}\na: {{ a }}\n{% endif %}\n{% for i in [1, 2] %}\nb{{ i }}: {{ b }}\n{% endfor %}\n{{ c }}\n",
+			want:     "a: {{ a }}\nb1: {{ b }}\nb2: {{ b }}\n{{ c }}\n",
+			undefined: []Undefined{
+				{Expression: "a", Line: 4},
+				{Expression: "b", Line: 7},
+				{Expression: "b", Line: 7},
+				{Expression: "c", Line: 9},
+			},
+		},
+		{
+			name:     "line numbers after whitespace control",
+			template: "a: 1\n\n\n{{- a }}\n{%- if enabled -%}\n\n{{ b }}\n{%- endif %}",
+			want:     "a: 1{{ a }}{{ b }}",
+			undefined: []Undefined{
+				{Expression: "a", Line: 4},
+				{Expression: "b", Line: 7},
+			},
+		},
+		{
+			name:     "an undefined condition is false",
+			template: "{% if missing %}yes{% else %}no{% endif %}",
+			want:     "no",
+		},
+		{
+			name:     "looping over an undefined does nothing",
+			template: "env:\n{% for e in environment_variables %}\n  - {{ e.name }}\n{% endfor %}\n",
+			want:     "env:\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, undefined, err := Render("test.j2", tt.template, vars)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			if !reflect.DeepEqual(undefined, tt.undefined) {
+				t.Errorf("got undefined %v, want %v", undefined, tt.undefined)
+			}
+		})
+	}
+}
+
+func TestUndefinedString(t *testing.T) {
+	u := Undefined{Expression: "container_image", Line: 12}
+	if got, want := u.String(), "line 12: {{ container_image }}"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestStatements(t *testing.T) {
+	vars := map[string]interface{}{
+		"env":   "staging",
+		"ports": []interface{}{80, 443},
+		"limits": map[string]interface{}{
+			"cpu":    "500m",
+			"memory": "1Gi",
+		},
+		"environment_variables": []interface{}{
+			map[string]interface{}{"name": "A", "value": "1"},
+			map[string]interface{}{"name": "B", "value": "2"},
+		},
+	}
+	tests := []struct {
+		name     string
+		template string
+		want     string
+	}{
+		{
+			name:     "if elif else",
+			template: "{% if env == 'production' %}p{% elif env == 'staging' %}s{% else %}o{% endif %}",
+			want:     "s",
+		},
+		{
+			name:     "for with loop variables",
+			template: "{% for port in ports %}{{ loop.index }}/{{ loop.length }}:{{ port }}{% if not loop.last %},{% endif %}{% endfor %}",
+			want:     "1/2:80,2/2:443",
+		},
+		{
+			name:     "for with a condition",
+			template: "{% for port in ports if port > 100 %}{{ port }}{% endfor %}",
+			want:     "443",
+		},
+		{
+			name:     "for else",
+			template: "{% for port in [] %}{{ port }}{% else %}none{% endfor %}",
+			want:     "none",
+		},
+		{
+			name:     "for over items",
+			template: "{% for k, v in limits.items() %}{{ k }}={{ v }} {% endfor %}",
+			want:     "cpu=500m memory=1Gi ",
+		},
+		{
+			name: "the env var loop",
+			template: `env:
+  {% for environment_variable in environment_variables %}
+  - name: "{{ environment_variable.name }}"
+    value: "{{ environment_variable.value }}"
+  {% endfor %}
+`,
+			want: `env:
+  - name: "A"
+    value: "1"
+  - name: "B"
+    value: "2"
+`,
+		},
+		{
+			name:     "set",
+			template: "{% set host = env ~ '.example.com' %}{{ host }}",
+			want:     "staging.example.com",
+		},
+		{
+			name:     "raw",
+			template: "{% raw %}{{ not_rendered }}{% endraw %}",
+			want:     "{{ not_rendered }}",
+		},
+		{
+			name:     "arithmetic and slices",
+			template: "{{ ports[0] * 2 + 1 }} {{ 'aion-foo'[5:] }} {{ 7 // 2 }} {{ 7 % 2 }}",
+			want:     "161 foo 3 1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, undefined, err := Render("test.j2", tt.template, vars)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(undefined) > 0 {
+				t.Errorf("got undefined %v", undefined)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		want     string
+	}{
+		{"missing endif", "a: 1\n{% if x %}\nb: 2\n", "endif"},
+		{"missing endfor", "{% for x in y %}", "endfor"},
+		{"missing endraw", "{% raw %}{{ x }}", "missing `endraw` for `raw` on line 1"},
+		{"unknown tag", "{% include 'x.j2' %}", "include"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse("test.j2", tt.template)
+			if err == nil {
+				t.Fatal("got no error")
+			}
+			if !strings.HasPrefix(err.Error(), "test.j2: ") || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got %q, want it to mention %q", err, tt.want)
+			}
+		})
+	}
+}
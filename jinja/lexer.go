@@ -0,0 +1,255 @@
+package jinja
+
+import (
+	"fmt"
+	"strings"
+)
+
+type chunkKind int
+
+const (
+	chunkText chunkKind = iota
+	chunkOutput
+	chunkBlock
+)
+
+// A chunk is either a run of literal text or the contents of a `{{ }}` or
+// `{% %}` tag.  Comments are dropped by the lexer.
+type chunk struct {
+	kind chunkKind
+	body string
+	line int
+}
+
+// splitChunks breaks the template source into text and tag chunks, applying
+// the same whitespace control that Ansible uses when it renders templates
+// (`trim_blocks`), along with `lstrip_blocks` so that block tags on a line
+// by themselves don't leave stray indentation in the YAML.  The `-` and `+`
+// modifiers are honored.
+func splitChunks(source string) ([]chunk, error) {
+	var chunks []chunk
+	line := 1
+	pos := 0
+	trimNextNewline := false
+	stripNextWhitespace := false
+
+	for pos < len(source) {
+		if stripNextWhitespace {
+			for pos < len(source) && strings.IndexByte(" \t\r\n", source[pos]) >= 0 {
+				if source[pos] == '\n' {
+					line++
+				}
+				pos++
+			}
+		} else if trimNextNewline {
+			if strings.HasPrefix(source[pos:], "\r\n") {
+				pos += 2
+				line++
+			} else if strings.HasPrefix(source[pos:], "\n") {
+				pos++
+				line++
+			}
+		}
+		trimNextNewline = false
+		stripNextWhitespace = false
+
+		start := nextTagStart(source, pos)
+		if start < 0 {
+			if pos < len(source) {
+				chunks = append(chunks, chunk{kind: chunkText, body: source[pos:], line: line})
+			}
+			break
+		}
+		text := source[pos:start]
+
+		open := source[start : start+2]
+		bodyStart := start + 2
+		modifier := byte(0)
+		if bodyStart < len(source) && (source[bodyStart] == '-' || source[bodyStart] == '+') {
+			modifier = source[bodyStart]
+			bodyStart++
+		}
+
+		switch {
+		case modifier == '-':
+			text = strings.TrimRight(text, " \t\r\n")
+		case modifier != '+' && open != "{{":
+			// lstrip_blocks: drop the indentation in front of a block tag
+			// or comment when it is the first thing on its line.
+			lineStart := strings.LastIndex(source[:start], "\n") + 1
+			if strings.TrimLeft(source[lineStart:start], " \t") == "" {
+				text = strings.TrimRight(text, " \t")
+			}
+		}
+		if text != "" {
+			chunks = append(chunks, chunk{kind: chunkText, body: text, line: line})
+		}
+		line += strings.Count(source[pos:start], "\n")
+
+		closeTag := map[string]string{"{{": "}}", "{%": "%}", "{#": "#}"}[open]
+		end := findTagEnd(source, bodyStart, closeTag, open == "{#")
+		if end < 0 {
+			return nil, fmt.Errorf("line %d: unclosed tag `%s`", line, open)
+		}
+		body := source[bodyStart:end]
+		next := end + 2
+		if strings.HasSuffix(body, "-") {
+			body = body[:len(body)-1]
+			stripNextWhitespace = true
+		} else if strings.HasSuffix(body, "+") {
+			body = body[:len(body)-1]
+		} else if open != "{{" {
+			trimNextNewline = true
+		}
+
+		switch open {
+		case "{{":
+			chunks = append(chunks, chunk{kind: chunkOutput, body: strings.TrimSpace(body), line: line})
+		case "{%":
+			chunks = append(chunks, chunk{kind: chunkBlock, body: strings.TrimSpace(body), line: line})
+		}
+		line += strings.Count(source[start:next], "\n")
+		pos = next
+	}
+	return chunks, nil
+}
+
+func nextTagStart(source string, pos int) int {
+	for i := pos; i+1 < len(source); i++ {
+		if source[i] == '{' && (source[i+1] == '{' || source[i+1] == '%' || source[i+1] == '#') {
+			return i
+		}
+	}
+	return -1
+}
+
+// findTagEnd returns the index of the closing delimiter, skipping over any
+// quoted strings in the tag body.
+func findTagEnd(source string, pos int, closeTag string, isComment bool) int {
+	if isComment {
+		i := strings.Index(source[pos:], closeTag)
+		if i < 0 {
+			return -1
+		}
+		return pos + i
+	}
+	var quote byte
+	for i := pos; i+1 < len(source); i++ {
+		c := source[i]
+		if quote != 0 {
+			if c == '\\' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+			continue
+		}
+		if c == '\'' || c == '"' {
+			quote = c
+			continue
+		}
+		if source[i:i+2] == closeTag {
+			return i
+		}
+	}
+	return -1
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokName
+	tokString
+	tokInt
+	tokFloat
+	tokOp
+)
+
+type token struct {
+	kind  tokenKind
+	value string
+}
+
+// tokenize splits the body of a tag into expression tokens.
+func tokenize(s string) ([]token, error) {
+	var tokens []token
+	i := 0
+	for i < len(s) {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case isNameStart(c):
+			j := i + 1
+			for j < len(s) && isNameChar(s[j]) {
+				j++
+			}
+			tokens = append(tokens, token{tokName, s[i:j]})
+			i = j
+		case c >= '0' && c <= '9':
+			j := i + 1
+			kind := tokInt
+			for j < len(s) && (s[j] >= '0' && s[j] <= '9' || s[j] == '_') {
+				j++
+			}
+			if j+1 < len(s) && s[j] == '.' && s[j+1] >= '0' && s[j+1] <= '9' {
+				kind = tokFloat
+				j++
+				for j < len(s) && s[j] >= '0' && s[j] <= '9' {
+					j++
+				}
+			}
+			tokens = append(tokens, token{kind, strings.ReplaceAll(s[i:j], "_", "")})
+			i = j
+		case c == '\'' || c == '"':
+			var b strings.Builder
+			j := i + 1
+			for ; j < len(s) && s[j] != c; j++ {
+				if s[j] == '\\' && j+1 < len(s) {
+					j++
+					switch s[j] {
+					case 'n':
+						b.WriteByte('\n')
+					case 't':
+						b.WriteByte('\t')
+					default:
+						b.WriteByte(s[j])
+					}
+					continue
+				}
+				b.WriteByte(s[j])
+			}
+			if j >= len(s) {
+				return nil, fmt.Errorf("unterminated string in `%s`", s)
+			}
+			tokens = append(tokens, token{tokString, b.String()})
+			i = j + 1
+		default:
+			op := ""
+			for _, candidate := range []string{"//", "**", "==", "!=", "<=", ">="} {
+				if strings.HasPrefix(s[i:], candidate) {
+					op = candidate
+					break
+				}
+			}
+			if op == "" {
+				if !strings.ContainsRune("+-*/%~()[]{},.:|<>=", rune(c)) {
+					return nil, fmt.Errorf("unexpected character `%c` in `%s`", c, s)
+				}
+				op = string(c)
+			}
+			tokens = append(tokens, token{tokOp, op})
+			i += len(op)
+		}
+	}
+	return append(tokens, token{kind: tokEOF}), nil
+}
+
+func isNameStart(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func isNameChar(c byte) bool {
+	return isNameStart(c) || c >= '0' && c <= '9'
+}
@@ -0,0 +1,123 @@
+package jinja
+
+import (
+	"testing"
+)
+
+func TestWhitespaceControl(t *testing.T) {
+	vars := map[string]interface{}{
+		"items":   []interface{}{"a", "b"},
+		"enabled": true,
+		"name":    "aion-foo",
+	}
+	tests := []struct {
+		name     string
+		template string
+		want     string
+	}{
+		{
+			name:     "trim_blocks drops the newline after a block tag",
+			template: "{% if enabled %}\nyes\n{% endif %}\ndone\n",
+			want:     "yes\ndone\n",
+		},
+		{
+			name:     "but not after an expression",
+			template: "{{ name }}\ndone\n",
+			want:     "aion-foo\ndone\n",
+		},
+		{
+			name:     "lstrip_blocks drops the indentation in front of a block tag",
+			template: "env:\n    {% for item in items %}\n  - {{ item }}\n    {% endfor %}\n",
+			want:     "env:\n  - a\n  - b\n",
+		},
+		{
+			name:     "trim_blocks applies to a block tag in the middle of a line",
+			template: "a: {% if enabled %}yes{% endif %}\nb: 2\n",
+			want:     "a: yesb: 2\n",
+		},
+		{
+			name:     "lstrip_blocks applies to comments",
+			template: "a: 1\n    {# a comment #}\nb: 2\n",
+			want:     "a: 1\nb: 2\n",
+		},
+		{
+			name:     "{%- strips the whitespace in front",
+			template: "a: [\n  {%- for item in items %}{{ item }},{% endfor %}]\n",
+			want:     "a: [a,b,]\n",
+		},
+		{
+			name:     "-%} strips the whitespace after",
+			template: "{% for item in items -%}\n\n   {{ item }}\n{% endfor %}",
+			want:     "a\nb\n",
+		},
+		{
+			name:     "{{- and -}} strip around an expression",
+			template: "name:   \n  {{- ' ' ~ name -}}  \n\n!",
+			want:     "name: aion-foo!",
+		},
+		{
+			name:     "+%} keeps the newline",
+			template: "{% if enabled +%}\nyes\n{% endif %}",
+			want:     "\nyes\n",
+		},
+		{
+			name:     "{%+ keeps the indentation",
+			template: "  {%+ if enabled %}yes{% endif %}",
+			want:     "  yes",
+		},
+		{
+			name:     "CRLF line endings",
+			template: "{% if enabled %}\r\nyes\r\n{% endif %}\r\n",
+			want:     "yes\r\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, undefined, err := Render("test.j2", tt.template, vars)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(undefined) > 0 {
+				t.Errorf("got undefined %v", undefined)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnclosedTag(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		want     string
+	}{
+		{
+			name:     "expression",
+			template: "a: 1\nb: {{ name\n",
+			want:     "test.j2: line 2: unclosed tag `{{`",
+		},
+		{
+			name:     "block",
+			template: "{% if enabled %}\n{% endif\n",
+			want:     "test.j2: line 2: unclosed tag `{%`",
+		},
+		{
+			name:     "comment",
+			template: "{# a comment\n",
+			want:     "test.j2: line 1: unclosed tag `{#`",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse("test.j2", tt.template)
+			if err == nil {
+				t.Fatal("got no error")
+			}
+			if err.Error() != tt.want {
+				t.Errorf("got %q, want %q", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,753 @@
+package jinja
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Template nodes.
+type node interface{}
+
+type textNode struct {
+	text string
+}
+
+type outputNode struct {
+	expr expr
+	src  string
+	line int
+}
+
+type ifBranch struct {
+	cond expr
+	body []node
+}
+
+type ifNode struct {
+	branches []ifBranch
+	orElse   []node
+}
+
+type forNode struct {
+	targets []string
+	iter    expr
+	cond    expr
+	body    []node
+	orElse  []node
+	line    int
+}
+
+type setNode struct {
+	name string
+	expr expr
+}
+
+// Expression nodes.
+type expr interface{}
+
+type literal struct {
+	value interface{}
+}
+
+type name struct {
+	name string
+}
+
+type listExpr struct {
+	items []expr
+}
+
+type dictExpr struct {
+	keys   []expr
+	values []expr
+}
+
+type attrExpr struct {
+	object expr
+	attr   string
+}
+
+type indexExpr struct {
+	object expr
+	index  expr
+}
+
+type sliceExpr struct {
+	object      expr
+	start, stop expr
+}
+
+type callExpr struct {
+	callee expr
+	args   []expr
+	kwargs map[string]expr
+}
+
+type filterExpr struct {
+	object expr
+	name   string
+	args   []expr
+	kwargs map[string]expr
+}
+
+type testExpr struct {
+	object expr
+	name   string
+	args   []expr
+	negate bool
+}
+
+type unaryExpr struct {
+	op      string
+	operand expr
+}
+
+type binaryExpr struct {
+	op          string
+	left, right expr
+}
+
+type condExpr struct {
+	cond, then, orElse expr
+}
+
+// parser consumes chunks from the lexer and builds the node tree.  Block
+// statements are parsed recursively until one of the `end` keywords is seen.
+type parser struct {
+	chunks []chunk
+	pos    int
+}
+
+func parseNodes(chunks []chunk) ([]node, error) {
+	p := &parser{chunks: chunks}
+	nodes, end, err := p.parseUntil()
+	if err != nil {
+		return nil, err
+	}
+	if end != nil {
+		return nil, fmt.Errorf("line %d: unexpected `%s`", end.line, end.body)
+	}
+	return nodes, nil
+}
+
+// parseUntil parses nodes until it reaches a block tag that it doesn't know
+// how to open (`elif`, `else`, `endif`, `endfor`, ...), which is returned to
+// the caller to handle.
+func (p *parser) parseUntil() ([]node, *chunk, error) {
+	var nodes []node
+	for p.pos < len(p.chunks) {
+		c := p.chunks[p.pos]
+		p.pos++
+		switch c.kind {
+		case chunkText:
+			nodes = append(nodes, &textNode{text: c.body})
+		case chunkOutput:
+			e, err := parseExpression(c.body)
+			if err != nil {
+				return nil, nil, fmt.Errorf("line %d: %w", c.line, err)
+			}
+			nodes = append(nodes, &outputNode{expr: e, src: c.body, line: c.line})
+		case chunkBlock:
+			keyword, rest, _ := strings.Cut(c.body, " ")
+			rest = strings.TrimSpace(rest)
+			var n node
+			var err error
+			switch keyword {
+			case "if":
+				n, err = p.parseIf(rest, c.line)
+			case "for":
+				n, err = p.parseFor(rest, c.line)
+			case "set":
+				n, err = parseSet(rest)
+			case "raw":
+				n, err = p.parseRaw(c.line)
+			default:
+				return nodes, &c, nil
+			}
+			if err != nil {
+				return nil, nil, fmt.Errorf("line %d: %w", c.line, err)
+			}
+			nodes = append(nodes, n)
+		}
+	}
+	return nodes, nil, nil
+}
+
+func (p *parser) parseIf(condition string, line int) (node, error) {
+	n := &ifNode{}
+	for {
+		cond, err := parseExpression(condition)
+		if err != nil {
+			return nil, err
+		}
+		body, end, err := p.parseUntil()
+		if err != nil {
+			return nil, err
+		}
+		if end == nil {
+			return nil, fmt.Errorf("missing `endif` for `if` on line %d", line)
+		}
+		n.branches = append(n.branches, ifBranch{cond: cond, body: body})
+		keyword, rest, _ := strings.Cut(end.body, " ")
+		switch keyword {
+		case "elif":
+			condition = strings.TrimSpace(rest)
+		case "else":
+			orElse, end, err := p.parseUntil()
+			if err != nil {
+				return nil, err
+			}
+			if end == nil || end.body != "endif" {
+				return nil, fmt.Errorf("missing `endif` for `if` on line %d", line)
+			}
+			n.orElse = orElse
+			return n, nil
+		case "endif":
+			return n, nil
+		default:
+			return nil, fmt.Errorf("unexpected `%s` in `if` on line %d", end.body, line)
+		}
+	}
+}
+
+func (p *parser) parseFor(header string, line int) (node, error) {
+	tokens, err := tokenize(header)
+	if err != nil {
+		return nil, err
+	}
+	ep := &exprParser{tokens: tokens}
+	n := &forNode{line: line}
+	for {
+		t := ep.next()
+		if t.kind != tokName {
+			return nil, fmt.Errorf("expected loop variable in `for %s`", header)
+		}
+		n.targets = append(n.targets, t.value)
+		if !ep.acceptOp(",") {
+			break
+		}
+	}
+	if !ep.acceptName("in") {
+		return nil, fmt.Errorf("expected `in` in `for %s`", header)
+	}
+	// The iterable can't be an inline `if` since that would swallow the
+	// loop filter.
+	if n.iter, err = ep.parseOr(); err != nil {
+		return nil, err
+	}
+	if ep.acceptName("if") {
+		if n.cond, err = ep.parseOr(); err != nil {
+			return nil, err
+		}
+	}
+	if ep.peek().kind != tokEOF {
+		return nil, fmt.Errorf("unexpected `%s` in `for %s`", ep.peek().value, header)
+	}
+
+	body, end, err := p.parseUntil()
+	if err != nil {
+		return nil, err
+	}
+	if end != nil && end.body == "else" {
+		n.orElse, end, err = p.parseUntil()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if end == nil || end.body != "endfor" {
+		return nil, fmt.Errorf("missing `endfor` for `for` on line %d", line)
+	}
+	n.body = body
+	return n, nil
+}
+
+func parseSet(statement string) (node, error) {
+	target, value, ok := strings.Cut(statement, "=")
+	target = strings.TrimSpace(target)
+	if !ok || target == "" {
+		return nil, fmt.Errorf("block `set` is not supported")
+	}
+	e, err := parseExpression(value)
+	if err != nil {
+		return nil, err
+	}
+	return &setNode{name: target, expr: e}, nil
+}
+
+// parseRaw reassembles everything up to `endraw` as literal text.  The
+// lexer has already split it into chunks, so this is best effort.
+func (p *parser) parseRaw(line int) (node, error) {
+	var b strings.Builder
+	for p.pos < len(p.chunks) {
+		c := p.chunks[p.pos]
+		p.pos++
+		switch c.kind {
+		case chunkText:
+			b.WriteString(c.body)
+		case chunkOutput:
+			b.WriteString("{{ " + c.body + " }}")
+		case chunkBlock:
+			if c.body == "endraw" {
+				return &textNode{text: b.String()}, nil
+			}
+			b.WriteString("{% " + c.body + " %}")
+		}
+	}
+	return nil, fmt.Errorf("missing `endraw` for `raw` on line %d", line)
+}
+
+func parseExpression(s string) (expr, error) {
+	tokens, err := tokenize(s)
+	if err != nil {
+		return nil, err
+	}
+	ep := &exprParser{tokens: tokens}
+	e, err := ep.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if ep.peek().kind != tokEOF {
+		return nil, fmt.Errorf("unexpected `%s` in `%s`", ep.peek().value, s)
+	}
+	return e, nil
+}
+
+// exprParser is a recursive descent parser that follows Jinja's operator
+// precedence.
+type exprParser struct {
+	tokens []token
+	pos    int
+}
+
+func (ep *exprParser) peek() token {
+	return ep.tokens[ep.pos]
+}
+
+func (ep *exprParser) next() token {
+	t := ep.tokens[ep.pos]
+	if t.kind != tokEOF {
+		ep.pos++
+	}
+	return t
+}
+
+func (ep *exprParser) acceptOp(op string) bool {
+	if t := ep.peek(); t.kind == tokOp && t.value == op {
+		ep.pos++
+		return true
+	}
+	return false
+}
+
+func (ep *exprParser) acceptName(n string) bool {
+	if t := ep.peek(); t.kind == tokName && t.value == n {
+		ep.pos++
+		return true
+	}
+	return false
+}
+
+func (ep *exprParser) expectOp(op string) error {
+	if !ep.acceptOp(op) {
+		return fmt.Errorf("expected `%s`, got `%s`", op, ep.peek().value)
+	}
+	return nil
+}
+
+func (ep *exprParser) parseExpr() (expr, error) {
+	e, err := ep.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if ep.acceptName("if") {
+		cond, err := ep.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		var orElse expr
+		if ep.acceptName("else") {
+			if orElse, err = ep.parseExpr(); err != nil {
+				return nil, err
+			}
+		}
+		return &condExpr{cond: cond, then: e, orElse: orElse}, nil
+	}
+	return e, nil
+}
+
+func (ep *exprParser) parseOr() (expr, error) {
+	left, err := ep.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for ep.acceptName("or") {
+		right, err := ep.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryExpr{op: "or", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (ep *exprParser) parseAnd() (expr, error) {
+	left, err := ep.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for ep.acceptName("and") {
+		right, err := ep.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryExpr{op: "and", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (ep *exprParser) parseNot() (expr, error) {
+	if ep.acceptName("not") {
+		operand, err := ep.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &unaryExpr{op: "not", operand: operand}, nil
+	}
+	return ep.parseCompare()
+}
+
+func (ep *exprParser) parseCompare() (expr, error) {
+	left, err := ep.parseConcat()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		var op string
+		t := ep.peek()
+		switch {
+		case t.kind == tokOp && (t.value == "==" || t.value == "!=" || t.value == "<" || t.value == "<=" || t.value == ">" || t.value == ">="):
+			op = t.value
+			ep.pos++
+		case t.kind == tokName && t.value == "in":
+			op = "in"
+			ep.pos++
+		case t.kind == tokName && t.value == "not" && ep.tokens[ep.pos+1].kind == tokName && ep.tokens[ep.pos+1].value == "in":
+			op = "not in"
+			ep.pos += 2
+		default:
+			return left, nil
+		}
+		right, err := ep.parseConcat()
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryExpr{op: op, left: left, right: right}
+	}
+}
+
+func (ep *exprParser) parseConcat() (expr, error) {
+	left, err := ep.parseAdd()
+	if err != nil {
+		return nil, err
+	}
+	for ep.acceptOp("~") {
+		right, err := ep.parseAdd()
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryExpr{op: "~", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (ep *exprParser) parseAdd() (expr, error) {
+	left, err := ep.parseMul()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := ep.peek()
+		if t.kind != tokOp || (t.value != "+" && t.value != "-") {
+			return left, nil
+		}
+		ep.pos++
+		right, err := ep.parseMul()
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryExpr{op: t.value, left: left, right: right}
+	}
+}
+
+func (ep *exprParser) parseMul() (expr, error) {
+	left, err := ep.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := ep.peek()
+		if t.kind != tokOp || (t.value != "*" && t.value != "/" && t.value != "//" && t.value != "%") {
+			return left, nil
+		}
+		ep.pos++
+		right, err := ep.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryExpr{op: t.value, left: left, right: right}
+	}
+}
+
+func (ep *exprParser) parseUnary() (expr, error) {
+	if ep.acceptOp("-") {
+		operand, err := ep.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &unaryExpr{op: "-", operand: operand}, nil
+	}
+	if ep.acceptOp("+") {
+		return ep.parseUnary()
+	}
+	return ep.parseFilters()
+}
+
+// parseFilters handles the postfix `|filter` and `is test` operators, which
+// bind tighter than arithmetic.
+func (ep *exprParser) parseFilters() (expr, error) {
+	e, err := ep.parsePostfix()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch {
+		case ep.acceptOp("|"):
+			t := ep.next()
+			if t.kind != tokName {
+				return nil, fmt.Errorf("expected filter name after `|`")
+			}
+			f := &filterExpr{object: e, name: t.value}
+			if ep.acceptOp("(") {
+				if f.args, f.kwargs, err = ep.parseArgs(); err != nil {
+					return nil, err
+				}
+			}
+			e = f
+		case ep.acceptName("is"):
+			negate := ep.acceptName("not")
+			t := ep.next()
+			if t.kind != tokName {
+				return nil, fmt.Errorf("expected test name after `is`")
+			}
+			te := &testExpr{object: e, name: t.value, negate: negate}
+			if ep.acceptOp("(") {
+				if te.args, _, err = ep.parseArgs(); err != nil {
+					return nil, err
+				}
+			} else if nt := ep.peek(); nt.kind == tokString || nt.kind == tokInt || nt.kind == tokFloat {
+				arg, err := ep.parsePrimary()
+				if err != nil {
+					return nil, err
+				}
+				te.args = []expr{arg}
+			}
+			e = te
+		default:
+			return e, nil
+		}
+	}
+}
+
+func (ep *exprParser) parsePostfix() (expr, error) {
+	e, err := ep.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch {
+		case ep.acceptOp("."):
+			t := ep.next()
+			if t.kind != tokName && t.kind != tokInt {
+				return nil, fmt.Errorf("expected attribute name after `.`")
+			}
+			e = &attrExpr{object: e, attr: t.value}
+		case ep.acceptOp("["):
+			var start expr
+			if t := ep.peek(); !(t.kind == tokOp && t.value == ":") {
+				if start, err = ep.parseExpr(); err != nil {
+					return nil, err
+				}
+			}
+			if ep.acceptOp(":") {
+				var stop expr
+				if t := ep.peek(); !(t.kind == tokOp && t.value == "]") {
+					if stop, err = ep.parseExpr(); err != nil {
+						return nil, err
+					}
+				}
+				e = &sliceExpr{object: e, start: start, stop: stop}
+			} else {
+				e = &indexExpr{object: e, index: start}
+			}
+			if err := ep.expectOp("]"); err != nil {
+				return nil, err
+			}
+		case ep.acceptOp("("):
+			c := &callExpr{callee: e}
+			if c.args, c.kwargs, err = ep.parseArgs(); err != nil {
+				return nil, err
+			}
+			e = c
+		default:
+			return e, nil
+		}
+	}
+}
+
+// parseArgs parses a call's argument list.  The opening paren has already
+// been consumed.
+func (ep *exprParser) parseArgs() ([]expr, map[string]expr, error) {
+	var args []expr
+	kwargs := map[string]expr{}
+	for !ep.acceptOp(")") {
+		if len(args) > 0 || len(kwargs) > 0 {
+			if err := ep.expectOp(","); err != nil {
+				return nil, nil, err
+			}
+			if ep.acceptOp(")") {
+				break
+			}
+		}
+		if t := ep.peek(); t.kind == tokName && ep.tokens[ep.pos+1].kind == tokOp && ep.tokens[ep.pos+1].value == "=" {
+			ep.pos += 2
+			value, err := ep.parseExpr()
+			if err != nil {
+				return nil, nil, err
+			}
+			kwargs[t.value] = value
+			continue
+		}
+		arg, err := ep.parseExpr()
+		if err != nil {
+			return nil, nil, err
+		}
+		args = append(args, arg)
+	}
+	return args, kwargs, nil
+}
+
+func (ep *exprParser) parsePrimary() (expr, error) {
+	t := ep.next()
+	switch t.kind {
+	case tokString:
+		s := t.value
+		// Adjacent string literals are concatenated.
+		for ep.peek().kind == tokString {
+			s += ep.next().value
+		}
+		return &literal{value: s}, nil
+	case tokInt:
+		n, err := strconv.Atoi(t.value)
+		if err != nil {
+			return nil, err
+		}
+		return &literal{value: n}, nil
+	case tokFloat:
+		f, err := strconv.ParseFloat(t.value, 64)
+		if err != nil {
+			return nil, err
+		}
+		return &literal{value: f}, nil
+	case tokName:
+		switch t.value {
+		case "true", "True":
+			return &literal{value: true}, nil
+		case "false", "False":
+			return &literal{value: false}, nil
+		case "none", "None":
+			return &literal{value: nil}, nil
+		}
+		return &name{name: t.value}, nil
+	case tokOp:
+		switch t.value {
+		case "(":
+			if ep.acceptOp(")") {
+				return &listExpr{}, nil
+			}
+			e, err := ep.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			// A tuple is treated as a list.
+			if ep.acceptOp(",") {
+				items := []expr{e}
+				for !ep.acceptOp(")") {
+					item, err := ep.parseExpr()
+					if err != nil {
+						return nil, err
+					}
+					items = append(items, item)
+					if !ep.acceptOp(",") {
+						if err := ep.expectOp(")"); err != nil {
+							return nil, err
+						}
+						break
+					}
+				}
+				return &listExpr{items: items}, nil
+			}
+			if err := ep.expectOp(")"); err != nil {
+				return nil, err
+			}
+			return e, nil
+		case "[":
+			l := &listExpr{}
+			for !ep.acceptOp("]") {
+				if len(l.items) > 0 {
+					if err := ep.expectOp(","); err != nil {
+						return nil, err
+					}
+					if ep.acceptOp("]") {
+						break
+					}
+				}
+				item, err := ep.parseExpr()
+				if err != nil {
+					return nil, err
+				}
+				l.items = append(l.items, item)
+			}
+			return l, nil
+		case "{":
+			d := &dictExpr{}
+			for !ep.acceptOp("}") {
+				if len(d.keys) > 0 {
+					if err := ep.expectOp(","); err != nil {
+						return nil, err
+					}
+					if ep.acceptOp("}") {
+						break
+					}
+				}
+				key, err := ep.parseExpr()
+				if err != nil {
+					return nil, err
+				}
+				if err := ep.expectOp(":"); err != nil {
+					return nil, err
+				}
+				value, err := ep.parseExpr()
+				if err != nil {
+					return nil, err
+				}
+				d.keys = append(d.keys, key)
+				d.values = append(d.values, value)
+			}
+			return d, nil
+		}
+	case tokEOF:
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	return nil, fmt.Errorf("unexpected `%s`", t.value)
+}
@@ -1,8 +1,10 @@
 package main
 
 import (
-	"bufio"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
@@ -11,427 +13,670 @@ import (
 	"gopkg.in/yaml.v3"
 )
 
-func getResources(defaultValues ManifestValues) *Resources {
-	r := &Resources{}
-	var b bool
-	limitsCPU, ok := defaultValues["resources_limits_cpu"]
-	if !ok {
-		fmt.Fprintln(os.Stderr, "resources_limits_cpu")
-	} else {
-		r.LimitsCPU = limitsCPU.(string)
-		b = true
+// The outcome of kustomizing a single service (repository).  The services are
+// kustomized concurrently, so these are only collected into `m.Results` once
+// they're all done.
+type ServiceResult struct {
+	Repository string `json:"-"`
+	Success    bool   `json:"success"`
+	NoKube     bool   `json:"no_kube,omitempty"`
+	// The manifest templates found in the `.kube` directory.
+	Manifests          []string                `json:"manifests,omitempty"`
+	MissingValuesFiles []string                `json:"missing_values_files,omitempty"`
+	Unmatched          []*UnresolvedExpression `json:"unresolved,omitempty"`
+	RenderErrors       []*RenderError          `json:"render_errors,omitempty"`
+	// The files that couldn't be written.  Either of these means that the previous
+	// output (if any) was kept.
+	WriteErrors []*RenderError `json:"write_errors,omitempty"`
+	// The overlays that `kustomize build` couldn't render, which also means that
+	// the previous output was kept.
+	BuildErrors []*BuildError `json:"build_errors,omitempty"`
+	// What the overlays were built into that the target Kubernetes version would
+	// reject, which also means that the previous output was kept.
+	SchemaErrors []*SchemaError `json:"schema_errors,omitempty"`
+	Warnings     []string       `json:"warnings,omitempty"`
+	// Every file that was written (where it ended up, not where it was staged).
+	Outputs []string `json:"outputs,omitempty"`
+}
+
+// Everything a service needs that isn't in the service's own repository.  This
+// is read once and shared (read-only) by all of the services.
+type sharedValues struct {
+	foregroundServices map[string]bool
+	certificates       ManifestValues
+	// Why the certificates couldn't be read, which only matters to the services
+	// with an Ingress.
+	certificatesErr error
+}
+
+// The unit of work for a single service.  Nothing in here is shared with any
+// other service, and the Migrator itself is only ever read.
+type serviceJob struct {
+	m            *Migrator
+	shared       *sharedValues
+	repo         string
+	clonedAppDir string
+	// The service is written to the staging dir, and only replaces what's in the
+	// app dir once all of it has been written.
+	appDir     string
+	stagingDir string
+	kubeDir    string
+	result     *ServiceResult
+	w          io.Writer
+}
+
+// A Kustomize directory and the manifest templates that go in it.  Usually this
+// is the whole repository, but a repository with more than one Deployment gets a
+// directory for each of them.
+type serviceUnit struct {
+	dir   string
+	files []string
+}
+
+func (s *serviceJob) warn(format string, a ...interface{}) {
+	msg := fmt.Sprintf(format, a...)
+	s.result.Warnings = append(s.result.Warnings, msg)
+	fmt.Fprintln(s.w, fmt.Sprintf("%s %s", color.Warning(), msg))
+}
+
+func (s *serviceJob) renderError(filename string, err error) {
+	s.result.RenderErrors = append(s.result.RenderErrors, &RenderError{File: filename, Error: err.Error()})
+	fmt.Fprintln(s.w, fmt.Sprintf("%s Could not render `%s`: %s", color.Error(), filename, err))
+}
+
+// Read the values file, noting whether it was there.
+func (s *serviceJob) values(filename string) (ManifestValues, bool) {
+	if !checkFileExists(filename) {
+		s.result.MissingValuesFiles = append(s.result.MissingValuesFiles, filename)
+		fmt.Fprintln(s.w, fmt.Sprintf("%s Could not read file `%s`", color.Warning(), filename))
 	}
-	limitsMemory, ok := defaultValues["resources_limits_memory"]
-	if !ok {
-		fmt.Fprintln(os.Stderr, "No resources_limits_memory")
-	} else {
-		r.LimitsMemory = limitsMemory.(string)
-		b = true
+	return s.readValues(filename)
+}
+
+// Nothing that uses a values file that can't be read can be rendered, so it's a
+// render error.
+func (s *serviceJob) readValues(filename string) (ManifestValues, bool) {
+	values, err := getManifestValues(filename)
+	if err != nil {
+		s.result.RenderErrors = append(s.result.RenderErrors, &RenderError{File: filename, Error: err.Error()})
+		fmt.Fprintln(s.w, fmt.Sprintf("%s Could not read the values file `%s`: %s", color.Error(), filename, err))
+		return nil, false
 	}
-	requestsCPU, ok := defaultValues["resources_requests_cpu"]
-	if !ok {
-		fmt.Fprintln(os.Stderr, "No resources_requests_cpu")
-	} else {
-		r.RequestsCPU = requestsCPU.(string)
-		b = true
+	return values, true
+}
+
+func (s *serviceJob) writeError(filename string, err error) {
+	s.result.WriteErrors = append(s.result.WriteErrors, &RenderError{File: s.output(filename), Error: err.Error()})
+	fmt.Fprintln(s.w, fmt.Sprintf("%s Could not write `%s`: %s", color.Error(), s.output(filename), err))
+}
+
+// Where the staged file will end up.
+func (s *serviceJob) output(filename string) string {
+	rel, err := filepath.Rel(s.stagingDir, filename)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return filename
 	}
-	requestsMemory, ok := defaultValues["resources_requests_memory"]
-	if !ok {
-		fmt.Fprintln(os.Stderr, "No resources_requests_memory")
-	} else {
-		r.RequestsMemory = requestsMemory.(string)
-		b = true
+	return filepath.Join(s.appDir, rel)
+}
+
+func (s *serviceJob) write(filename, contents string) {
+	err := writeFile(filename, contents)
+	if err != nil {
+		s.writeError(filename, err)
+		return
+	}
+	s.result.Outputs = append(s.result.Outputs, s.output(filename))
+}
+
+func (s *serviceJob) getResources(defaultValues ManifestValues) *Resources {
+	r := &Resources{}
+	var b bool
+	for key, field := range map[string]*string{
+		"resources_limits_cpu":      &r.LimitsCPU,
+		"resources_limits_memory":   &r.LimitsMemory,
+		"resources_requests_cpu":    &r.RequestsCPU,
+		"resources_requests_memory": &r.RequestsMemory,
+	} {
+		if v, ok := defaultValues[key]; ok {
+			*field = fmt.Sprint(v)
+			b = true
+		}
 	}
 	if b {
 		return r
 	}
+	s.warn("No resources in the defaults for `%s`", s.repo)
 	return nil
 }
 
-// name: aion-identity-service
-//var reDeploymentName = regexp.MustCompile(`\s*name:\s(?P<DeploymentName>[a-zA-Z-]*)$`)
+// Render the manifest template and record anything that couldn't be resolved.
+func (s *serviceJob) render(filename, manifest string, values map[string]interface{}) (string, bool) {
+	rendered, unmatched, err := renderManifest(filename, manifest, values)
+	if err != nil {
+		s.renderError(filename, err)
+		return "", false
+	}
+	// Any expression that is still in the rendered manifest couldn't be resolved (not good).
+	for _, u := range unmatched {
+		s.result.Unmatched = append(s.result.Unmatched, &UnresolvedExpression{
+			File:       filename,
+			Line:       u.Line,
+			Expression: u.Expression,
+		})
+	}
+	return rendered, true
+}
+
+// A template that can't be executed isn't written at all, rather than half of it.
+func (s *serviceJob) executeTemplate(filename, name string, data interface{}) {
+	var b strings.Builder
+	err := s.m.Template.ExecuteTemplate(&b, name, data)
+	if err != nil {
+		// It's still an error, so that the previous output is kept.
+		s.writeError(filename, fmt.Errorf("Could not execute template `%s`: %w", name, err))
+		return
+	}
+	s.write(filename, b.String())
+}
 
-func (m *Migrator) kustomize() {
+func (m *Migrator) kustomize(ctx context.Context) error {
 	// Get a list of all services that have been cloned to `build/{PROJECT_NAME}`.
 	// These need to be tricked out for Kustomize.  The directory structure we'll
 	// be using is:
 	//
 	//	aion-nginx/
 	//	├── base/
-	//	│   ├── RESOURCES (manifests)
-	//	│   ├── env
-	//	│   └── kustomization.yaml
+	//	│   ├── RESOURCES (manifests)
+	//	│   ├── env
+	//	│   └── kustomization.yaml
 	//	└── overlays/
 	//		├── beta/
-	//		│   ├── env
-	//		│   └── kustomization.yaml
+	//		│   ├── env
+	//		│   └── kustomization.yaml
 	//		├── development/
-	//		│   ├── env
-	//		│   └── kustomization.yaml
+	//		│   ├── env
+	//		│   └── kustomization.yaml
 	//		└── production/
 	//			├── env
 	//			└── kustomization.yaml
 	//
-	dirs, err := os.ReadDir(fmt.Sprintf("%s/%s", m.Dirs.Cloned, m.Project.Name))
+	dirs, err := os.ReadDir(m.Dirs.Sources)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "Could not list contents of the build directory")
-		//		log.Fatal(err)
+		return fmt.Errorf("Could not list the contents of the sources dir `%s`: %w", m.Dirs.Sources, err)
+	}
+	var repos []string
+	for _, dir := range dirs {
+		if dir.IsDir() && !strings.HasPrefix(dir.Name(), ".") {
+			repos = append(repos, dir.Name())
+		}
+	}
+
+	shared := m.sharedValues()
+
+	// Whatever was staged by a run that was killed is of no use to anyone.
+	err = os.RemoveAll(m.Dirs.Staging)
+	if err == nil {
+		err = os.MkdirAll(m.Dirs.Staging, os.ModePerm)
+	}
+	if err != nil {
+		return fmt.Errorf("Could not create the staging dir `%s`: %w", m.Dirs.Staging, err)
+	}
+	defer os.RemoveAll(m.Dirs.Staging)
+
+	// A service that's been started is finished even if it's interrupted, since it
+	// doesn't take long, so that its output is never half-written.
+	all := make([]*ServiceResult, len(repos))
+	runOrdered(ctx, len(repos), m.Project.Jobs, os.Stderr, func(i int, w io.Writer) {
+		all[i] = m.kustomizeService(repos[i], shared, w)
+	})
+	var results []*ServiceResult
+	for _, result := range all {
+		if result != nil {
+			results = append(results, result)
+		}
+	}
+
+	var succeeded, warnings, unmatched int
+	for _, result := range results {
+		if result.Success {
+			succeeded += 1
+		}
+		warnings += len(result.Warnings)
+		unmatched += len(result.Unmatched)
+	}
+	m.Results = results
+	fmt.Fprintln(os.Stderr, fmt.Sprintf("%s Kustomized %d of %d services (%d warnings, %d unresolved expressions)", color.Info(), succeeded, len(results), warnings, unmatched))
+	return nil
+}
+
+// The foreground services are a list, either by itself or as the value of a
+// variable, e.g. `aion_foreground_services: [aion-nginx]`.
+func parseForegroundServices(b []byte) (map[string]bool, error) {
+	var v interface{}
+	if err := yaml.Unmarshal(b, &v); err != nil {
+		return nil, err
+	}
+	var lists []interface{}
+	switch v := v.(type) {
+	case nil:
+	case []interface{}:
+		lists = append(lists, v)
+	case map[string]interface{}:
+		for _, k := range sortedKeys(v) {
+			lists = append(lists, v[k])
+		}
+	default:
+		return nil, fmt.Errorf("expected a list of services, got `%v`", v)
+	}
+	services := map[string]bool{}
+	for _, list := range lists {
+		items, ok := list.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("expected a list of services, got `%v`", list)
+		}
+		for _, item := range items {
+			services[fmt.Sprint(item)] = true
+		}
+	}
+	return services, nil
+}
+
+// The foreground services are scheduled on the `application` nodes and the
+// rest on the `default` ones.
+func (s *sharedValues) nodeSelector(repo string) map[string]string {
+	if s.foregroundServices[repo] {
+		return map[string]string{"node_type": "application"}
 	}
-	foregroundServicesFile := fmt.Sprintf("%s/vars/aion_foreground_services.yml", m.Dirs.AnsibleDeployers)
+	return map[string]string{"node_type": "default"}
+}
+
+func (m *Migrator) sharedValues() *sharedValues {
+	shared := &sharedValues{}
+	foregroundServicesFile := fmt.Sprintf("%s/%s", m.Dirs.AnsibleDeployers, m.Config.ForegroundServices)
 	foregroundServices, err := os.ReadFile(foregroundServicesFile)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, fmt.Sprintf("%s Could not read file `%s`", color.Warning(), foregroundServicesFile))
-		//				log.Fatal(err)
+	}
+	shared.foregroundServices, err = parseForegroundServices(foregroundServices)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, fmt.Sprintf("%s Could not parse `%s`: %s", color.Warning(), foregroundServicesFile, err))
 	}
 
-	var serviceDir string
-	for _, dir := range dirs {
-		repo := dir.Name()
-		clonedAppDir := fmt.Sprintf("%s/%s/%s", m.Dirs.Cloned, m.Project.Name, repo)
-		appDir := fmt.Sprintf("%s/%s", m.Dirs.Project, repo)
-		kubeDir := fmt.Sprintf("%s/.kube", clonedAppDir)
-		// We capture this now to extract the image name and tag when we create the `overlays` files.
-		var defaultValues ManifestValues
-
-		if !checkFileExists(kubeDir) {
-			m.Debug.Files["noKube"] = append(m.Debug.Files["noKube"], repo)
-			err = os.RemoveAll(clonedAppDir)
+	// The certificates are looked up in the Ingress templates by `apex_domain` and
+	// `application_region`, i.e., `certificates_by_domain_and_region[apex_domain][application_region]`
+	// with a fall back to the older `certificates[apex_domain]`.
+	// See `ansible-deployers/vars/certificates.yml`.
+	certificatesFile := fmt.Sprintf("%s/%s", m.Dirs.AnsibleDeployers, m.Config.Certificates)
+	if !checkFileExists(certificatesFile) {
+		fmt.Fprintln(os.Stderr, fmt.Sprintf("%s Could not read the certificates file", color.Error()))
+	}
+	shared.certificates, shared.certificatesErr = getManifestValues(certificatesFile)
+	if shared.certificatesErr != nil {
+		fmt.Fprintln(os.Stderr, fmt.Sprintf("%s Could not read the certificates file: %s", color.Error(), shared.certificatesErr))
+	}
+	return shared
+}
+
+// Transform a single cloned repository into its Kustomize directories.  This is
+// safe to run concurrently with any other service, and all of its output is
+// written to `w`.
+func (m *Migrator) kustomizeService(repo string, shared *sharedValues, w io.Writer) *ServiceResult {
+	clonedAppDir := fmt.Sprintf("%s/%s", m.Dirs.Sources, repo)
+	s := &serviceJob{
+		m:            m,
+		shared:       shared,
+		repo:         repo,
+		clonedAppDir: clonedAppDir,
+		appDir:       fmt.Sprintf("%s/%s", m.Dirs.Project, repo),
+		kubeDir:      fmt.Sprintf("%s/%s", clonedAppDir, m.Config.KubeDir),
+		result:       &ServiceResult{Repository: repo},
+		w:            w,
+	}
+	if !m.Project.KeepSources {
+		defer func() {
+			err := os.RemoveAll(clonedAppDir)
 			if err != nil {
-				fmt.Println(err)
+				fmt.Fprintln(w, err)
 			}
-			continue
+		}()
+	}
+	if !checkFileExists(s.kubeDir) {
+		// There's nothing to kustomize anymore.
+		err := os.RemoveAll(s.appDir)
+		if err != nil {
+			s.warn("Could not remove the previous output %s: %s", s.appDir, err)
 		}
+		s.result.NoKube = true
+		return s.result
+	}
+	stagingDir, err := os.MkdirTemp(m.Dirs.Staging, fmt.Sprintf("%s-", repo))
+	if err != nil {
+		s.writeError(m.Dirs.Staging, err)
+		return s.result
+	}
+	defer os.RemoveAll(stagingDir)
+	s.stagingDir = stagingDir
 
-		// Get all dir entries in ".kube" and replace all tokens (`{{ TOKEN_NAME }}`) that we
-		// can in the Kubernetes manifest Jinja template files.  Some tokens will not be able
-		// to be replaced, as they are in the `ansible-deployers` repo.  This will be addressed
-		// in a later step.
-		//
-		// These will only replace the values gotten from the default environments file.  The
-		// other environment-specific values in `ansible-deployers` will be used to tokenize the
-		// special-case manifests such as Ingress and write them to the Kustomize overlays directory.
-		files, err := os.ReadDir(kubeDir)
-		if err != nil {
-			fmt.Fprintln(os.Stderr, fmt.Sprintf("%s Could not list contents of the .kube directory", color.Error()))
-			//			log.Fatal(err)
+	// Get all dir entries in ".kube" (or whatever the project config calls it) and render the Kubernetes manifest Jinja template
+	// files.  Some values will not be able to be resolved, as they are in the
+	// `ansible-deployers` repo.  This will be addressed in a later step.
+	//
+	// These will only use the values gotten from the default environments file.  The
+	// other environment-specific values in `ansible-deployers` will be used to render the
+	// special-case manifests such as Ingress and write them to the Kustomize overlays directory.
+	files, err := os.ReadDir(s.kubeDir)
+	if err != nil {
+		s.renderError(s.kubeDir, err)
+		return s.result
+	}
+
+	units := m.serviceUnits(s.stagingDir, files)
+	for _, unit := range units {
+		s.result.Manifests = append(s.result.Manifests, unit.files...)
+	}
+	for _, unit := range units {
+		s.kustomizeUnit(unit)
+	}
+	// There's no point building what's already known to be broken.
+	if len(s.result.RenderErrors) == 0 && len(s.result.WriteErrors) == 0 {
+		for _, unit := range units {
+			s.build(unit)
+		}
+	}
+	if len(s.result.RenderErrors) > 0 || len(s.result.WriteErrors) > 0 || len(s.result.BuildErrors) > 0 || invalid(s.result.SchemaErrors) > 0 {
+		if checkFileExists(s.appDir) {
+			fmt.Fprintln(s.w, fmt.Sprintf("%s Kept the previous output for `%s`", color.Warning(), s.repo))
+		}
+		s.result.Outputs = nil
+		return s.result
+	}
+	if err := s.commit(); err != nil {
+		s.writeError(s.appDir, err)
+		s.result.Outputs = nil
+		return s.result
+	}
+	s.result.Success = true
+	return s.result
+}
+
+// Put the manifest templates in the `kube_dir` into their Kustomize directories
+// under `dir`.
+func (m *Migrator) serviceUnits(dir string, files []os.DirEntry) []*serviceUnit {
+	var n int
+	for _, f := range files {
+		if strings.Contains(f.Name(), "-deployment") {
+			n += 1
+		}
+	}
+	hasMultipleDeployments := n > 1
+
+	// We cannot depend on the service name.  Instead, get the name up to the hyphen,
+	// which is also how each `default-` environment file in `environments` is named.
+	var units []*serviceUnit
+	byDir := map[string]*serviceUnit{}
+	for _, f := range files {
+		if f.IsDir() || filepath.Ext(f.Name()) != m.Config.TemplateExtension {
+			continue
+		}
+		unitDir := dir
+		if hasMultipleDeployments {
+			prefix, _, _ := strings.Cut(f.Name(), "-")
+			unitDir = fmt.Sprintf("%s/%s", dir, prefix)
 		}
+		unit, ok := byDir[unitDir]
+		if !ok {
+			unit = &serviceUnit{dir: unitDir}
+			byDir[unitDir] = unit
+			units = append(units, unit)
+		}
+		unit.files = append(unit.files, f.Name())
+	}
+	return units
+}
 
-		var hasMultipleDeployments bool
-		var n int
-		for _, f := range files {
-			if strings.Contains(f.Name(), "-deployment") {
-				n += 1
-				if n > 1 {
-					hasMultipleDeployments = true
-					break
-				}
+// Replace the previous output (if any) with what was staged.  If that can't be
+// done, the previous output is put back.
+func (s *serviceJob) commit() error {
+	if err := os.MkdirAll(filepath.Dir(s.appDir), os.ModePerm); err != nil {
+		return err
+	}
+	previous := fmt.Sprintf("%s.previous", s.stagingDir)
+	err := os.Rename(s.appDir, previous)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err := os.Rename(s.stagingDir, s.appDir); err != nil {
+		if checkFileExists(previous) {
+			if rollbackErr := os.Rename(previous, s.appDir); rollbackErr != nil {
+				return fmt.Errorf("%w (and could not put the previous output back: %w)", err, rollbackErr)
 			}
 		}
+		return err
+	}
+	return os.RemoveAll(previous)
+}
 
-		var k Service
-		for _, f := range files {
-			if f.IsDir() {
+// Check that every overlay of the staged unit can be built, and that what it's
+// built into is valid for the target Kubernetes version.
+func (s *serviceJob) build(unit *serviceUnit) {
+	for _, overlay := range s.m.buildOverlays(unit.dir) {
+		dir := s.output(overlay.Dir)
+		if overlay.Err != nil {
+			s.result.BuildErrors = append(s.result.BuildErrors, &BuildError{Environment: overlay.Environment, Dir: dir, Error: overlay.Err.Error()})
+			fmt.Fprintln(s.w, fmt.Sprintf("%s Could not build the `%s` overlay `%s`: %s", color.Error(), overlay.Environment, dir, overlay.Err))
+			continue
+		}
+		schemaErrs, err := s.m.checkSchemas(overlay)
+		if err != nil {
+			s.warn("Could not check the `%s` overlay `%s` against the schemas: %s", overlay.Environment, dir, err)
+			continue
+		}
+		for _, schemaErr := range schemaErrs {
+			s.result.SchemaErrors = append(s.result.SchemaErrors, schemaErr)
+			if schemaErr.Deprecated {
+				fmt.Fprintln(s.w, fmt.Sprintf("%s The `%s` overlay `%s` has a deprecated API version: %s", color.Warning(), overlay.Environment, dir, schemaErr))
 				continue
 			}
-			filename := f.Name()
-			filenameNoExtension, _, _ := strings.Cut(filename, "-")
-			if filepath.Ext(filename) == m.TplExt {
-				var content []byte
-				f := fmt.Sprintf("%s/%s", kubeDir, filename)
-				// Maybe fix up the manifests after variable substitution?
-				if strings.Contains(filename, "deployment") {
-					content = hackAndBeHappyDeployment(f, repo)
-					//				} else if strings.Contains(filename, "ingress") {
-					//					content = hackAndBeHappyIngress(f)
-				} else {
-					content, err = os.ReadFile(f)
-					if err != nil {
-						fmt.Fprintln(os.Stderr, fmt.Sprintf("%s Could not read file `%s`", color.Warning(), f))
-						//						log.Fatal(err)
-					}
-				}
-
-				// Remove the extension ONLY after the template file has been read.
-				filename = strings.TrimSuffix(filename, filepath.Ext(filename))
-
-				// We cannot depend on the service name.  Instead, get the name up to
-				// the hyphen and match it against each `default-` environment file
-				// in `environments`.
-
-				defaultManifestValues := fmt.Sprintf("%s/environments/defaults-%s.yaml", kubeDir, filenameNoExtension)
-				// Capture the default values because we will need them later (specifically, the image name).
-				defaultValues = getManifestValues(defaultManifestValues)
-				k.Resources = getResources(defaultValues)
-
-				if hasMultipleDeployments {
-					serviceDir = fmt.Sprintf("%s/%s", appDir, filenameNoExtension)
-					m.scaffold(serviceDir)
-					svcName, ok := defaultValues["service_name"]
-					if !ok {
-						fmt.Fprintln(os.Stderr, "No service name")
-					}
-					// Re-use the previous struct if it's a service because we don't want to overwrite
-					// any of the struct's information for the deployment.
-					// This **should** work because of lexigraphrical order, but it's brittle.
-					if !strings.Contains(filename, "-service") {
-						k = Service{
-							Name:          svcName.(string),
-							NameNoHyphens: filenameNoExtension,
-						}
-					}
-				} else {
-					// Create the build/serviceNameDir and Kustomized scaffolding for the service (repo).
-					serviceDir = appDir
-					m.scaffold(appDir)
-				}
-
-				tokenized, tokenMap := tokenizeManifests(defaultValues, string(content))
-				for k, v := range tokenMap {
-					// Any token that still exists in the `tokenized` string will have a non-zero value.
-					// This means that we haven't been able to replace it (not good).
-					if v > 0 {
-						m.Debug.Files["noMatchedToken"] = append(m.Debug.Files["noMatchedToken"], fmt.Sprintf("%s: %s", f, k))
-					}
-				}
-
-				// This is just horrible.  Since `ansible-deployers` was injecting this into the
-				// manifest via a Python script, there's not a "nice" way to do it here except by doing
-				// the same horrible thing (injection).
-				// If it were part of the templated Jinja manifest it wouldn't be nearly as ugly as this.
-				// NOTE: This becomes the value of `nodeSelector`, which is crazy.
-				if strings.Contains(filename, "deployment") {
-					// We need to append the `nodeSelector` label to the tokenized string.
-					var nodeSelectorLabel string
-					if strings.Contains(string(foregroundServices), repo) {
-						nodeSelectorLabel = "node_type: application"
-					} else {
-						nodeSelectorLabel = "node_type: default"
-					}
-					tokenized = fmt.Sprintf("%s      nodeSelector:\n        %s", tokenized, nodeSelectorLabel)
-				}
-
-				// We're going to patch the Ingress, so don't include it in the list
-				// that will become the `resources` list in base/kustomization.yaml.
-				// Instead, flag it so we know to add it as `overlays/ENV/patch_ingress.yaml`
-				// (see below).
-				if !strings.Contains(filename, "ingress") {
-					k.ResourceManifests = append(k.ResourceManifests, filename)
-					writeManifestFile(filename, tokenized, serviceDir)
-				} else {
-					k.HasIngress = &tokenized
-				}
-			}
+			fmt.Fprintln(s.w, fmt.Sprintf("%s The `%s` overlay `%s` isn't valid for Kubernetes %s: %s", color.Error(), overlay.Environment, dir, s.m.Schema.Version, schemaErr))
+		}
+	}
+}
 
-			// Create the base `kustomization.yaml`.
-			f, err := os.Create(fmt.Sprintf("%s/base/kustomization.yaml", serviceDir))
-			if err != nil {
-				fmt.Fprintln(os.Stderr, fmt.Sprintf("Could not create %s/base/kustomization.yaml", serviceDir))
-				//			log.Fatal(err)
+func (s *serviceJob) kustomizeUnit(unit *serviceUnit) {
+	err := s.m.scaffold(unit.dir)
+	if err != nil {
+		s.writeError(unit.dir, err)
+		return
+	}
+
+	var k Service
+	// We capture this now to extract the image name and tag when we create the `overlays` files.
+	var defaultValues ManifestValues
+	for _, filename := range unit.files {
+		f := fmt.Sprintf("%s/%s", s.kubeDir, filename)
+		content, err := os.ReadFile(f)
+		if err != nil {
+			s.warn("Could not read file `%s`", f)
+			continue
+		}
+
+		filenameNoExtension, _, _ := strings.Cut(filename, "-")
+		// Remove the extension ONLY after the template file has been read.
+		filename = strings.TrimSuffix(filename, filepath.Ext(filename))
+
+		// Capture the default values because we will need them later (specifically, the image name).
+		var ok bool
+		defaultValues, ok = s.values(fmt.Sprintf("%s/%s/%s", s.kubeDir, s.m.Config.ValuesDir, s.m.Config.defaultsFile(filenameNoExtension)))
+		if !ok {
+			// Nothing in the unit can be rendered without them.
+			return
+		}
+		if k.NameNoHyphens == "" {
+			k.NameNoHyphens = filenameNoExtension
+			if svcName, ok := defaultValues["service_name"].(string); ok {
+				k.Name = svcName
+			} else {
+				s.warn("No service name in the defaults for `%s`", s.repo)
+				k.Name = s.repo
 			}
-			defer f.Close()
+		}
 
-			err = m.Template.ExecuteTemplate(f, "kustomization_base.tpl", k)
+		// We're going to patch the Ingress, so don't include it in the list
+		// that will become the `resources` list in base/kustomization.yaml.
+		// Instead, flag it so we know to add it as `overlays/ENV/ingress.yaml`.
+		// It needs the environment-specific values, so it's rendered for each
+		// overlay (see below).
+		if strings.Contains(filename, "ingress") {
+			ingress := string(content)
+			k.HasIngress = &ingress
+			continue
+		}
+
+		tokenized, ok := s.render(f, string(content), mapMerge(s.m.Config.Vars, defaultValues))
+		if !ok {
+			continue
+		}
+		// `ansible-deployers` was injecting the `nodeSelector` into the manifest via a
+		// Python script, so do the same here, along with swapping the env vars for the
+		// ConfigMap that's generated in each overlay.
+		// NOTE: This becomes the value of `nodeSelector`, which is crazy.
+		if strings.Contains(filename, "deployment") {
+			rewritten, err := rewriteDeployment(tokenized, &DeploymentPatch{
+				ConfigMapName: fmt.Sprintf("env-%s", k.Name),
+				NodeSelector:  s.shared.nodeSelector(s.repo),
+			})
 			if err != nil {
-				fmt.Fprintln(os.Stderr, "Could not execute template `kustomization_base.tpl`")
-				//			log.Fatal(err)
+				s.renderError(f, fmt.Errorf("could not rewrite the Deployment: %w", err))
+				continue
 			}
+			tokenized = rewritten
+		}
 
-			// Create the `env` file in each overlays environment that will be used to generate the
-			// ConfigMap that will replace the embedding of the env vars in the Deployment.
-			// In addition, create the `kustomization.yaml` file in each overlays environment dir.
-			//
-			// Note: if the service includes an Ingress, then include this as a patch in the respective
-			// overlay environment's directory as a patch.
-			for _, env := range m.Environments {
-				// Create a `kustomization.yaml` for each environment in overlays.
-				f, err = os.Create(fmt.Sprintf("%s/overlays/%s/kustomization.yaml", serviceDir, env))
-				if err != nil {
-					fmt.Fprintln(os.Stderr, fmt.Sprintf("Could not create %s/overlays/%s/kustomization.yaml", serviceDir, env))
-					//				log.Fatal(err)
-				}
-				defer f.Close()
-
-				k.Environment = env
-				defaultImage, ok := defaultValues["container_image"]
-				if !ok {
-					fmt.Fprintln(os.Stderr, "No default image")
-				} else {
-					containerImage := strings.Split(defaultImage.(string), ":")
-					var containerImageName string
-					var newTag string
-					if len(containerImage) == 0 {
-						containerImageName = env
-						newTag = env
-					} else if len(containerImage) == 1 {
-						containerImageName = containerImage[0]
-						newTag = env
-					} else if len(containerImage) == 2 {
-						containerImageName = containerImage[0]
-						newTag = containerImage[1]
-					}
-					k.Image = &Image{
-						Name:    containerImageName,
-						NewName: containerImageName,
-						NewTag:  newTag,
-					}
-				}
-				replicas, ok := defaultValues["replicas"]
-				if !ok {
-					fmt.Fprintln(os.Stderr, "No replicas")
-				} else {
-					k.Replicas = replicas.(int)
-				}
-
-				err = m.Template.ExecuteTemplate(f, "kustomization_overlay.tpl", k)
-				if err != nil {
-					fmt.Fprintln(os.Stderr, "Could not execute template `kustomization_overlay.tpl`")
-					//				log.Fatal(err)
-				}
-
-				if env != "development" && k.Resources != nil {
-					f, err := os.Create(fmt.Sprintf("%s/overlays/%s/deployment_patch.yaml", serviceDir, env))
-					if err != nil {
-						fmt.Fprintln(os.Stderr, fmt.Sprintf("Could not create %s/overlays/%s/deployment_patch.yaml", serviceDir, env))
-						//				log.Fatal(err)
-					}
-					defer f.Close()
-
-					err = m.Template.ExecuteTemplate(f, "deployment_patch.tpl", k.Resources)
-					if err != nil {
-						fmt.Fprintln(os.Stderr, "Could not execute template `deployment_patch.tpl`")
-						//				log.Fatal(err)
-					}
-				}
-
-				envFile := fmt.Sprintf("%s/environments/%s-%s.yaml", kubeDir, env, k.NameNoHyphens)
-				content, err := os.ReadFile(envFile)
-				if err != nil {
-					fmt.Fprintln(os.Stderr, fmt.Sprintf("%s Could not read file `%s`", color.Warning(), envFile))
-					//				log.Fatal(err)
-				}
-				baseEnvVars := T{}
-				err = yaml.Unmarshal(content, &baseEnvVars)
-				if err != nil {
-					//				log.Fatal(err)
-				}
-
-				// overrides in ansible-deployers
-				// 		     repo  = aion-nginx
-				// k.NameNoHyphens = aionnginx
-				overridesFile := fmt.Sprintf("%s/%s/environments/%s-%s.yaml", m.Dirs.AnsibleDeployerOverrides, repo, env, k.NameNoHyphens)
-				content, _ = os.ReadFile(overridesFile)
-				if err != nil {
-					fmt.Fprintln(os.Stderr, fmt.Sprintf("%s Could not read file `%s`", color.Warning(), overridesFile))
-					//				log.Fatal(err)
-				}
-				overridesEnvVars := T{}
-				err = yaml.Unmarshal(content, &overridesEnvVars)
-				if err != nil {
-					fmt.Fprintln(os.Stderr, "Could not unmarshal `ovveridesEnvVars`")
-					//				log.Fatal(err)
-				}
-
-				envvars := map[string]string{}
-				replaceMerge(envvars, baseEnvVars, overridesEnvVars)
-
-				f, err := os.Create(fmt.Sprintf("%s/overlays/%s/env", serviceDir, env))
-				if err != nil {
-					fmt.Fprintln(os.Stderr, fmt.Sprintf("Could not create file %s/overlays/%s/env", serviceDir, env))
-					//				log.Fatal(err)
-				}
-				defer f.Close()
-				err = m.Template.ExecuteTemplate(f, "env.tpl", envvars)
-				if err != nil {
-					fmt.Fprintln(os.Stderr, "Could not execute template `env.tpl`")
-					//				log.Fatal(err)
-				}
-
-				if k.HasIngress != nil {
-					baseFile := fmt.Sprintf("%s/environments/%s-%s.yaml", kubeDir, k.Environment, k.NameNoHyphens)
-					overridesFile = fmt.Sprintf("%s/%s/environments/%s-%s.yaml", m.Dirs.AnsibleDeployerOverrides, repo, k.Environment, k.NameNoHyphens)
-
-					mergedValues := mapMerge(
-						getManifestValues(baseFile),
-						getManifestValues(overridesFile),
-					)
-					// TODO (tokenMap)
-					tokenized, _ := tokenizeManifests(mergedValues, *k.HasIngress)
-
-					// TODO: aion-multi-system-login-nginx has `additional_certs` in its `mergedValues` map BUT
-					// is looking for `additional_certificates` in its tokenized Ingress manifest.
-					//				if k.Environment == "beta" {
-					//					fmt.Println("mergedValues", mergedValues)
-					//					fmt.Println("tokenized", tokenized)
-					//				}
-
-					// This whole block is just horrid.
-					//
-					// Check the newer dictionary first.
-					// See `ansible-deployers/vars/certificates.yml`.
-					// Get some certificate values, without which nothing can be looked up.
-					apexDomain, applicationRegion, err := getCertificateValues(mergedValues)
-					if err != nil {
-						fmt.Println(fmt.Sprintf("  %s %s", color.Error(), err))
-					}
-					contents, err := os.ReadFile("build/ansible-deployers/vars/certificates.yml")
-					if err != nil {
-						fmt.Println(fmt.Sprintf("%s Could not read the certificates file", color.Error()))
-					}
-					c := &C{}
-					err = yaml.Unmarshal(contents, &c)
-					if err != nil {
-						fmt.Println(err)
-					}
-					certsByRegion, certsOK := c.CertificatesByDomainAndRegion[apexDomain]
-					if certsOK {
-						cert, certOK := certsByRegion[applicationRegion]
-						if certOK {
-							tokenized = strings.ReplaceAll(tokenized, "{{ certificates_by_domain_and_region[apex_domain][application_region] }}", cert)
-						} else {
-							fmt.Println(fmt.Sprintf("%s There is no application region certification", color.Warning()))
-						}
-					} else {
-						fmt.Println(fmt.Sprintf("%s There are no certifications by application region", color.Warning()))
-						// Fall back to the old method.
-						// See `ansible-deployers/vars/certificates.yml`.
-						cert, certOK := c.Certificates[apexDomain]
-						if certOK {
-							tokenized = strings.ReplaceAll(tokenized, "{{ certificates[apex_domain] }}", cert)
-						} else {
-							fmt.Println(fmt.Sprintf("%s There is no certification", color.Warning()))
-						}
-					}
-
-					_, additionalCertsOK := mergedValues["additional_certs"]
-					_, additionalCertificatesOK := mergedValues["additional_certificates"]
-					var hasAdditionalCerts bool
-					if additionalCertsOK || additionalCertificatesOK {
-						hasAdditionalCerts = true
-					}
-
-					// Now we want to fix up the Ingress manifest template.  We do it now because we have access
-					// to the variables that we need to make our determinations about what to do with the template.
-					lines := hackAndBeHappyIngress(tokenized, k.Environment, hasAdditionalCerts)
-
-					ingressFile := fmt.Sprintf("%s/overlays/%s/ingress.yaml", serviceDir, k.Environment)
-					fd, err := os.Create(ingressFile)
-					w := bufio.NewWriter(fd)
-					for _, line := range lines {
-						w.WriteString(fmt.Sprintf("%s\n", string(line)))
-					}
-					w.Flush()
-				}
-			}
+		k.ResourceManifests = append(k.ResourceManifests, filename)
+		s.write(fmt.Sprintf("%s/base/%s", unit.dir, filename), tokenized)
+	}
 
-			//		err = os.RemoveAll(kubeDir)
-			//		if err != nil {
-			//			fmt.Println(err, fmt.Sprintf("%s Could not remove the %s", color.Warning(), kubeDir))
-			//		}
+	// Create the base `kustomization.yaml`.
+	s.executeTemplate(fmt.Sprintf("%s/base/kustomization.yaml", unit.dir), "kustomization_base.tpl", k)
 
+	k.Resources = s.getResources(defaultValues)
+	defaultImage, ok := defaultValues["container_image"]
+	if !ok {
+		s.warn("No default image for `%s`", s.repo)
+	} else {
+		containerImage := strings.Split(fmt.Sprint(defaultImage), ":")
+		var containerImageName string
+		var newTag string
+		containerImageName = containerImage[0]
+		if len(containerImage) > 1 {
+			newTag = containerImage[1]
 		}
-		err = os.RemoveAll(clonedAppDir)
+		k.Image = &Image{
+			Name:    containerImageName,
+			NewName: containerImageName,
+			NewTag:  newTag,
+		}
+	}
+	replicas, ok := defaultValues["replicas"].(int)
+	if !ok {
+		s.warn("No replicas for `%s`", s.repo)
+	} else {
+		k.Replicas = replicas
+	}
+
+	// Create the `env` file in each overlays environment that will be used to generate the
+	// ConfigMap that will replace the embedding of the env vars in the Deployment.
+	// In addition, create the `kustomization.yaml` file in each overlays environment dir.
+	//
+	// Note: if the service includes an Ingress, then include this as a patch in the respective
+	// overlay environment's directory as a patch.
+	for _, env := range s.m.Environments {
+		k.Environment = env
+		s.kustomizeOverlay(unit, k, defaultValues)
+	}
+}
+
+func (s *serviceJob) kustomizeOverlay(unit *serviceUnit, k Service, defaultValues ManifestValues) {
+	env := k.Environment
+	overlayDir := fmt.Sprintf("%s/overlays/%s", unit.dir, env.Name)
+	// An image without a tag is tagged with the environment.
+	if k.Image != nil && k.Image.NewTag == "" {
+		image := *k.Image
+		image.NewTag = env.Name
+		k.Image = &image
+	}
+
+	// Create a `kustomization.yaml` for each environment in overlays.
+	s.executeTemplate(fmt.Sprintf("%s/kustomization.yaml", overlayDir), "kustomization_overlay.tpl", k)
+
+	if env.ResourcePatches && k.Resources != nil {
+		s.executeTemplate(fmt.Sprintf("%s/deployment_patch.yaml", overlayDir), "deployment_patch.tpl", k.Resources)
+	}
+
+	envFile := fmt.Sprintf("%s/%s/%s", s.kubeDir, s.m.Config.ValuesDir, env.valuesFile(k.NameNoHyphens))
+	content, err := os.ReadFile(envFile)
+	if err != nil {
+		s.result.MissingValuesFiles = append(s.result.MissingValuesFiles, envFile)
+		fmt.Fprintln(s.w, fmt.Sprintf("%s Could not read file `%s`", color.Warning(), envFile))
+	}
+	baseEnvVars := T{}
+	err = yaml.Unmarshal(content, &baseEnvVars)
+	if err != nil {
+		s.warn("Could not unmarshal `%s`: %s", envFile, err)
+	}
+
+	// overrides in ansible-deployers
+	// 		     repo  = aion-nginx
+	// k.NameNoHyphens = aionnginx
+	overridesFile := fmt.Sprintf("%s/%s/%s/%s", s.m.Dirs.AnsibleDeployerOverrides, s.repo, s.m.Config.ValuesDir, env.valuesFile(k.NameNoHyphens))
+	// Most services don't have any overrides, so a missing file isn't worth a warning.
+	content, _ = os.ReadFile(overridesFile)
+	overridesEnvVars := T{}
+	err = yaml.Unmarshal(content, &overridesEnvVars)
+	if err != nil {
+		s.warn("Could not unmarshal `%s`: %s", overridesFile, err)
+	}
+
+	envvars := map[string]string{}
+	replaceMerge(envvars, baseEnvVars, overridesEnvVars)
+	s.executeTemplate(fmt.Sprintf("%s/env", overlayDir), "env.tpl", envvars)
+
+	if k.HasIngress == nil {
+		return
+	}
+	ingressFile := fmt.Sprintf("%s/ingress.yaml", overlayDir)
+	if s.shared.certificatesErr != nil {
+		s.renderError(s.output(ingressFile), fmt.Errorf("could not read the certificates: %w", s.shared.certificatesErr))
+		return
+	}
+	envValues, ok := s.readValues(envFile)
+	if !ok {
+		return
+	}
+	overridesValues, ok := s.readValues(overridesFile)
+	if !ok {
+		return
+	}
+	mergedValues := mapMerge(
+		s.m.Config.Vars,
+		s.shared.certificates,
+		defaultValues,
+		envValues,
+		overridesValues,
+		ManifestValues{"application_environment": env.Name},
+	)
+	// The staging directory is gone by the time anyone reads the report.
+	tokenized, ok := s.render(s.output(ingressFile), *k.HasIngress, mergedValues)
+	if !ok {
+		return
+	}
+	if env.IngressClass != "" {
+		rewritten, err := rewriteIngress(tokenized, env.IngressClass)
 		if err != nil {
-			fmt.Println(err)
+			s.renderError(s.output(ingressFile), fmt.Errorf("could not set the ingress class: %w", err))
+			return
 		}
+		tokenized = rewritten
 	}
+	s.write(ingressFile, tokenized)
 }
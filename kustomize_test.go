@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestForegroundServices(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents string
+		repo     string
+		want     string
+		wantErr  bool
+	}{
+		{
+			name:     "list",
+			contents: "- aion-nginx\n- aion-api\n",
+			repo:     "aion-api",
+			want:     "application",
+		},
+		{
+			name:     "variable",
+			contents: "aion_foreground_services:\n  - aion-nginx\n",
+			repo:     "aion-nginx",
+			want:     "application",
+		},
+		{
+			name:     "part of a name",
+			contents: "aion_foreground_services:\n  - aion-nginx-proxy\n",
+			repo:     "aion-nginx",
+			want:     "default",
+		},
+		{
+			name:     "not in the list",
+			contents: "- aion-nginx\n",
+			repo:     "aion-api",
+			want:     "default",
+		},
+		{
+			name: "empty",
+			repo: "aion-api",
+			want: "default",
+		},
+		{
+			name:     "not a list",
+			contents: "aion-nginx aion-api\n",
+			repo:     "aion-api",
+			want:     "default",
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			services, err := parseForegroundServices([]byte(tt.contents))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want an error: %t", err, tt.wantErr)
+			}
+			shared := &sharedValues{foregroundServices: services}
+			if got := shared.nodeSelector(tt.repo)["node_type"]; got != tt.want {
+				t.Errorf("got node_type %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,86 +1,664 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"io"
 	"os"
+	"os/signal"
+	"regexp"
+	"slices"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/btoll/migrator/color"
-	"github.com/ktrysmt/go-bitbucket"
 )
 
+type command struct {
+	name        string
+	description string
+	run         func(ctx context.Context, args []string) error
+}
+
+var commands = []*command{
+	{"run", "Clone and transform the repositories (the default)", runCommand},
+	{"list", "List the project's repositories", listCommand},
+	{"clone", "Clone the repositories", cloneCommand},
+	{"transform", "Transform the cloned repositories into the kustomized directory structure", transformCommand},
+	{"validate", "Check the kustomized directory structure", validateCommand},
+	{"verify", "Compare the kustomized services with what `ansible-deployers` would have deployed", verifyCommand},
+	{"report", "Summarize a run and regenerate its dashboard", reportCommand},
+	{"diff", "Compare the kustomized directory structure with another directory or the gitops repository", diffCommand},
+	{"publish", "Commit the kustomized services to a new branch of the gitops repository", publishCommand},
+	{"prune", "Delete the cached repositories that haven't been used recently", pruneCommand},
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: migrator <command> [flags]")
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "Commands:")
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", c.name, c.description)
+	}
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "Run `migrator <command> --help` for the command's flags.")
+}
+
 func main() {
-	filename := flag.String("file", "", "The name of the file that contains the repositories to clone")
-	project := flag.String("project", "", "The name of the project")
-	buildDir := flag.String("build-dir", "build", "The location of the build directory.  Defaults to `./build`.")
-	cloneOnly := flag.Bool("clone-only", false, "Clone but don't kustomize")
-	flag.Parse()
+	args := os.Args[1:]
+	// Flags without a command are the original (and still default) way to run it.
+	c := commands[0]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		if args[0] == "help" {
+			usage()
+			return
+		}
+		i := slices.IndexFunc(commands, func(c *command) bool {
+			return c.name == args[0]
+		})
+		if i == -1 {
+			fmt.Fprintln(os.Stderr, fmt.Sprintf("%s Unknown command `%s`", color.Error(), args[0]))
+			usage()
+			os.Exit(2)
+		}
+		c = commands[i]
+		args = args[1:]
+	}
 
-	if *project == "" {
+	// The first Ctrl-C (or SIGTERM) lets what's in flight finish (or roll back) and
+	// writes the report, and the second one quits right away.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+		fmt.Fprintln(os.Stderr, fmt.Sprintf("%s Interrupted, finishing what's in flight (Ctrl-C again to quit)...", color.Warning()))
+	}()
+
+	startTime := time.Now()
+	err := c.run(ctx, args)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if errors.Is(err, context.Canceled) {
+		fmt.Fprintln(os.Stderr, fmt.Sprintf("%s Interrupted, only what was done is in the report", color.Warning()))
+		os.Exit(130)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, fmt.Sprintf("%s %s", color.Error(), err))
 		os.Exit(1)
 	}
+	if c.name == "run" || c.name == "clone" || c.name == "transform" {
+		fmt.Println("total time taken ", time.Since(startTime).Seconds(), "seconds")
+	}
+}
+
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: migrator %s [flags]\n\n", name)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// The flags that every command that works on a project's build directory needs.
+type projectFlags struct {
+	project      *string
+	buildDir     *string
+	config       *string
+	environments *string
+	report       *string
+	jobs         *int
+}
+
+func addProjectFlags(fs *flag.FlagSet) *projectFlags {
+	return &projectFlags{
+		project:      fs.String("project", "", "The name of the project (required)"),
+		buildDir:     fs.String("build-dir", "build", "The location of the build directory.  Defaults to `./build`."),
+		config:       fs.String("config", defaultConfigFile, "The project config that declares the paths and naming conventions"),
+		environments: fs.String("environments", "", "The YAML file that declares the environments.  Defaults to `production`, `beta` and `development`."),
+		report:       fs.String("report", "", "Where to write the JSON report of the run.  Defaults to `BUILD_DIR/report.json`."),
+		jobs:         fs.Int("jobs", 1, "The number of repositories to clone or transform at the same time"),
+	}
+}
+
+func (f *projectFlags) newProject() (*Project, error) {
+	if *f.project == "" {
+		return nil, errors.New("`--project` is required")
+	}
+	return &Project{
+		Name:             strings.ToLower(*f.project),
+		BuildDir:         *f.buildDir,
+		ConfigFile:       *f.config,
+		EnvironmentsFile: *f.environments,
+		ReportFile:       *f.report,
+		Jobs:             *f.jobs,
+	}, nil
+}
+
+// The flags for listing and cloning from the provider.
+type providerFlags struct {
+	provider     *string
+	owner        *string
+	apiURL       *string
+	cloneURL     *string
+	projectKey   *string
+	match        *string
+	language     *string
+	updatedSince *string
+	archived     *string
+	auth         *string
+	sshKey       *string
+	knownHosts   *string
+	retries      *int
+	timeout      *time.Duration
+}
+
+func addProviderFlags(fs *flag.FlagSet) *providerFlags {
+	return &providerFlags{
+		provider:     fs.String("provider", "bitbucket", "Where the repositories are hosted: `bitbucket`, `github`, `gitlab`, `gitea` or `local`"),
+		owner:        fs.String("owner", "", "The Bitbucket workspace, GitHub or Gitea organization or GitLab group.  Defaults to `pecteam` for Bitbucket."),
+		apiURL:       fs.String("api-url", "", "The base URL of the provider's API (for self-hosted instances)"),
+		cloneURL:     fs.String("clone-url", "", "The base URL to clone from, e.g. `git@bitbucket.org:pecteam`, or the directory of repositories for the `local` provider"),
+		projectKey:   fs.String("project-key", "", "Only list the repositories in the Bitbucket project with this key (instead of matching the project name)"),
+		match:        fs.String("match", "", "Only list the repositories whose name matches this regular expression"),
+		language:     fs.String("language", "", "Only list the repositories in this language"),
+		updatedSince: fs.String("updated-since", "", "Only list the repositories updated on or after this date (YYYY-MM-DD)"),
+		archived:     fs.String("archived", ArchivedExclude, "Whether to `exclude`, `include` or list `only` the archived repositories"),
+		auth:         fs.String("auth", "", "How to authenticate the clones: `auto`, `ssh-agent`, `ssh-key`, `https`, `netrc` or `none`.  Defaults to the project config or `auto`."),
+		sshKey:       fs.String("ssh-key", "", "The SSH private key to clone with.  The passphrase, if any, is read from `SSH_KEY_PASSPHRASE`."),
+		knownHosts:   fs.String("known-hosts", "", "Check the host keys against `~/.ssh/known_hosts` (`strict`), a known_hosts file or not at all (`ignore`)"),
+		retries:      fs.Int("retries", -1, "The number of times to retry a clone or an API request that fails for a reason that might go away.  Defaults to the project config or 3."),
+		timeout:      fs.Duration("timeout", 0, "How long a single clone or API request can take.  Defaults to the project config or 5m."),
+	}
+}
+
+// Create the provider and the clone credentials for the project.
+func (f *providerFlags) configure(p *Project) error {
+	provider, err := f.newProvider()
+	if err != nil {
+		return err
+	}
+	p.Provider = provider
+	p.ProviderName = *f.provider
+	p.Auth = &AuthConfig{
+		Method:     *f.auth,
+		SSHKey:     *f.sshKey,
+		KnownHosts: *f.knownHosts,
+	}
+	if p.Auth.Method == "" && p.Auth.SSHKey != "" {
+		p.Auth.Method = AuthSSHKey
+	}
+	p.Retry = f.retry()
+	return nil
+}
 
-	var p *Project
-	if *filename == "" {
-		username := os.Getenv("BITBUCKET_USERNAME")
-		password := os.Getenv("BITBUCKET_PASSWORD")
+func (f *providerFlags) retry() *RetryPolicy {
+	return &RetryPolicy{
+		Retries: *f.retries,
+		Timeout: *f.timeout,
+	}
+}
 
-		if !(username != "" && password != "") {
-			fmt.Fprintln(os.Stderr, fmt.Sprintf("%s Both username (BITBUCKET_USERNAME) and password (BITBUCKET_PASSWORD) must be set.", color.Error()))
-			os.Exit(1)
+func (f *providerFlags) newProvider() (SourceProvider, error) {
+	filter := &RepositoryFilter{
+		ProjectKey: *f.projectKey,
+		Language:   *f.language,
+		Archived:   *f.archived,
+	}
+	if *f.match != "" {
+		re, err := regexp.Compile(*f.match)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid regular expression `%s`: %w", *f.match, err)
 		}
+		filter.Name = re
+	}
+	if *f.updatedSince != "" {
+		t, err := time.Parse(time.DateOnly, *f.updatedSince)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid date `%s`, expected YYYY-MM-DD", *f.updatedSince)
+		}
+		filter.UpdatedSince = t
+	}
+	if *f.timeout < 0 {
+		return nil, errors.New("`--timeout` can't be negative")
+	}
+	if !slices.Contains([]string{ArchivedExclude, ArchivedInclude, ArchivedOnly}, *f.archived) {
+		return nil, errors.New("`--archived` must be one of `exclude`, `include` or `only`")
+	}
+	return NewSourceProvider(&ProviderOptions{
+		Name:     *f.provider,
+		Owner:    *f.owner,
+		APIURL:   *f.apiURL,
+		CloneURL: *f.cloneURL,
+		Filter:   filter,
+		// The project config isn't read for listing, so these are only the flags.
+		Retry: f.retry().merge(defaultRetryPolicy()),
+	})
+}
 
-		f, err := os.Create(fmt.Sprintf("repos/%s.names", *project))
+// List the project's repositories and write them to `w`, one per line.
+func listRepositories(provider SourceProvider, project string, w io.Writer) (*RepositoryNames, error) {
+	repositories, err := provider.ListRepositories(project)
+	if err != nil {
+		return nil, err
+	}
+	repositoryNames := &RepositoryNames{}
+	for _, repository := range repositories {
+		*repositoryNames = append(*repositoryNames, repository.Name)
+		_, err := fmt.Fprintln(w, repository.Name)
 		if err != nil {
-			fmt.Println(err)
-			os.Exit(1)
+			return nil, err
 		}
-		defer f.Close()
-		c := bitbucket.NewBasicAuth(username, password)
-		opt := &bitbucket.RepositoriesOptions{
-			Owner: "pecteam",
+	}
+	return repositoryNames, nil
+}
+
+// The repositories are either in `--file` or listed from the provider, in which
+// case they're also written to `repos/PROJECT.names`.
+func setRepositories(p *Project, filename, project string) error {
+	if filename != "" {
+		p.Filename = filename
+		return nil
+	}
+	f, err := os.Create(fmt.Sprintf("repos/%s.names", project))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	repositoryNames, err := listRepositories(p.Provider, project, f)
+	if err != nil {
+		return err
+	}
+	p.UseLogin = true
+	p.RepositoryNames = repositoryNames
+	return nil
+}
+
+func splitRefs(refs string) []string {
+	var split []string
+	for _, ref := range strings.Split(refs, ",") {
+		if ref = strings.TrimSpace(ref); ref != "" {
+			split = append(split, ref)
 		}
-		res, err := c.Repositories.ListForAccount(opt)
+	}
+	return split
+}
+
+func runCommand(ctx context.Context, args []string) error {
+	fs := newFlagSet("run")
+	pf := addProjectFlags(fs)
+	sf := addProviderFlags(fs)
+	filename := fs.String("file", "", "The name of the file that contains the repositories to clone")
+	cacheDir := fs.String("cache-dir", "", "Cache the repositories in this directory and only fetch what's changed on later runs.  Defaults to the project config's `cache_dir`.")
+	offline := fs.Bool("offline", false, "Only clone from the cache, without fetching anything")
+	fullClone := fs.Bool("full-clone", false, "Clone the whole history and check out everything, not only the latest commit of the .kube directory")
+	refs := fs.String("refs", "", "The refs to clone, in order of preference, e.g. `development,main,HEAD`.  Defaults to the project config or `development,master,HEAD`.")
+	cloneOnly := fs.Bool("clone-only", false, "Clone but don't kustomize")
+	keepSources := fs.Bool("keep-sources", false, "Don't delete the cloned repositories once they're transformed")
+	kubernetesVersion := fs.String("kubernetes-version", "", "The Kubernetes version to check the built overlays against, e.g. `1.29`.  Defaults to the project config or the latest that there's a schema for.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	p, err := pf.newProject()
+	if err != nil {
+		return err
+	}
+	if err := sf.configure(p); err != nil {
+		return err
+	}
+	if *offline && *filename == "" {
+		return errors.New("`--offline` needs the repositories in `--file`")
+	}
+	if err := setRepositories(p, *filename, *pf.project); err != nil {
+		return err
+	}
+	p.Refs = splitRefs(*refs)
+	p.FullClone = *fullClone
+	p.CacheDir = *cacheDir
+	p.Offline = *offline
+	p.CloneOnly = *cloneOnly
+	p.KeepSources = *keepSources
+	p.KubernetesVersion = *kubernetesVersion
+	return NewMigrator(p).migrate(ctx)
+}
+
+func listCommand(ctx context.Context, args []string) error {
+	fs := newFlagSet("list")
+	project := fs.String("project", "", "The name of the project (required)")
+	output := fs.String("output", "", "The file to write the repository names to.  Defaults to stdout.")
+	sf := addProviderFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *project == "" {
+		return errors.New("`--project` is required")
+	}
+	provider, err := sf.newProvider()
+	if err != nil {
+		return err
+	}
+	w := io.Writer(os.Stdout)
+	if *output != "" {
+		f, err := os.Create(*output)
 		if err != nil {
-			panic(err)
+			return err
 		}
-		repositoryNames := &RepositoryNames{}
-		for _, item := range res.Items {
-			if item.Project.Name == *project {
-				*repositoryNames = append(*repositoryNames, item.Slug)
-				_, err := fmt.Fprintln(f, item.Slug)
-				if err != nil {
-					log.Fatal(err)
-				}
-			}
+		defer f.Close()
+		w = f
+	}
+	_, err = listRepositories(provider, *project, w)
+	return err
+}
+
+func cloneCommand(ctx context.Context, args []string) error {
+	fs := newFlagSet("clone")
+	pf := addProjectFlags(fs)
+	sf := addProviderFlags(fs)
+	filename := fs.String("file", "", "The name of the file that contains the repositories to clone")
+	cacheDir := fs.String("cache-dir", "", "Cache the repositories in this directory and only fetch what's changed on later runs.  Defaults to the project config's `cache_dir`.")
+	offline := fs.Bool("offline", false, "Only clone from the cache, without fetching anything")
+	fullClone := fs.Bool("full-clone", false, "Clone the whole history and check out everything, not only the latest commit of the .kube directory")
+	refs := fs.String("refs", "", "The refs to clone, in order of preference, e.g. `development,main,HEAD`.  Defaults to the project config or `development,master,HEAD`.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	p, err := pf.newProject()
+	if err != nil {
+		return err
+	}
+	if err := sf.configure(p); err != nil {
+		return err
+	}
+	if *offline && *filename == "" {
+		return errors.New("`--offline` needs the repositories in `--file`")
+	}
+	if err := setRepositories(p, *filename, *pf.project); err != nil {
+		return err
+	}
+	p.Refs = splitRefs(*refs)
+	p.FullClone = *fullClone
+	p.CacheDir = *cacheDir
+	p.Offline = *offline
+	p.CloneOnly = true
+	return NewMigrator(p).migrate(ctx)
+}
+
+func transformCommand(ctx context.Context, args []string) error {
+	fs := newFlagSet("transform")
+	pf := addProjectFlags(fs)
+	source := fs.String("source", "", "The directory of repositories to transform.  Defaults to `BUILD_DIR/cloned/PROJECT`.")
+	deleteSources := fs.Bool("delete-sources", false, "Delete the repositories once they're transformed")
+	ansibleDeployers := fs.String("ansible-deployers", "", "The `ansible-deployers` working copy.  Defaults to the one cloned into the build directory.")
+	kubernetesVersion := fs.String("kubernetes-version", "", "The Kubernetes version to check the built overlays against, e.g. `1.29`.  Defaults to the project config or the latest that there's a schema for.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	p, err := pf.newProject()
+	if err != nil {
+		return err
+	}
+	// This is meant to be run over and over while working on the transformations,
+	// so the sources are kept unless asked otherwise.
+	p.SourceDir = *source
+	p.KeepSources = !*deleteSources
+	p.AnsibleDeployersDir = *ansibleDeployers
+	p.KubernetesVersion = *kubernetesVersion
+	m := NewMigrator(p)
+	startedAt := time.Now()
+	err = m.kustomize(ctx)
+	m.writeReport(ctx, startedAt)
+	if err != nil {
+		return err
+	}
+	return ctx.Err()
+}
+
+func validateCommand(ctx context.Context, args []string) error {
+	fs := newFlagSet("validate")
+	pf := addProjectFlags(fs)
+	kubernetesVersion := fs.String("kubernetes-version", "", "The Kubernetes version to check the built overlays against, e.g. `1.29`.  Defaults to the project config or the latest that there's a schema for.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	p, err := pf.newProject()
+	if err != nil {
+		return err
+	}
+	p.KubernetesVersion = *kubernetesVersion
+	problems, err := NewMigrator(p).validate()
+	if err != nil {
+		return err
+	}
+	failed := 0
+	for _, problem := range problems {
+		fmt.Println(problem)
+		if !problem.Deprecated {
+			failed++
 		}
-		p = &Project{
-			Name:      strings.ToLower(*project),
-			BuildDir:  *buildDir,
-			UseLogin:  true,
-			CloneOnly: *cloneOnly,
-			Login: &Login{
-				Username: username,
-				Password: password,
-			},
-			RepositoryNames: repositoryNames,
+	}
+	if failed > 0 {
+		return fmt.Errorf("Found %d problems", failed)
+	}
+	fmt.Fprintln(os.Stderr, fmt.Sprintf("%s The kustomized directory structure is valid", color.Success()))
+	return nil
+}
+
+func verifyCommand(ctx context.Context, args []string) error {
+	fs := newFlagSet("verify")
+	pf := addProjectFlags(fs)
+	source := fs.String("source", "", "The directory of repositories that were transformed.  Defaults to `BUILD_DIR/cloned/PROJECT`.")
+	ansibleDeployers := fs.String("ansible-deployers", "", "The `ansible-deployers` working copy.  Defaults to the one cloned into the build directory.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	p, err := pf.newProject()
+	if err != nil {
+		return err
+	}
+	p.SourceDir = *source
+	p.AnsibleDeployersDir = *ansibleDeployers
+	drifts, err := NewMigrator(p).verify(ctx, os.Stderr)
+	if err != nil {
+		return err
+	}
+	for _, drift := range drifts {
+		fmt.Printf("%s (%s): %s\n", drift.Repository, drift.Environment, drift.Dir)
+		if drift.Error != "" {
+			fmt.Printf("  %s\n", drift.Error)
 		}
-	} else {
-		p = &Project{
-			Name:      strings.ToLower(*project),
-			BuildDir:  *buildDir,
-			Filename:  *filename,
-			CloneOnly: *cloneOnly,
+		for _, object := range drift.Objects {
+			fmt.Printf("  %s %s\n", object.Status, object.Object)
+			for _, field := range object.Fields {
+				fmt.Printf("    %s\n", field)
+			}
 		}
 	}
+	if len(drifts) > 0 {
+		return fmt.Errorf("%d overlays are different from what `ansible-deployers` would have deployed", len(drifts))
+	}
+	fmt.Fprintln(os.Stderr, fmt.Sprintf("%s Every overlay is the same as what `ansible-deployers` would have deployed", color.Success()))
+	return nil
+}
 
-	startTime := time.Now()
+func reportCommand(ctx context.Context, args []string) error {
+	fs := newFlagSet("report")
+	reportFile := fs.String("report", "build/report.json", "The JSON report of the run")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	r, err := readReport(*reportFile)
+	if err != nil {
+		return err
+	}
+	dashboard := dashboardFile(*reportFile)
+	if err := writeDashboard(r, dashboard); err != nil {
+		return err
+	}
+	s := r.Summary
+	fmt.Printf("%-14s %d\n", "repositories", s.Repositories)
+	fmt.Printf("%-14s %d\n", "cloned", s.Cloned)
+	fmt.Printf("%-14s %d\n", "clone errors", s.CloneErrors)
+	fmt.Printf("%-14s %d\n", "retryable", s.Retryable)
+	fmt.Printf("%-14s %d\n", "kustomized", s.Kustomized)
+	fmt.Printf("%-14s %d\n", "no .kube", s.NoKube)
+	fmt.Printf("%-14s %d\n", "failed", s.Failed)
+	fmt.Printf("%-14s %d\n", "render errors", s.RenderErrors)
+	fmt.Printf("%-14s %d\n", "write errors", s.WriteErrors)
+	fmt.Printf("%-14s %d\n", "build errors", s.BuildErrors)
+	fmt.Printf("%-14s %d\n", "schema errors", s.SchemaErrors)
+	fmt.Printf("%-14s %d\n", "deprecations", s.Deprecations)
+	fmt.Printf("%-14s %d\n", "unresolved", s.Unresolved)
+	fmt.Printf("%-14s %d\n", "warnings", s.Warnings)
+	fmt.Fprintln(os.Stderr, fmt.Sprintf("%s Wrote %s", color.Info(), dashboard))
+	return nil
+}
+
+func diffCommand(ctx context.Context, args []string) error {
+	fs := newFlagSet("diff")
+	pf := addProjectFlags(fs)
+	against := fs.String("against", "", "The directory to compare the files with")
+	gitopsDir := fs.String("gitops-dir", "", "The gitops working copy to compare the objects that each overlay is built into with, see `gitops.path` in the project config")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	p, err := pf.newProject()
+	if err != nil {
+		return err
+	}
+	if (*against == "") == (*gitopsDir == "") {
+		return errors.New("Either `--against` or `--gitops-dir` is required")
+	}
 	m := NewMigrator(p)
-	m.migrate()
-	endTime := time.Now()
-	diff := endTime.Sub(startTime)
-	fmt.Println("total time taken ", diff.Seconds(), "seconds")
+	if *gitopsDir != "" {
+		return m.diffGitops(*gitopsDir)
+	}
+	diffs, err := diffTrees(*against, m.Dirs.Project)
+	if err != nil {
+		return err
+	}
+	for _, d := range diffs {
+		fmt.Printf("%s\t%s\n", d.Status, d.Path)
+	}
+	if len(diffs) > 0 {
+		return fmt.Errorf("%d files are different", len(diffs))
+	}
+	return nil
+}
+
+func (m *Migrator) diffGitops(gitopsDir string) error {
+	from, err := m.gitopsServices(gitopsDir)
+	if err != nil {
+		return err
+	}
+	to, err := listServices(m.Dirs.Project)
+	if err != nil {
+		return err
+	}
+	diffs, err := diffServices(from, to)
+	if err != nil {
+		return err
+	}
+	for _, d := range diffs {
+		changes := d.Changes()
+		counts := map[string]int{}
+		for _, change := range changes {
+			if change.Field != nil {
+				counts[change.Status] += 1
+			}
+		}
+		if d.Status != FileModified {
+			fmt.Printf("%s %s\n", d.Status, d.Service)
+			continue
+		}
+		fmt.Printf("%s %s (%d added, %d removed, %d changed fields)\n", d.Status, d.Service, counts[FileAdded], counts[FileRemoved], counts[FileModified])
+		for _, overlay := range sortedKeys(d.Errors) {
+			fmt.Printf("    %s: %s\n", overlay, d.Errors[overlay])
+		}
+		for _, change := range changes {
+			if change.Field == nil {
+				fmt.Printf("    %s %s [%s]\n", change.Status, change.Object, strings.Join(change.Overlays, ", "))
+			} else {
+				fmt.Printf("    %s: %s [%s]\n", change.Object, change.Field, strings.Join(change.Overlays, ", "))
+			}
+		}
+	}
+	if len(diffs) > 0 {
+		return fmt.Errorf("%d services are different", len(diffs))
+	}
+	fmt.Fprintln(os.Stderr, fmt.Sprintf("%s Every service is the same as in `%s`", color.Success(), gitopsDir))
+	return nil
+}
+
+func publishCommand(ctx context.Context, args []string) error {
+	fs := newFlagSet("publish")
+	pf := addProjectFlags(fs)
+	gitopsURL := fs.String("gitops-url", "", "The gitops repository to clone and commit to.  Defaults to the project config's `gitops.url`.")
+	gitopsDir := fs.String("gitops-dir", "", "Commit to this gitops working copy instead of cloning the repository")
+	push := fs.Bool("push", false, "Push the new branch to `origin`")
+	auth := fs.String("auth", "", "How to authenticate with the gitops repository: `auto`, `ssh-agent`, `ssh-key`, `https`, `netrc` or `none`.  Defaults to the project config's `gitops.auth` or `auto`.")
+	sshKey := fs.String("ssh-key", "", "The SSH private key to clone and push with.  The passphrase, if any, is read from `SSH_KEY_PASSPHRASE`.")
+	knownHosts := fs.String("known-hosts", "", "Check the host keys against `~/.ssh/known_hosts` (`strict`), a known_hosts file or not at all (`ignore`)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	p, err := pf.newProject()
+	if err != nil {
+		return err
+	}
+	if *gitopsURL != "" && *gitopsDir != "" {
+		return errors.New("Only one of `--gitops-url` and `--gitops-dir` can be given")
+	}
+	p.GitopsURL = *gitopsURL
+	p.GitopsDir = *gitopsDir
+	p.Push = *push
+	p.Auth = &AuthConfig{
+		Method:     *auth,
+		SSHKey:     *sshKey,
+		KnownHosts: *knownHosts,
+	}
+	if p.Auth.Method == "" && p.Auth.SSHKey != "" {
+		p.Auth.Method = AuthSSHKey
+	}
+	publication, err := NewMigrator(p).publish(ctx)
+	if err != nil {
+		return err
+	}
+	if len(publication.Services) == 0 {
+		fmt.Fprintln(os.Stderr, fmt.Sprintf("%s Every service is the same as in the gitops repository, so there's nothing to commit", color.Info()))
+		return nil
+	}
+	for _, service := range publication.Services {
+		fmt.Println(service)
+	}
+	fmt.Fprintln(os.Stderr, fmt.Sprintf("%s Committed %d services (%s) to the %s branch in `%s`", color.Success(), len(publication.Services), publication.Commit[:7], color.Branch(publication.Branch), publication.Dir))
+	if publication.Pushed {
+		fmt.Fprintln(os.Stderr, fmt.Sprintf("%s Pushed the %s branch", color.Success(), color.Branch(publication.Branch)))
+	}
+	return nil
+}
+
+func pruneCommand(ctx context.Context, args []string) error {
+	fs := newFlagSet("prune")
+	cacheDir := fs.String("cache-dir", "", "The cache of repositories (required)")
+	olderThan := fs.Duration("older-than", 30*24*time.Hour, "Delete the repositories that haven't been used for this long")
+	dryRun := fs.Bool("dry-run", false, "Only print what would be deleted")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *cacheDir == "" {
+		return errors.New("`--cache-dir` is required")
+	}
+	pruned, err := pruneCache(*cacheDir, time.Now().Add(-*olderThan), *dryRun)
+	for _, path := range pruned {
+		fmt.Println(path)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(os.Stderr, fmt.Sprintf("%s Pruned %d repositories from the cache", color.Info(), len(pruned)))
+	return nil
 }
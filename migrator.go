@@ -2,18 +2,20 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"html/template"
+	"io"
 	"log"
 	"os"
+	"strings"
+	"time"
+
+	"github.com/btoll/migrator/color"
 )
 
 type RepositoryNames []string
 
-// Find intersection:
-// join <(sort errors/1) <(sort errors/2)
-// comm -12 <(sort errors/1) <(sort errors/2)
-
 // TODO
 // - clean up all the fmt.Sprintf file interpolations.
 
@@ -39,7 +41,7 @@ type EnvironmentVariable struct {
 type Service struct {
 	Name              string
 	NameNoHyphens     string
-	Environment       string
+	Environment       *Environment
 	Image             *Image
 	Replicas          int
 	Resources         *Resources
@@ -62,98 +64,189 @@ type Resources struct {
 }
 
 type BuildDirs struct {
-	Build                    string
-	Project                  string
-	Cloned                   string
+	Build   string
+	Project string
+	Cloned  string
+	// The repositories to transform, usually `build/cloned/PROJECT`.
+	Sources string
+	// Where each service is written before it's moved into `Project`.
+	Staging                  string
 	AnsibleDeployers         string
 	AnsibleDeployerOverrides string
 }
 
-type Debug struct {
-	Files map[string]ServiceNames
-}
-
-type ServiceNames []string
-
 type Migrator struct {
-	Project      *Project
-	Environments []string
-	ReposFile    string
-	TplExt       string
-	Template     *template.Template
-	Dirs         *BuildDirs
-	Debug        *Debug
-}
-
-type Login struct {
-	Username string
-	Password string
+	Project *Project
+	Config  *Config
+	Auth    *CloneAuth
+	Retry   *RetryPolicy
+	// The refs to clone, see `refs.go`.
+	Refs           []*CloneRef
+	RepositoryRefs map[string][]*CloneRef
+	Environments   []*Environment
+	ReposFile      string
+	Template       *template.Template
+	// The schemas of the target Kubernetes version.
+	Schema *KubernetesSchema
+	Dirs   *BuildDirs
+	// Only there if `ansible-deployers` couldn't be cloned.
+	AnsibleDeployersClone *CloneResult
+	Clones                []*CloneResult
+	Results               []*ServiceResult
 }
 
 type Project struct {
-	Name            string
-	Filename        string
-	BuildDir        string
-	UseLogin        bool
-	CloneOnly       bool
-	Login           *Login
+	Name      string
+	Filename  string
+	BuildDir  string
+	UseLogin  bool
+	CloneOnly bool
+	// Transform the repositories in this directory instead of the ones that were cloned.
+	SourceDir string
+	// Don't delete the repositories once they're transformed.
+	KeepSources bool
+	// Use this `ansible-deployers` working copy instead of cloning it into the build directory.
+	AnsibleDeployersDir string
+	// Defaults to `build/report.json`.
+	ReportFile string
+	// The project config, see `config.go`.
+	ConfigFile string
+	// The YAML file that declares the environments (overlays).  The defaults are
+	// `production`, `beta` and `development`.
+	EnvironmentsFile string
+	Jobs             int
+	Provider         SourceProvider
+	ProviderName     string
+	// These take precedence over the provider's `auth` in the project config.
+	Auth *AuthConfig
+	// Clone everything instead of only the latest commit of the `kube_dir`.
+	FullClone bool
+	// Clone from the cache, which is updated first unless it's offline.
+	CacheDir string
+	Offline  bool
+	// These take precedence over the `retry` in the project config.
+	Retry *RetryPolicy
+	// These take precedence over the `refs` in the project config (but not over
+	// the `repository_refs`).
+	Refs []string
+	// This takes precedence over the `kubernetes_version` in the project config.
+	KubernetesVersion string
+	// The gitops repository to publish to (or a working copy of it), and whether
+	// to push the branch.  The URL takes precedence over `gitops.url`.
+	GitopsURL       string
+	GitopsDir       string
+	Push            bool
 	RepositoryNames *RepositoryNames
 }
 
 func NewMigrator(project *Project) *Migrator {
-	tpl, err := template.ParseGlob("tpl/*")
+	config, err := loadConfig(project.ConfigFile, project.Name)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Could not read the project config")
+		log.Fatalln(err)
+	}
+	tpl, err := template.ParseGlob(fmt.Sprintf("%s/*", config.Templates))
 	if err != nil {
-		fmt.Println("err", err)
 		fmt.Fprintln(os.Stderr, "Could not parse template globs")
 		log.Fatalln(err)
 	}
+	environments := config.Environments
+	if project.EnvironmentsFile != "" {
+		environments, err = loadEnvironments(project.EnvironmentsFile, config.ValuesFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Could not read the environments file")
+			log.Fatalln(err)
+		}
+	} else if len(environments) == 0 {
+		environments = defaultEnvironments(config.ValuesFile)
+	}
+	authConfig := project.Auth
+	if authConfig == nil {
+		authConfig = &AuthConfig{}
+	}
+	auth, err := NewCloneAuth(project.ProviderName, authConfig.merge(config.Auth[project.ProviderName]))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Could not configure the credentials for cloning")
+		log.Fatalln(err)
+	}
+	retry := config.Retry
+	if project.Retry != nil {
+		retry = project.Retry.merge(config.Retry)
+	}
+	if project.CacheDir == "" {
+		project.CacheDir = config.CacheDir
+	}
+	if project.Offline && project.CacheDir == "" {
+		log.Fatalln("Can't clone offline without a cache (`--cache-dir`)")
+	}
+	if len(project.Refs) > 0 {
+		config.Refs = project.Refs
+	}
+	refs, err := parseRefs(config.Refs)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Could not read the refs to clone")
+		log.Fatalln(err)
+	}
+	repositoryRefs := map[string][]*CloneRef{}
+	for repository, r := range config.RepositoryRefs {
+		// These were checked when the config was read.
+		repositoryRefs[repository], _ = parseRefs(r)
+	}
+	if project.KubernetesVersion != "" {
+		config.KubernetesVersion = project.KubernetesVersion
+	}
+	schema, err := loadKubernetesSchema(config.KubernetesVersion)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Could not read the Kubernetes schemas")
+		log.Fatalln(err)
+	}
+	ansibleDeployers := project.AnsibleDeployersDir
+	if ansibleDeployers == "" {
+		ansibleDeployers = fmt.Sprintf("%s/%s", project.BuildDir, config.AnsibleDeployers)
+	}
+	cloned := fmt.Sprintf("%s/cloned", project.BuildDir)
+	sources := project.SourceDir
+	if sources == "" {
+		sources = fmt.Sprintf("%s/%s", cloned, project.Name)
+	}
 	return &Migrator{
-		Project:      project,
-		Environments: []string{"production", "beta", "development"},
-		TplExt:       ".j2",
-		Template:     tpl,
-		Debug: &Debug{
-			Files: map[string]ServiceNames{
-				"error":          ServiceNames{},
-				"master":         ServiceNames{},
-				"development":    ServiceNames{},
-				"noKube":         ServiceNames{},
-				"noMatchedToken": ServiceNames{},
-			},
-		},
+		Project:        project,
+		Config:         config,
+		Auth:           auth,
+		Retry:          retry,
+		Refs:           refs,
+		RepositoryRefs: repositoryRefs,
+		Environments:   environments,
+		Template:       tpl,
+		Schema:         schema,
 		Dirs: &BuildDirs{
 			Build:                    project.BuildDir,
 			Project:                  fmt.Sprintf("%s/%s", project.BuildDir, project.Name),
-			Cloned:                   fmt.Sprintf("%s/cloned", project.BuildDir),
-			AnsibleDeployers:         fmt.Sprintf("%s/ansible-deployers", project.BuildDir),
-			AnsibleDeployerOverrides: fmt.Sprintf("%s/ansible-deployers/files/kubernetes_environment_overrides", project.BuildDir),
+			Cloned:                   cloned,
+			Sources:                  sources,
+			Staging:                  fmt.Sprintf("%s/.staging", project.BuildDir),
+			AnsibleDeployers:         ansibleDeployers,
+			AnsibleDeployerOverrides: fmt.Sprintf("%s/%s", ansibleDeployers, config.Overrides),
 		},
 	}
 }
 
-// This creates a file in `build/` for each of the keys in `m.Debug.Files`
-// and is useful to know which service fell into which category.
-func (m *Migrator) debug() {
-	for filename, v := range m.Debug.Files {
-		f, err := os.Create(fmt.Sprintf("%s/%s", m.Dirs.Build, filename))
-		if err != nil {
-			fmt.Println(err)
-		}
-		defer f.Close()
-		buf := bufio.NewWriter(f)
-		for _, name := range v {
-			_, err := buf.WriteString(fmt.Sprintf("%s\n", name))
-			if err != nil {
-				fmt.Println(err)
-			}
-		}
-		if err := buf.Flush(); err != nil {
-			fmt.Println(err)
-		}
+// Clone everything and then kustomize it (unless it's only cloning).  If it's
+// interrupted, whatever was done is still in the report.
+func (m *Migrator) migrate(ctx context.Context) error {
+	startedAt := time.Now()
+	err := m.cloneRepositories(ctx)
+	if err == nil && !m.Project.CloneOnly && ctx.Err() == nil {
+		err = m.kustomize(ctx)
+	}
+	m.writeReport(ctx, startedAt)
+	if err != nil {
+		return err
 	}
+	return ctx.Err()
 }
 
-func (m *Migrator) migrate() {
+func (m *Migrator) cloneRepositories(ctx context.Context) error {
 	// Create "build/aion".
 	err := os.MkdirAll(m.Dirs.Project, os.ModePerm)
 	if err != nil {
@@ -167,6 +260,7 @@ func (m *Migrator) migrate() {
 		log.Fatal(err)
 	}
 
+	var repositoryNames RepositoryNames
 	if !m.Project.UseLogin {
 		// Contents will never be large enough to need to chunk or buffer.
 		readfile, err := os.Open(m.Project.Filename)
@@ -178,38 +272,71 @@ func (m *Migrator) migrate() {
 
 		filescanner := bufio.NewScanner(readfile)
 		for filescanner.Scan() {
-			m.clone(filescanner.Text())
+			if name := strings.TrimSpace(filescanner.Text()); name != "" {
+				repositoryNames = append(repositoryNames, name)
+			}
 		}
 	} else {
-		for _, repositoryName := range *m.Project.RepositoryNames {
-			m.clone(repositoryName)
-		}
+		repositoryNames = *m.Project.RepositoryNames
 	}
 
-	if !m.Project.CloneOnly {
-		m.kustomize()
-		m.debug()
+	if err := m.cloneAnsibleDeployers(ctx); err != nil {
+		return err
 	}
+	m.cloneAll(ctx, repositoryNames)
+	return nil
 }
 
-func (m *Migrator) scaffold(appDir string) {
-	err := os.Mkdir(appDir, os.ModePerm)
+func (m *Migrator) reportFile() string {
+	if m.Project.ReportFile != "" {
+		return m.Project.ReportFile
+	}
+	return fmt.Sprintf("%s/report.json", m.Dirs.Build)
+}
+
+func (m *Migrator) writeReport(ctx context.Context, startedAt time.Time) {
+	reportFile := m.reportFile()
+	report := m.report(startedAt)
+	report.Interrupted = ctx.Err() != nil
+	err := report.write(reportFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, fmt.Sprintf("%s Could not write the report `%s`: %s", color.Error(), reportFile, err))
+	}
+	dashboardFile := dashboardFile(reportFile)
+	err = writeDashboard(report, dashboardFile)
 	if err != nil {
-		fmt.Println(err)
-		fmt.Fprintln(os.Stderr, "Could not create build service directory")
-		//		log.Fatal(err)
+		fmt.Fprintln(os.Stderr, fmt.Sprintf("%s Could not write the dashboard `%s`: %s", color.Error(), dashboardFile, err))
 	}
-	// Now, create directory structure for Kustomize.
-	err = os.MkdirAll(fmt.Sprintf("%s/base", appDir), os.ModePerm)
+}
+
+// Clone the repositories using a pool of `m.Project.Jobs` workers.  The output of
+// each clone is printed in the same order as the repository names, regardless of
+// when the clones finish.
+func (m *Migrator) cloneAll(ctx context.Context, repositoryNames RepositoryNames) {
+	clones := make([]*CloneResult, len(repositoryNames))
+	runOrdered(ctx, len(repositoryNames), m.Project.Jobs, os.Stderr, func(i int, w io.Writer) {
+		clones[i] = m.clone(ctx, repositoryNames[i], w)
+	})
+	// The ones that weren't started because it was interrupted aren't reported.
+	m.Clones = nil
+	for _, clone := range clones {
+		if clone != nil {
+			m.Clones = append(m.Clones, clone)
+		}
+	}
+}
+
+// Create the directory structure for Kustomize.
+func (m *Migrator) scaffold(appDir string) error {
+	err := os.MkdirAll(fmt.Sprintf("%s/base", appDir), os.ModePerm)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "Could not create build service directory")
-		//		log.Fatal(err)
+		return err
 	}
 	for _, env := range m.Environments {
-		err = os.MkdirAll(fmt.Sprintf("%s/overlays/%s", appDir, env), os.ModePerm)
+		err = os.MkdirAll(fmt.Sprintf("%s/overlays/%s", appDir, env.Name), os.ModePerm)
 		if err != nil {
-			fmt.Fprintln(os.Stderr, "Could not create environment directory in Kustomize overlays directory")
-			//			log.Fatal(err)
+			return err
 		}
 	}
+	return nil
 }
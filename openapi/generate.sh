@@ -0,0 +1,31 @@
+#!/bin/bash
+# Trim the OpenAPI (swagger) spec of a Kubernetes release down to the kinds that
+# are validated (and everything that they reference), without the descriptions,
+# and write it here as `kubernetes-MAJOR.MINOR.json.gz`, e.g.:
+#
+#	./openapi/generate.sh 1.29 ~/src/kubernetes/api/openapi-spec/swagger.json
+#
+# The spec of every release is in the `kubernetes` repository, or in the
+# `k8s.io/kubernetes` module, e.g. `https://proxy.golang.org/k8s.io/kubernetes/@v/v1.29.0.zip`.
+set -eo pipefail
+
+if [ $# -ne 2 ]; then
+    echo "Usage: $0 VERSION SWAGGER_JSON" >&2
+    exit 1
+fi
+
+jq -c '
+  .definitions as $defs
+  | [$defs | to_entries[]
+      | select(.value["x-kubernetes-group-version-kind"] // [] | any(.kind == ("Deployment", "Service", "Ingress")))
+      | .key] as $roots
+  | {keep: $roots, next: $roots}
+  | until(.next == [];
+      . as $state
+      | ([.next[] as $name | $defs[$name] | .. | objects | .["$ref"]? // empty | sub("^#/definitions/"; "")] | unique - $state.keep) as $refs
+      | .keep += $refs
+      | .next = $refs)
+  | .keep as $keep
+  | {definitions: ($defs | with_entries(select(.key as $name | $keep | index($name))))}
+  | walk(if type == "object" then del(.description) else . end)
+' "$2" | gzip -9n > "$(dirname "$0")/kubernetes-$1.json.gz"
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// A repository as described by the source provider.
+type SourceRepository struct {
+	Name          string
+	CloneURL      string
+	DefaultBranch string
+	// The Bitbucket project key.
+	Project   string
+	Language  string
+	UpdatedOn time.Time
+	Archived  bool
+}
+
+// Archived repositories are skipped unless asked for.
+const (
+	ArchivedExclude = "exclude"
+	ArchivedInclude = "include"
+	ArchivedOnly    = "only"
+)
+
+// Narrows down the repositories that are listed for a project.  The zero value
+// matches everything that isn't archived.
+type RepositoryFilter struct {
+	// Match on the Bitbucket project key rather than the project name.
+	ProjectKey   string
+	Name         *regexp.Regexp
+	Language     string
+	UpdatedSince time.Time
+	// One of `exclude`, `include` or `only`.
+	Archived string
+}
+
+func (f *RepositoryFilter) Match(r *SourceRepository) bool {
+	if f == nil {
+		return !r.Archived
+	}
+	if f.ProjectKey != "" && r.Project != "" && !strings.EqualFold(f.ProjectKey, r.Project) {
+		return false
+	}
+	if f.Name != nil && !f.Name.MatchString(r.Name) {
+		return false
+	}
+	if f.Language != "" && !strings.EqualFold(f.Language, r.Language) {
+		return false
+	}
+	if !f.UpdatedSince.IsZero() && r.UpdatedOn.Before(f.UpdatedSince) {
+		return false
+	}
+	switch f.Archived {
+	case ArchivedInclude:
+		return true
+	case ArchivedOnly:
+		return r.Archived
+	}
+	return !r.Archived
+}
+
+// A SourceProvider is where the application repositories live.  The `project`
+// is the Bitbucket project name or, for the providers that don't have such a
+// thing, a topic that the repositories have been tagged with.  The owner
+// (Bitbucket workspace, GitHub or Gitea organization, GitLab group) is given
+// when the provider is created.
+type SourceProvider interface {
+	ListRepositories(project string) ([]*SourceRepository, error)
+	CloneURL(repository string) string
+	DefaultBranch(repository string) (string, error)
+}
+
+type ProviderOptions struct {
+	// One of `bitbucket`, `github`, `gitlab`, `gitea` or `local`.
+	Name  string
+	Owner string
+	// The base URL of the REST API, e.g. `https://api.github.com`.  This only
+	// needs to be set for self-hosted instances.
+	APIURL string
+	// The base of the URL that each repository is cloned from, e.g.
+	// `git@bitbucket.org:pecteam`.  Defaults to SSH on the provider's host.  For
+	// the local provider, this is the directory of repositories.
+	CloneURL string
+	Filter   *RepositoryFilter
+	// How the API requests are retried, see `retry.go`.
+	Retry *RetryPolicy
+}
+
+// The credentials are read from the environment:
+//
+//	bitbucket  BITBUCKET_USERNAME and BITBUCKET_PASSWORD (an app password)
+//	github     GITHUB_TOKEN
+//	gitlab     GITLAB_TOKEN
+//	gitea      GITEA_TOKEN
+//	local      (none)
+func NewSourceProvider(opts *ProviderOptions) (SourceProvider, error) {
+	switch opts.Name {
+	case "", "bitbucket":
+		return NewBitbucketProvider(opts, os.Getenv("BITBUCKET_USERNAME"), os.Getenv("BITBUCKET_PASSWORD"))
+	case "github":
+		return NewGitHubProvider(opts, os.Getenv("GITHUB_TOKEN"))
+	case "gitlab":
+		return NewGitLabProvider(opts, os.Getenv("GITLAB_TOKEN"))
+	case "gitea":
+		return NewGiteaProvider(opts, os.Getenv("GITEA_TOKEN"))
+	case "local":
+		return NewLocalProvider(opts)
+	}
+	return nil, fmt.Errorf("Unknown provider `%s`", opts.Name)
+}
+
+// Build the SSH clone URL for a repository, e.g. `git@github.com:btoll/migrator.git`.
+func sshCloneURL(base, host, owner, repository string) string {
+	if base == "" {
+		base = fmt.Sprintf("git@%s:%s", host, owner)
+	}
+	return fmt.Sprintf("%s/%s.git", strings.TrimSuffix(base, "/"), repository)
+}
+
+// Get the host name that the repositories are served from.  For self-hosted
+// instances, this is the host of the API URL.
+func gitHost(apiURL, defaultAPIURL, defaultHost string) string {
+	if apiURL == "" || apiURL == defaultAPIURL {
+		return defaultHost
+	}
+	u, err := url.Parse(apiURL)
+	if err != nil || u.Hostname() == "" {
+		return defaultHost
+	}
+	return u.Hostname()
+}
+
+var reLinkNext = regexp.MustCompile(`<([^>]+)>;\s*rel="next"`)
+
+// Make a GET request to a JSON API and decode the response into `v`.  The link
+// to the next page is returned if there is one (see RFC 8288).
+func getJSON(client *http.Client, rawURL string, header http.Header, v interface{}) (string, error) {
+	req, err := http.NewRequest(http.MethodGet, rawURL, nil)
+	if err != nil {
+		return "", err
+	}
+	for k, values := range header {
+		for _, value := range values {
+			req.Header.Add(k, value)
+		}
+	}
+	req.Header.Set("Accept", "application/json")
+
+	res, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+		return "", &HTTPError{URL: rawURL, StatusCode: res.StatusCode, Body: strings.TrimSpace(string(body))}
+	}
+	if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+		return "", fmt.Errorf("Could not decode the response from `%s`: %w", rawURL, err)
+	}
+
+	var next string
+	if matches := reLinkNext.FindStringSubmatch(res.Header.Get("Link")); matches != nil {
+		next = matches[1]
+	}
+	return next, nil
+}
+
+type HTTPError struct {
+	URL        string
+	StatusCode int
+	Body       string
+	// How long the server said to wait (`Retry-After`) before trying again.
+	RetryAfter time.Duration
+}
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("GET %s: %d %s %s", e.URL, e.StatusCode, http.StatusText(e.StatusCode), e.Body)
+}
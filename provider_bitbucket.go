@@ -0,0 +1,161 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	bitbucketAPIURL   = "https://api.bitbucket.org/2.0"
+	bitbucketOwner    = "pecteam"
+	bitbucketPageSize = 100
+)
+
+type BitbucketProvider struct {
+	// The workspace.
+	Owner        string
+	APIURL       string
+	Filter       *RepositoryFilter
+	baseCloneURL string
+	client       *http.Client
+	header       http.Header
+	hasLogin     bool
+	host         string
+}
+
+type bitbucketRepository struct {
+	Slug      string    `json:"slug"`
+	Language  string    `json:"language"`
+	UpdatedOn time.Time `json:"updated_on"`
+	// This is only reported by some Bitbucket versions.
+	Archived bool `json:"archived"`
+	Project  struct {
+		Key  string `json:"key"`
+		Name string `json:"name"`
+	} `json:"project"`
+	Mainbranch struct {
+		Name string `json:"name"`
+	} `json:"mainbranch"`
+}
+
+type bitbucketPage struct {
+	Values []bitbucketRepository `json:"values"`
+	Next   string                `json:"next"`
+}
+
+func NewBitbucketProvider(opts *ProviderOptions, username, password string) (*BitbucketProvider, error) {
+	owner := opts.Owner
+	if owner == "" {
+		owner = bitbucketOwner
+	}
+	apiURL := opts.APIURL
+	if apiURL == "" {
+		apiURL = bitbucketAPIURL
+	}
+	if _, err := url.Parse(apiURL); err != nil {
+		return nil, fmt.Errorf("Invalid Bitbucket API URL `%s`: %w", apiURL, err)
+	}
+	req := &http.Request{Header: http.Header{}}
+	req.SetBasicAuth(username, password)
+	return &BitbucketProvider{
+		Owner:        owner,
+		APIURL:       strings.TrimSuffix(apiURL, "/"),
+		Filter:       opts.Filter,
+		baseCloneURL: opts.CloneURL,
+		client:       newHTTPClient(opts.Retry, os.Stderr),
+		header:       req.Header,
+		hasLogin:     username != "" && password != "",
+		host:         gitHost(opts.APIURL, bitbucketAPIURL, "bitbucket.org"),
+	}, nil
+}
+
+func (b *BitbucketProvider) login() error {
+	if !b.hasLogin {
+		return errors.New("Both username (BITBUCKET_USERNAME) and password (BITBUCKET_PASSWORD) must be set.")
+	}
+	return nil
+}
+
+// Build the query that filters the repositories on the server, so only the ones
+// we care about are paged through.  The name and archived filters are applied
+// after.
+// See https://developer.atlassian.com/cloud/bitbucket/rest/intro/#filtering.
+func (b *BitbucketProvider) query(project string) string {
+	var q []string
+	if b.Filter != nil && b.Filter.ProjectKey != "" {
+		q = append(q, fmt.Sprintf(`project.key="%s"`, bitbucketQuote(b.Filter.ProjectKey)))
+	} else {
+		q = append(q, fmt.Sprintf(`project.name="%s"`, bitbucketQuote(project)))
+	}
+	if b.Filter != nil {
+		if b.Filter.Language != "" {
+			q = append(q, fmt.Sprintf(`language="%s"`, bitbucketQuote(strings.ToLower(b.Filter.Language))))
+		}
+		if !b.Filter.UpdatedSince.IsZero() {
+			q = append(q, fmt.Sprintf(`updated_on>=%s`, b.Filter.UpdatedSince.UTC().Format(time.RFC3339)))
+		}
+	}
+	return strings.Join(q, " AND ")
+}
+
+// Escape a value that goes between the quotes of a query clause, or a project
+// name with a `"` in it would end the string early.
+func bitbucketQuote(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s)
+}
+
+func (b *BitbucketProvider) ListRepositories(project string) ([]*SourceRepository, error) {
+	if err := b.login(); err != nil {
+		return nil, err
+	}
+	q := url.Values{}
+	q.Set("pagelen", fmt.Sprint(bitbucketPageSize))
+	q.Set("q", b.query(project))
+	q.Set("sort", "slug")
+	next := fmt.Sprintf("%s/repositories/%s?%s", b.APIURL, url.PathEscape(b.Owner), q.Encode())
+
+	repositories := []*SourceRepository{}
+	for next != "" {
+		var page bitbucketPage
+		if _, err := getJSON(b.client, next, b.header, &page); err != nil {
+			return nil, err
+		}
+		for _, item := range page.Values {
+			repository := &SourceRepository{
+				Name:          item.Slug,
+				CloneURL:      b.CloneURL(item.Slug),
+				DefaultBranch: item.Mainbranch.Name,
+				Project:       item.Project.Key,
+				Language:      item.Language,
+				UpdatedOn:     item.UpdatedOn,
+				Archived:      item.Archived,
+			}
+			if b.Filter.Match(repository) {
+				repositories = append(repositories, repository)
+			}
+		}
+		next = page.Next
+	}
+	return repositories, nil
+}
+
+func (b *BitbucketProvider) CloneURL(repository string) string {
+	return sshCloneURL(b.baseCloneURL, b.host, b.Owner, repository)
+}
+
+func (b *BitbucketProvider) DefaultBranch(repository string) (string, error) {
+	if err := b.login(); err != nil {
+		return "", err
+	}
+	var repo bitbucketRepository
+	_, err := getJSON(b.client, fmt.Sprintf("%s/repositories/%s/%s", b.APIURL, url.PathEscape(b.Owner), url.PathEscape(repository)), b.header, &repo)
+	if err != nil {
+		return "", err
+	}
+	return repo.Mainbranch.Name, nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const giteaPageSize = 50
+
+type GiteaProvider struct {
+	// The organization or user.
+	Owner        string
+	APIURL       string
+	Filter       *RepositoryFilter
+	baseCloneURL string
+	client       *http.Client
+	header       http.Header
+	host         string
+}
+
+type giteaRepository struct {
+	Name          string    `json:"name"`
+	DefaultBranch string    `json:"default_branch"`
+	Language      string    `json:"language"`
+	UpdatedAt     time.Time `json:"updated_at"`
+	Archived      bool      `json:"archived"`
+	Owner         struct {
+		Login string `json:"login"`
+	} `json:"owner"`
+}
+
+type giteaSearchResults struct {
+	OK   bool              `json:"ok"`
+	Data []giteaRepository `json:"data"`
+}
+
+// Gitea is always self-hosted, so the API URL is required, e.g.
+// `https://gitea.example.com/api/v1`.
+func NewGiteaProvider(opts *ProviderOptions, token string) (*GiteaProvider, error) {
+	if opts.APIURL == "" {
+		return nil, errors.New("The Gitea provider needs the API URL")
+	}
+	if opts.Owner == "" {
+		return nil, errors.New("The Gitea provider needs an owner (organization or user)")
+	}
+	header := http.Header{}
+	if token != "" {
+		header.Set("Authorization", fmt.Sprintf("token %s", token))
+	}
+	return &GiteaProvider{
+		Owner:        opts.Owner,
+		APIURL:       strings.TrimSuffix(opts.APIURL, "/"),
+		Filter:       opts.Filter,
+		baseCloneURL: opts.CloneURL,
+		client:       newHTTPClient(opts.Retry, os.Stderr),
+		header:       header,
+		host:         gitHost(opts.APIURL, "", ""),
+	}, nil
+}
+
+// List the owner's repositories that have the project as a topic.
+func (g *GiteaProvider) ListRepositories(project string) ([]*SourceRepository, error) {
+	repositories := []*SourceRepository{}
+	for page := 1; ; page++ {
+		q := url.Values{}
+		q.Set("q", strings.ToLower(project))
+		q.Set("topic", "true")
+		q.Set("limit", fmt.Sprint(giteaPageSize))
+		q.Set("page", fmt.Sprint(page))
+		var results giteaSearchResults
+		_, err := getJSON(g.client, fmt.Sprintf("%s/repos/search?%s", g.APIURL, q.Encode()), g.header, &results)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range results.Data {
+			repository := &SourceRepository{
+				Name:          item.Name,
+				CloneURL:      g.CloneURL(item.Name),
+				DefaultBranch: item.DefaultBranch,
+				Language:      item.Language,
+				UpdatedOn:     item.UpdatedAt,
+				Archived:      item.Archived,
+			}
+			if strings.EqualFold(item.Owner.Login, g.Owner) && g.Filter.Match(repository) {
+				repositories = append(repositories, repository)
+			}
+		}
+		// The server may have a smaller maximum page size than was asked for, so
+		// a short page isn't necessarily the last one.
+		if len(results.Data) == 0 {
+			break
+		}
+	}
+	return repositories, nil
+}
+
+func (g *GiteaProvider) CloneURL(repository string) string {
+	return sshCloneURL(g.baseCloneURL, g.host, g.Owner, repository)
+}
+
+func (g *GiteaProvider) DefaultBranch(repository string) (string, error) {
+	var repo giteaRepository
+	_, err := getJSON(g.client, fmt.Sprintf("%s/repos/%s/%s", g.APIURL, g.Owner, repository), g.header, &repo)
+	if err != nil {
+		return "", err
+	}
+	return repo.DefaultBranch, nil
+}
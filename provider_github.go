@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+const githubAPIURL = "https://api.github.com"
+
+type GitHubProvider struct {
+	Owner        string
+	APIURL       string
+	Filter       *RepositoryFilter
+	baseCloneURL string
+	client       *http.Client
+	header       http.Header
+	host         string
+}
+
+type githubRepository struct {
+	Name          string    `json:"name"`
+	DefaultBranch string    `json:"default_branch"`
+	Topics        []string  `json:"topics"`
+	Language      string    `json:"language"`
+	PushedAt      time.Time `json:"pushed_at"`
+	Archived      bool      `json:"archived"`
+}
+
+func NewGitHubProvider(opts *ProviderOptions, token string) (*GitHubProvider, error) {
+	if opts.Owner == "" {
+		return nil, errors.New("The GitHub provider needs an owner (organization or user)")
+	}
+	apiURL := opts.APIURL
+	if apiURL == "" {
+		apiURL = githubAPIURL
+	}
+	header := http.Header{}
+	header.Set("Accept", "application/vnd.github+json")
+	header.Set("X-GitHub-Api-Version", "2022-11-28")
+	if token != "" {
+		header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	}
+	return &GitHubProvider{
+		Owner:        opts.Owner,
+		APIURL:       strings.TrimSuffix(apiURL, "/"),
+		Filter:       opts.Filter,
+		baseCloneURL: opts.CloneURL,
+		client:       newHTTPClient(opts.Retry, os.Stderr),
+		header:       header,
+		host:         gitHost(opts.APIURL, githubAPIURL, "github.com"),
+	}, nil
+}
+
+// List the repositories in the organization (or user account) that are tagged
+// with the project as a topic.  GitHub topics are always lowercase.
+func (g *GitHubProvider) ListRepositories(project string) ([]*SourceRepository, error) {
+	next := fmt.Sprintf("%s/orgs/%s/repos?per_page=100", g.APIURL, g.Owner)
+	var httpErr *HTTPError
+	repositories := []*SourceRepository{}
+	for next != "" {
+		var page []githubRepository
+		link, err := getJSON(g.client, next, g.header, &page)
+		// The owner may be a user rather than an organization.
+		if errors.As(err, &httpErr) && httpErr.StatusCode == http.StatusNotFound && len(repositories) == 0 && strings.Contains(next, "/orgs/") {
+			next = fmt.Sprintf("%s/users/%s/repos?per_page=100", g.APIURL, g.Owner)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range page {
+			repository := &SourceRepository{
+				Name:          item.Name,
+				CloneURL:      g.CloneURL(item.Name),
+				DefaultBranch: item.DefaultBranch,
+				Language:      item.Language,
+				UpdatedOn:     item.PushedAt,
+				Archived:      item.Archived,
+			}
+			if slices.Contains(item.Topics, strings.ToLower(project)) && g.Filter.Match(repository) {
+				repositories = append(repositories, repository)
+			}
+		}
+		next = link
+	}
+	return repositories, nil
+}
+
+func (g *GitHubProvider) CloneURL(repository string) string {
+	return sshCloneURL(g.baseCloneURL, g.host, g.Owner, repository)
+}
+
+func (g *GitHubProvider) DefaultBranch(repository string) (string, error) {
+	var repo githubRepository
+	_, err := getJSON(g.client, fmt.Sprintf("%s/repos/%s/%s", g.APIURL, g.Owner, repository), g.header, &repo)
+	if err != nil {
+		return "", err
+	}
+	return repo.DefaultBranch, nil
+}
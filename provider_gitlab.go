@@ -0,0 +1,194 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const gitlabAPIURL = "https://gitlab.com/api/v4"
+
+type GitLabProvider struct {
+	// The group, which may be a subgroup, e.g. `pecteam/aion`.
+	Owner        string
+	APIURL       string
+	Filter       *RepositoryFilter
+	baseCloneURL string
+	client       *http.Client
+	header       http.Header
+	host         string
+
+	// Projects in subgroups aren't directly under the owner, so remember the
+	// full path of everything that's been listed.
+	mu    sync.Mutex
+	paths map[string]string
+}
+
+type gitlabProject struct {
+	Path              string    `json:"path"`
+	PathWithNamespace string    `json:"path_with_namespace"`
+	DefaultBranch     string    `json:"default_branch"`
+	LastActivityAt    time.Time `json:"last_activity_at"`
+	Archived          bool      `json:"archived"`
+}
+
+func NewGitLabProvider(opts *ProviderOptions, token string) (*GitLabProvider, error) {
+	if opts.Owner == "" {
+		return nil, errors.New("The GitLab provider needs an owner (group)")
+	}
+	apiURL := opts.APIURL
+	if apiURL == "" {
+		apiURL = gitlabAPIURL
+	}
+	header := http.Header{}
+	if token != "" {
+		header.Set("PRIVATE-TOKEN", token)
+	}
+	return &GitLabProvider{
+		Owner:        strings.Trim(opts.Owner, "/"),
+		APIURL:       strings.TrimSuffix(apiURL, "/"),
+		Filter:       opts.Filter,
+		baseCloneURL: opts.CloneURL,
+		client:       newHTTPClient(opts.Retry, os.Stderr),
+		header:       header,
+		host:         gitHost(opts.APIURL, gitlabAPIURL, "gitlab.com"),
+		paths:        map[string]string{},
+	}, nil
+}
+
+// List the projects in the group and its subgroups that have the project as a
+// topic.  GitLab doesn't report the language in the listing, so that filter is
+// ignored.
+func (g *GitLabProvider) ListRepositories(project string) ([]*SourceRepository, error) {
+	q := url.Values{}
+	q.Set("include_subgroups", "true")
+	q.Set("per_page", "100")
+	q.Set("topic", project)
+	if g.Filter != nil {
+		if !g.Filter.UpdatedSince.IsZero() {
+			q.Set("last_activity_after", g.Filter.UpdatedSince.UTC().Format(time.RFC3339))
+		}
+		switch g.Filter.Archived {
+		case ArchivedInclude:
+		case ArchivedOnly:
+			q.Set("archived", "true")
+		default:
+			q.Set("archived", "false")
+		}
+	} else {
+		q.Set("archived", "false")
+	}
+	filter := g.Filter
+	if filter != nil && filter.Language != "" {
+		withoutLanguage := *filter
+		withoutLanguage.Language = ""
+		filter = &withoutLanguage
+	}
+
+	next := fmt.Sprintf("%s/groups/%s/projects?%s", g.APIURL, url.PathEscape(g.Owner), q.Encode())
+	repositories := []*SourceRepository{}
+	for next != "" {
+		var page []gitlabProject
+		link, err := getJSON(g.client, next, g.header, &page)
+		if err != nil {
+			return nil, err
+		}
+		g.mu.Lock()
+		for _, item := range page {
+			g.paths[item.Path] = item.PathWithNamespace
+		}
+		g.mu.Unlock()
+		for _, item := range page {
+			repository := &SourceRepository{
+				Name:          item.Path,
+				CloneURL:      g.CloneURL(item.Path),
+				DefaultBranch: item.DefaultBranch,
+				UpdatedOn:     item.LastActivityAt,
+				Archived:      item.Archived,
+			}
+			if filter.Match(repository) {
+				repositories = append(repositories, repository)
+			}
+		}
+		next = link
+	}
+	return repositories, nil
+}
+
+// The full path of the project.  It's known without asking if the project was
+// listed, otherwise (e.g., it's from a file) the group and its subgroups are
+// searched for it.
+func (g *GitLabProvider) path(repository string) (string, error) {
+	g.mu.Lock()
+	p, ok := g.paths[repository]
+	g.mu.Unlock()
+	if ok {
+		return p, nil
+	}
+
+	q := url.Values{}
+	q.Set("include_subgroups", "true")
+	q.Set("per_page", "100")
+	q.Set("search", repository)
+	next := fmt.Sprintf("%s/groups/%s/projects?%s", g.APIURL, url.PathEscape(g.Owner), q.Encode())
+	var paths []string
+	for next != "" {
+		var page []gitlabProject
+		link, err := getJSON(g.client, next, g.header, &page)
+		if err != nil {
+			return "", err
+		}
+		// The search isn't only on the path, and isn't exact.
+		for _, item := range page {
+			if item.Path == repository {
+				paths = append(paths, item.PathWithNamespace)
+			}
+		}
+		next = link
+	}
+	p = fmt.Sprintf("%s/%s", g.Owner, repository)
+	switch {
+	case len(paths) == 0:
+		return "", fmt.Errorf("There's no `%s` project in the `%s` group or its subgroups", repository, g.Owner)
+	case len(paths) == 1:
+		p = paths[0]
+	// Unless one of them is directly in the group, which is the one that's meant.
+	case !slices.Contains(paths, p):
+		return "", fmt.Errorf("There's more than one `%s` project in the subgroups of `%s`: %s", repository, g.Owner, strings.Join(paths, ", "))
+	}
+
+	g.mu.Lock()
+	g.paths[repository] = p
+	g.mu.Unlock()
+	return p, nil
+}
+
+func (g *GitLabProvider) CloneURL(repository string) string {
+	if g.baseCloneURL != "" {
+		return sshCloneURL(g.baseCloneURL, g.host, g.Owner, repository)
+	}
+	p, err := g.path(repository)
+	if err != nil {
+		// It's left to the clone to say that it isn't there.
+		p = fmt.Sprintf("%s/%s", g.Owner, repository)
+	}
+	return fmt.Sprintf("git@%s:%s.git", g.host, p)
+}
+
+func (g *GitLabProvider) DefaultBranch(repository string) (string, error) {
+	p, err := g.path(repository)
+	if err != nil {
+		return "", err
+	}
+	var project gitlabProject
+	if _, err := getJSON(g.client, fmt.Sprintf("%s/projects/%s", g.APIURL, url.PathEscape(p)), g.header, &project); err != nil {
+		return "", err
+	}
+	return project.DefaultBranch, nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// The repositories are in a local directory, either as working copies or bare
+// repositories (`aion-nginx` or `aion-nginx.git`), so nothing needs the network.
+type LocalProvider struct {
+	Dir    string
+	Filter *RepositoryFilter
+}
+
+// The directory is the clone URL, which can be a path or a `file://` URL.
+func NewLocalProvider(opts *ProviderOptions) (*LocalProvider, error) {
+	if opts.CloneURL == "" {
+		return nil, errors.New("The local provider needs the directory of repositories (`--clone-url`)")
+	}
+	dir, err := filepath.Abs(strings.TrimPrefix(opts.CloneURL, "file://"))
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("`%s` isn't a directory", dir)
+	}
+	return &LocalProvider{
+		Dir:    dir,
+		Filter: opts.Filter,
+	}, nil
+}
+
+func isGitRepository(dir string) bool {
+	// A working copy or a bare repository.
+	return checkFileExists(filepath.Join(dir, ".git")) ||
+		(checkFileExists(filepath.Join(dir, "HEAD")) && checkFileExists(filepath.Join(dir, "objects")))
+}
+
+// If there's a directory for the project that isn't itself a repository, e.g.
+// `repos/aion/`, the repositories are in there.
+func (l *LocalProvider) root(project string) string {
+	for _, name := range []string{project, strings.ToLower(project)} {
+		dir := filepath.Join(l.Dir, name)
+		if info, err := os.Stat(dir); err == nil && info.IsDir() && !isGitRepository(dir) {
+			return dir
+		}
+	}
+	return l.Dir
+}
+
+// List every repository in the directory.  There aren't topics or languages, so
+// only the name and updated filters apply, the latter using the date of the
+// latest commit.
+func (l *LocalProvider) ListRepositories(project string) ([]*SourceRepository, error) {
+	root := l.root(project)
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return nil, err
+	}
+	repositories := []*SourceRepository{}
+	for _, entry := range entries {
+		dir := filepath.Join(root, entry.Name())
+		if !entry.IsDir() || !isGitRepository(dir) {
+			continue
+		}
+		repo, err := git.PlainOpen(dir)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", dir, err)
+		}
+		repository := &SourceRepository{
+			Name:     strings.TrimSuffix(entry.Name(), ".git"),
+			CloneURL: fmt.Sprintf("file://%s", filepath.ToSlash(dir)),
+		}
+		if head, err := repo.Head(); err == nil {
+			repository.DefaultBranch = head.Name().Short()
+			if commit, err := repo.CommitObject(head.Hash()); err == nil {
+				repository.UpdatedOn = commit.Committer.When
+			}
+		}
+		if l.Filter.Match(repository) {
+			repositories = append(repositories, repository)
+		}
+	}
+	return repositories, nil
+}
+
+// The repository can be anywhere that `ListRepositories` would have found it,
+// i.e., in the directory or in one of the project directories in it.
+func (l *LocalProvider) path(repository string) string {
+	roots := []string{l.Dir}
+	if entries, err := os.ReadDir(l.Dir); err == nil {
+		for _, entry := range entries {
+			if dir := filepath.Join(l.Dir, entry.Name()); entry.IsDir() && !isGitRepository(dir) {
+				roots = append(roots, dir)
+			}
+		}
+	}
+	for _, root := range roots {
+		for _, name := range []string{fmt.Sprintf("%s.git", repository), repository} {
+			if dir := filepath.Join(root, name); isGitRepository(dir) {
+				return dir
+			}
+		}
+	}
+	return filepath.Join(l.Dir, repository)
+}
+
+func (l *LocalProvider) CloneURL(repository string) string {
+	return fmt.Sprintf("file://%s", filepath.ToSlash(l.path(repository)))
+}
+
+func (l *LocalProvider) DefaultBranch(repository string) (string, error) {
+	repo, err := git.PlainOpen(l.path(repository))
+	if err != nil {
+		return "", err
+	}
+	// Don't resolve it, the branch that HEAD points to may not have any commits.
+	head, err := repo.Reference(plumbing.HEAD, false)
+	if err != nil {
+		return "", err
+	}
+	if head.Type() != plumbing.SymbolicReference {
+		return "", fmt.Errorf("HEAD is detached in `%s`", repository)
+	}
+	return head.Target().Short(), nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// A repository with a commit on `branch`, or a bare clone of one.
+func newLocalRepository(t *testing.T, dir, branch string, bare bool) time.Time {
+	t.Helper()
+	src := dir
+	if bare {
+		src = filepath.Join(t.TempDir(), filepath.Base(dir))
+	}
+	repo, err := git.PlainInit(src, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref := plumbing.NewSymbolicReference(plumbing.HEAD, plumbing.NewBranchReferenceName(branch))
+	if err := repo.Storer.SetReference(ref); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, filepath.Join(src, "README.md"), "# test\n")
+	wt, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := wt.Add("README.md"); err != nil {
+		t.Fatal(err)
+	}
+	when := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	_, err = wt.Commit("Initial commit", &git.CommitOptions{
+		Author: &object.Signature{Name: "test", Email: "test@example.com", When: when},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bare {
+		if _, err := git.PlainClone(dir, true, &git.CloneOptions{URL: src}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return when
+}
+
+func TestLocalProvider(t *testing.T) {
+	dir := t.TempDir()
+	when := newLocalRepository(t, filepath.Join(dir, "aion", "aion-foo"), "main", false)
+	newLocalRepository(t, filepath.Join(dir, "aion", "aion-bar.git"), "develop", true)
+	writeTestFile(t, filepath.Join(dir, "aion", "notes.txt"), "not a repository\n")
+	writeTestFile(t, filepath.Join(dir, "aion", "scratch", "notes.txt"), "not a repository\n")
+
+	if _, err := NewLocalProvider(&ProviderOptions{CloneURL: filepath.Join(dir, "aion", "notes.txt")}); err == nil {
+		t.Error("got a provider for a file")
+	}
+	tests := []struct {
+		name   string
+		filter *RepositoryFilter
+		want   string
+	}{
+		{name: "everything", want: "aion-bar,aion-foo"},
+		{name: "updated since", filter: &RepositoryFilter{UpdatedSince: when.Add(time.Hour)}, want: ""},
+		{name: "name", filter: &RepositoryFilter{Name: regexp.MustCompile("^aion-f")}, want: "aion-foo"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := NewLocalProvider(&ProviderOptions{CloneURL: "file://" + dir, Filter: tt.filter})
+			if err != nil {
+				t.Fatal(err)
+			}
+			repositories, err := l.ListRepositories("aion")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := repositoryNames(repositories); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	l, err := NewLocalProvider(&ProviderOptions{CloneURL: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for repository, want := range map[string]string{"aion-foo": "main", "aion-bar": "develop"} {
+		branch, err := l.DefaultBranch(repository)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if branch != want {
+			t.Errorf("got default branch %s for %s, want %s", branch, repository, want)
+		}
+	}
+	if got, want := l.CloneURL("aion-bar"), "file://"+filepath.ToSlash(filepath.Join(dir, "aion", "aion-bar.git")); got != want {
+		t.Errorf("got clone URL %s, want %s", got, want)
+	}
+
+	// A clone from the listed URL works.
+	repositories, err := l.ListRepositories("aion")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range repositories {
+		clone, err := git.PlainClone(filepath.Join(t.TempDir(), r.Name), false, &git.CloneOptions{URL: r.CloneURL})
+		if err != nil {
+			t.Fatalf("could not clone %s: %s", r.CloneURL, err)
+		}
+		head, err := clone.Head()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if head.Name().Short() != r.DefaultBranch {
+			t.Errorf("got %s checked out, want %s", head.Name().Short(), r.DefaultBranch)
+		}
+	}
+}
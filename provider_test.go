@@ -0,0 +1,409 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// An API that serves whatever the route for the path returns as JSON (or a 404
+// for nil), checking the auth header on every request.
+func newAPIServer(t *testing.T, header, want string, routes map[string]func(w http.ResponseWriter, r *http.Request) interface{}) *httptest.Server {
+	t.Helper()
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get(header); got != want {
+			t.Errorf("%s: got %s `%s`, want `%s`", r.URL, header, got, want)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		route, ok := routes[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		v := route(w, r)
+		if v == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if err := json.NewEncoder(w).Encode(v); err != nil {
+			t.Error(err)
+		}
+	}))
+}
+
+// The page that's asked for, where 1 is the first.
+func page(r *http.Request) int {
+	if p, err := strconv.Atoi(r.URL.Query().Get("page")); err == nil {
+		return p
+	}
+	return 1
+}
+
+// Link to the next page the way GitHub and GitLab do, if there is one.
+func linkNext(w http.ResponseWriter, r *http.Request, pages int) {
+	if p := page(r); p < pages {
+		q := r.URL.Query()
+		q.Set("page", fmt.Sprint(p+1))
+		w.Header().Set("Link", fmt.Sprintf(`<http://%s%s?%s>; rel="next", <http://%s%s?page=1>; rel="first"`, r.Host, r.URL.Path, q.Encode(), r.Host, r.URL.Path))
+	}
+}
+
+func repositoryNames(repositories []*SourceRepository) string {
+	var names []string
+	for _, r := range repositories {
+		names = append(names, r.Name)
+	}
+	return strings.Join(names, ",")
+}
+
+func TestGitHubProvider(t *testing.T) {
+	pushed := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	pages := [][]githubRepository{
+		{
+			{Name: "aion-foo", DefaultBranch: "main", Topics: []string{"aion"}, Language: "Go", PushedAt: pushed},
+			{Name: "other", DefaultBranch: "main", Topics: []string{"other"}},
+		},
+		{
+			{Name: "aion-bar", DefaultBranch: "master", Topics: []string{"aion", "api"}},
+			{Name: "aion-old", DefaultBranch: "master", Topics: []string{"aion"}, Archived: true},
+		},
+	}
+	server := newAPIServer(t, "Authorization", "Bearer secret", map[string]func(w http.ResponseWriter, r *http.Request) interface{}{
+		// The owner is a user, so the organization isn't found.
+		"/users/btoll/repos": func(w http.ResponseWriter, r *http.Request) interface{} {
+			if r.URL.Query().Get("per_page") != "100" {
+				t.Errorf("got per_page %s", r.URL.Query().Get("per_page"))
+			}
+			if got := r.Header.Get("X-GitHub-Api-Version"); got == "" {
+				t.Error("no API version")
+			}
+			linkNext(w, r, len(pages))
+			return pages[page(r)-1]
+		},
+		"/repos/btoll/aion-bar": func(w http.ResponseWriter, r *http.Request) interface{} {
+			return pages[1][0]
+		},
+	})
+	defer server.Close()
+
+	g, err := NewGitHubProvider(&ProviderOptions{Owner: "btoll", APIURL: server.URL}, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	repositories, err := g.ListRepositories("AION")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := repositoryNames(repositories); got != "aion-foo,aion-bar" {
+		t.Fatalf("got %s, want aion-foo,aion-bar", got)
+	}
+	foo := repositories[0]
+	if foo.DefaultBranch != "main" || foo.Language != "Go" || !foo.UpdatedOn.Equal(pushed) {
+		t.Errorf("got %+v", foo)
+	}
+	if want := fmt.Sprintf("git@%s:btoll/aion-foo.git", strings.Split(strings.TrimPrefix(server.URL, "http://"), ":")[0]); foo.CloneURL != want {
+		t.Errorf("got clone URL %s, want %s", foo.CloneURL, want)
+	}
+	branch, err := g.DefaultBranch("aion-bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if branch != "master" {
+		t.Errorf("got default branch %s, want master", branch)
+	}
+}
+
+func TestBitbucketProvider(t *testing.T) {
+	since := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	repository := func(slug string, archived bool) bitbucketRepository {
+		r := bitbucketRepository{Slug: slug, Language: "go", UpdatedOn: since.AddDate(0, 1, 0), Archived: archived}
+		r.Project.Key = "AION"
+		r.Mainbranch.Name = "master"
+		return r
+	}
+	pages := [][]bitbucketRepository{
+		{repository("aion-foo", false), repository("aion-old", true), repository("other", false)},
+		{repository("aion-bar", false)},
+	}
+	server := newAPIServer(t, "Authorization", "Basic dXNlcjpwYXNz", map[string]func(w http.ResponseWriter, r *http.Request) interface{}{
+		"/repositories/pecteam": func(w http.ResponseWriter, r *http.Request) interface{} {
+			q := r.URL.Query()
+			if want := `project.key="AION" AND language="go" AND updated_on>=2024-01-01T00:00:00Z`; q.Get("q") != want {
+				t.Errorf("got q `%s`, want `%s`", q.Get("q"), want)
+			}
+			p := page(r)
+			var next string
+			if p < len(pages) {
+				q.Set("page", fmt.Sprint(p+1))
+				next = fmt.Sprintf("http://%s%s?%s", r.Host, r.URL.Path, q.Encode())
+			}
+			return bitbucketPage{Values: pages[p-1], Next: next}
+		},
+		"/repositories/pecteam/aion-bar": func(w http.ResponseWriter, r *http.Request) interface{} {
+			return pages[1][0]
+		},
+	})
+	defer server.Close()
+
+	filter := &RepositoryFilter{
+		ProjectKey:   "AION",
+		Name:         regexp.MustCompile(`^aion-`),
+		Language:     "Go",
+		UpdatedSince: since,
+	}
+	b, err := NewBitbucketProvider(&ProviderOptions{APIURL: server.URL, Filter: filter}, "user", "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	repositories, err := b.ListRepositories("Aion")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The archived repository and the one that doesn't match the name are
+	// filtered out after.
+	if got := repositoryNames(repositories); got != "aion-foo,aion-bar" {
+		t.Fatalf("got %s, want aion-foo,aion-bar", got)
+	}
+	if foo := repositories[0]; foo.DefaultBranch != "master" || foo.Project != "AION" || foo.Language != "go" {
+		t.Errorf("got %+v", foo)
+	}
+	branch, err := b.DefaultBranch("aion-bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if branch != "master" {
+		t.Errorf("got default branch %s, want master", branch)
+	}
+
+	unauthenticated, err := NewBitbucketProvider(&ProviderOptions{APIURL: server.URL}, "user", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := unauthenticated.ListRepositories("Aion"); err == nil {
+		t.Error("listed the repositories without a password")
+	}
+}
+
+func TestBitbucketQuery(t *testing.T) {
+	tests := []struct {
+		name    string
+		filter  *RepositoryFilter
+		project string
+		want    string
+	}{
+		{"project name", nil, "Aion", `project.name="Aion"`},
+		{"project key", &RepositoryFilter{ProjectKey: "AION"}, "Aion", `project.key="AION"`},
+		{"escaped", nil, `say "hi" \o/`, `project.name="say \"hi\" \\o/"`},
+		{"language", &RepositoryFilter{Language: `Go"`}, "Aion", `project.name="Aion" AND language="go\""`},
+		{"updated", &RepositoryFilter{UpdatedSince: time.Date(2024, 1, 2, 3, 4, 5, 0, time.FixedZone("EST", -5*60*60))}, "Aion", `project.name="Aion" AND updated_on>=2024-01-02T08:04:05Z`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &BitbucketProvider{Filter: tt.filter}
+			if got := b.query(tt.project); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGitLabProvider(t *testing.T) {
+	pages := [][]gitlabProject{
+		{{Path: "aion-foo", PathWithNamespace: "pecteam/aion-foo", DefaultBranch: "main"}},
+		{{Path: "aion-bar", PathWithNamespace: "pecteam/aion/aion-bar", DefaultBranch: "develop"}},
+	}
+	server := newAPIServer(t, "PRIVATE-TOKEN", "secret", map[string]func(w http.ResponseWriter, r *http.Request) interface{}{
+		"/groups/pecteam/projects": func(w http.ResponseWriter, r *http.Request) interface{} {
+			q := r.URL.Query()
+			if q.Get("topic") != "aion" || q.Get("include_subgroups") != "true" || q.Get("archived") != "false" {
+				t.Errorf("got query %s", r.URL.RawQuery)
+			}
+			linkNext(w, r, len(pages))
+			return pages[page(r)-1]
+		},
+		// The path of a project in a subgroup is escaped.
+		"/projects/pecteam/aion/aion-bar": func(w http.ResponseWriter, r *http.Request) interface{} {
+			if !strings.Contains(r.URL.RawPath, "pecteam%2Faion%2Faion-bar") {
+				t.Errorf("got path %s", r.URL.RawPath)
+			}
+			return pages[1][0]
+		},
+	})
+	defer server.Close()
+
+	g, err := NewGitLabProvider(&ProviderOptions{Owner: "pecteam", APIURL: server.URL + "/"}, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	repositories, err := g.ListRepositories("aion")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := repositoryNames(repositories); got != "aion-foo,aion-bar" {
+		t.Fatalf("got %s, want aion-foo,aion-bar", got)
+	}
+	if got := repositories[1].CloneURL; !strings.HasSuffix(got, ":pecteam/aion/aion-bar.git") {
+		t.Errorf("got clone URL %s, want the subgroup's path", got)
+	}
+	branch, err := g.DefaultBranch("aion-bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if branch != "develop" {
+		t.Errorf("got default branch %s, want develop", branch)
+	}
+}
+
+func TestGitLabProviderSearch(t *testing.T) {
+	searched := map[string]int{}
+	results := map[string][]gitlabProject{
+		// The search isn't exact.
+		"aion-bar": {
+			{Path: "aion-bar-old", PathWithNamespace: "pecteam/aion-bar-old"},
+			{Path: "aion-bar", PathWithNamespace: "pecteam/aion/aion-bar"},
+		},
+		"aion-foo": {
+			{Path: "aion-foo", PathWithNamespace: "pecteam/aion/aion-foo"},
+			{Path: "aion-foo", PathWithNamespace: "pecteam/aion-foo"},
+		},
+		"aion-baz": {
+			{Path: "aion-baz", PathWithNamespace: "pecteam/aion/aion-baz"},
+			{Path: "aion-baz", PathWithNamespace: "pecteam/old/aion-baz"},
+		},
+	}
+	server := newAPIServer(t, "PRIVATE-TOKEN", "secret", map[string]func(w http.ResponseWriter, r *http.Request) interface{}{
+		"/groups/pecteam/projects": func(w http.ResponseWriter, r *http.Request) interface{} {
+			q := r.URL.Query()
+			if q.Get("include_subgroups") != "true" {
+				t.Errorf("got query %s", r.URL.RawQuery)
+			}
+			searched[q.Get("search")]++
+			if projects, ok := results[q.Get("search")]; ok {
+				return projects
+			}
+			return []gitlabProject{}
+		},
+		"/projects/pecteam/aion/aion-bar": func(w http.ResponseWriter, r *http.Request) interface{} {
+			return gitlabProject{Path: "aion-bar", PathWithNamespace: "pecteam/aion/aion-bar", DefaultBranch: "develop"}
+		},
+	})
+	defer server.Close()
+
+	// Nothing's been listed, e.g., the services are from a file.
+	g, err := NewGitLabProvider(&ProviderOptions{Owner: "pecteam", APIURL: server.URL}, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	host := strings.Split(strings.TrimPrefix(server.URL, "http://"), ":")[0]
+	tests := []struct {
+		repository string
+		want       string
+	}{
+		{"aion-bar", "pecteam/aion/aion-bar"},
+		{"aion-foo", "pecteam/aion-foo"},
+		// It's left to the clone to fail.
+		{"aion-baz", "pecteam/aion-baz"},
+		{"missing", "pecteam/missing"},
+	}
+	for _, tt := range tests {
+		if got, want := g.CloneURL(tt.repository), fmt.Sprintf("git@%s:%s.git", host, tt.want); got != want {
+			t.Errorf("%s: got clone URL %s, want %s", tt.repository, got, want)
+		}
+	}
+
+	branch, err := g.DefaultBranch("aion-bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if branch != "develop" {
+		t.Errorf("got default branch %s, want develop", branch)
+	}
+	if searched["aion-bar"] != 1 {
+		t.Errorf("searched for aion-bar %d times, want once", searched["aion-bar"])
+	}
+	if _, err := g.DefaultBranch("missing"); err == nil || !strings.Contains(err.Error(), "no `missing` project") {
+		t.Errorf("got %v, want the project not to be found", err)
+	}
+	if _, err := g.DefaultBranch("aion-baz"); err == nil || !strings.Contains(err.Error(), "pecteam/aion/aion-baz, pecteam/old/aion-baz") {
+		t.Errorf("got %v, want both of the projects", err)
+	}
+}
+
+func TestGiteaProvider(t *testing.T) {
+	repository := func(name, owner string) giteaRepository {
+		r := giteaRepository{Name: name, DefaultBranch: "main"}
+		r.Owner.Login = owner
+		return r
+	}
+	// The server's maximum page size is smaller than what's asked for.
+	pages := [][]giteaRepository{
+		{repository("aion-foo", "pecteam"), repository("aion-fork", "someone")},
+		{repository("aion-bar", "PECTEAM")},
+		{},
+	}
+	server := newAPIServer(t, "Authorization", "token secret", map[string]func(w http.ResponseWriter, r *http.Request) interface{}{
+		"/api/v1/repos/search": func(w http.ResponseWriter, r *http.Request) interface{} {
+			q := r.URL.Query()
+			if q.Get("q") != "aion" || q.Get("topic") != "true" || q.Get("limit") != fmt.Sprint(giteaPageSize) {
+				t.Errorf("got query %s", r.URL.RawQuery)
+			}
+			p := page(r)
+			if p > len(pages) {
+				t.Errorf("asked for page %d after an empty one", p)
+				return giteaSearchResults{OK: true}
+			}
+			return giteaSearchResults{OK: true, Data: pages[p-1]}
+		},
+		"/api/v1/repos/pecteam/aion-bar": func(w http.ResponseWriter, r *http.Request) interface{} {
+			return pages[1][0]
+		},
+	})
+	defer server.Close()
+
+	if _, err := NewGiteaProvider(&ProviderOptions{Owner: "pecteam"}, ""); err == nil {
+		t.Error("got a provider without an API URL")
+	}
+	g, err := NewGiteaProvider(&ProviderOptions{Owner: "pecteam", APIURL: server.URL + "/api/v1"}, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	repositories, err := g.ListRepositories("Aion")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := repositoryNames(repositories); got != "aion-foo,aion-bar" {
+		t.Fatalf("got %s, want aion-foo,aion-bar", got)
+	}
+	branch, err := g.DefaultBranch("aion-bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if branch != "main" {
+		t.Errorf("got default branch %s, want main", branch)
+	}
+}
+
+func TestGetJSONError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintln(w, "rate limited")
+	}))
+	defer server.Close()
+
+	var v interface{}
+	_, err := getJSON(http.DefaultClient, server.URL, nil, &v)
+	httpErr, ok := err.(*HTTPError)
+	if !ok {
+		t.Fatalf("got %v, want an HTTPError", err)
+	}
+	if httpErr.StatusCode != http.StatusForbidden || httpErr.Body != "rate limited" {
+		t.Errorf("got %+v", httpErr)
+	}
+}
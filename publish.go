@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/btoll/migrator/color"
+	"github.com/go-git/go-git/v5"
+	gitconfig "github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+)
+
+// What `publish` committed to the gitops repository.  There's no commit (or
+// branch) if none of the services changed.
+type Publication struct {
+	Dir      string
+	Branch   string
+	Commit   string
+	Services []string
+	Pushed   bool
+}
+
+// Commit every service in the project's output to the gitops repository (see
+// `GitopsConfig`), on a new branch, and push it if asked.  The services that are
+// in the repository but not in the output are left alone, since the run may have
+// only been for some of them.
+func (m *Migrator) publish(ctx context.Context) (*Publication, error) {
+	services, err := listServices(m.Dirs.Project)
+	if err != nil {
+		return nil, err
+	}
+	if len(services) == 0 {
+		return nil, fmt.Errorf("There aren't any kustomized services in `%s`", m.Dirs.Project)
+	}
+	authConfig := m.Project.Auth
+	if authConfig == nil {
+		authConfig = &AuthConfig{}
+	}
+	gitopsAuth, err := NewCloneAuth("", authConfig.merge(m.Config.Gitops.Auth))
+	if err != nil {
+		return nil, err
+	}
+	repo, p, err := m.openGitops(ctx, gitopsAuth)
+	if err != nil {
+		return nil, err
+	}
+	wt, err := repo.Worktree()
+	if err != nil {
+		return nil, err
+	}
+
+	paths := map[string]string{}
+	for service := range services {
+		paths[service] = filepath.ToSlash(m.Config.Gitops.servicePath(m.Project.Name, service))
+	}
+	// A working copy may have changes of its own, which are neither committed nor
+	// overwritten along with the services.
+	status, err := wt.Status()
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range sortedKeys(status) {
+		s := status[file]
+		if s.Staging != git.Unmodified && s.Staging != git.Untracked {
+			return nil, fmt.Errorf("`%s` has staged changes (`%s`), commit or unstage them first", p.Dir, file)
+		}
+		if _, ok := servicePathOf(file, paths); ok {
+			return nil, fmt.Errorf("`%s` has uncommitted changes in a service's directory (`%s`), commit or remove them first", p.Dir, file)
+		}
+	}
+
+	for _, service := range sortedKeys(services) {
+		dest := filepath.Join(p.Dir, filepath.FromSlash(paths[service]))
+		if err := os.RemoveAll(dest); err != nil {
+			return nil, err
+		}
+		if err := copyDir(services[service], dest); err != nil {
+			return nil, fmt.Errorf("Could not copy `%s` into the gitops repository: %w", service, err)
+		}
+		// A directory is added with whatever was deleted from it.
+		if _, err := wt.Add(paths[service]); err != nil {
+			return nil, err
+		}
+	}
+	status, err = wt.Status()
+	if err != nil {
+		return nil, err
+	}
+	changed := map[string]bool{}
+	for file, s := range status {
+		if s.Staging == git.Unmodified || s.Staging == git.Untracked {
+			continue
+		}
+		service, ok := servicePathOf(file, paths)
+		if !ok {
+			// The whole index is committed, so it can only have the services.
+			return nil, fmt.Errorf("`%s` was staged, but it isn't in a service's directory", file)
+		}
+		changed[service] = true
+	}
+	p.Services = sortedKeys(changed)
+	if len(p.Services) == 0 {
+		return p, nil
+	}
+
+	p.Branch = fmt.Sprintf("%s%s-%s", m.Config.Gitops.BranchPrefix, m.Project.Name, time.Now().Format("20060102-150405"))
+	branch := plumbing.NewBranchReferenceName(p.Branch)
+	if _, err := repo.Head(); errors.Is(err, plumbing.ErrReferenceNotFound) {
+		// It doesn't have any commits yet, so the first one starts the branch.
+		err = repo.Storer.SetReference(plumbing.NewSymbolicReference(plumbing.HEAD, branch))
+		if err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	} else if err := wt.Checkout(&git.CheckoutOptions{Branch: branch, Create: true, Keep: true}); err != nil {
+		return nil, fmt.Errorf("Could not create the `%s` branch: %w", p.Branch, err)
+	}
+	author, err := m.gitopsAuthor(repo)
+	if err != nil {
+		return nil, err
+	}
+	hash, err := wt.Commit(m.publishMessage(p.Services), &git.CommitOptions{Author: author})
+	if err != nil {
+		return nil, fmt.Errorf("Could not commit to the gitops repository: %w", err)
+	}
+	p.Commit = hash.String()
+
+	if !m.Project.Push {
+		return p, nil
+	}
+	remote, err := repo.Remote("origin")
+	if err != nil {
+		return nil, fmt.Errorf("Could not push the `%s` branch: %w", p.Branch, err)
+	}
+	auth, err := gitopsAuth.Method(remote.Config().URLs[0])
+	if err != nil {
+		return nil, err
+	}
+	_, err = retry(ctx, m.Retry, os.Stderr, fmt.Sprintf("push the `%s` branch", p.Branch), func(ctx context.Context) error {
+		return repo.PushContext(ctx, &git.PushOptions{
+			RemoteName: "origin",
+			RefSpecs:   []gitconfig.RefSpec{gitconfig.RefSpec(fmt.Sprintf("%s:%s", branch, branch))},
+			Auth:       auth,
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Could not push the `%s` branch: %w", p.Branch, err)
+	}
+	p.Pushed = true
+	return p, nil
+}
+
+// Open the working copy (`--gitops-dir`), or clone the repository into the build
+// directory.  A clone is only ever a copy, so it's cloned again every time.  An
+// empty repository can't be cloned, so it's started instead.
+func (m *Migrator) openGitops(ctx context.Context, gitopsAuth *CloneAuth) (*git.Repository, *Publication, error) {
+	if m.Project.GitopsDir != "" {
+		repo, err := git.PlainOpen(m.Project.GitopsDir)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Could not open the gitops repository `%s`: %w", m.Project.GitopsDir, err)
+		}
+		return repo, &Publication{Dir: m.Project.GitopsDir}, nil
+	}
+	url := m.Project.GitopsURL
+	if url == "" {
+		url = m.Config.Gitops.URL
+	}
+	if url == "" {
+		return nil, nil, errors.New("The gitops repository is needed (`--gitops-url`, `--gitops-dir` or `gitops.url` in the project config)")
+	}
+	auth, err := gitopsAuth.Method(url)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Could not get the credentials to clone the gitops repository: %w", err)
+	}
+	dir := fmt.Sprintf("%s/gitops/%s", m.Dirs.Build, m.Project.Name)
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, nil, err
+	}
+	cloner := &Cloner{
+		URL:        url,
+		Repository: "gitops",
+		Reference:  plumbing.HEAD,
+		CloneDir:   dir,
+		Auth:       auth,
+	}
+	if m.Config.Gitops.Branch != "" {
+		cloner.Reference = plumbing.NewBranchReferenceName(m.Config.Gitops.Branch)
+	}
+	var repo *git.Repository
+	_, err = retry(ctx, m.Retry, os.Stderr, "clone the gitops repository", func(ctx context.Context) error {
+		var err error
+		repo, err = clone(ctx, cloner)
+		return err
+	})
+	if errors.Is(err, transport.ErrEmptyRemoteRepository) {
+		repo, err = git.PlainInit(dir, false)
+		if err == nil {
+			_, err = repo.CreateRemote(&gitconfig.RemoteConfig{Name: "origin", URLs: []string{url}})
+		}
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("Could not clone the gitops repository `%s`: %w", url, err)
+	}
+	return repo, &Publication{Dir: dir}, nil
+}
+
+// go-git doesn't fall back to the git config for the author, so it's done here.
+func (m *Migrator) gitopsAuthor(repo *git.Repository) (*object.Signature, error) {
+	author := &object.Signature{
+		Name:  m.Config.Gitops.AuthorName,
+		Email: m.Config.Gitops.AuthorEmail,
+		When:  time.Now(),
+	}
+	if author.Name != "" {
+		return author, nil
+	}
+	// The repository's config merged with the global and the system ones.
+	config, err := repo.ConfigScoped(gitconfig.SystemScope)
+	if err != nil {
+		return nil, err
+	}
+	author.Name, author.Email = config.User.Name, config.User.Email
+	if author.Name == "" {
+		return nil, errors.New("The commit needs an author (`gitops.author_name` in the project config or `user.name` in the git config)")
+	}
+	return author, nil
+}
+
+// The commit message lists the services with the commits that they were
+// transformed from, from the report of the run or else the sources (since
+// `transform` doesn't clone, its report doesn't have them).
+func (m *Migrator) publishMessage(services []string) string {
+	clones := map[string]*CloneResult{}
+	if r, err := readReport(m.reportFile()); err == nil {
+		for _, repository := range r.Repositories {
+			if repository.Clone != nil && repository.Clone.Error == "" {
+				clones[repository.Name] = repository.Clone
+			}
+		}
+	} else {
+		fmt.Fprintln(os.Stderr, fmt.Sprintf("%s Could not read the report, so the commits of the services aren't known: %s", color.Warning(), err))
+	}
+	noun := "services"
+	if len(services) == 1 {
+		noun = "service"
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "Migrate %d %s %s\n\n", len(services), m.Project.Name, noun)
+	for _, service := range services {
+		clone, ok := clones[service]
+		if !ok {
+			if repo, err := git.PlainOpen(fmt.Sprintf("%s/%s", m.Dirs.Sources, service)); err == nil {
+				if head, err := repo.Head(); err == nil {
+					clone, ok = &CloneResult{Commit: head.Hash().String()}, true
+					if head.Name().IsBranch() {
+						clone.Branch = head.Name().Short()
+					}
+				}
+			}
+		}
+		switch {
+		case !ok:
+			fmt.Fprintf(&b, "- %s (unknown commit)\n", service)
+		case clone.Branch != "":
+			fmt.Fprintf(&b, "- %s: %s (%s)\n", service, clone.Commit, clone.Branch)
+		case clone.Ref != "" && clone.Ref != clone.Commit:
+			fmt.Fprintf(&b, "- %s: %s (%s)\n", service, clone.Commit, plumbing.ReferenceName(clone.Ref).Short())
+		default:
+			fmt.Fprintf(&b, "- %s: %s\n", service, clone.Commit)
+		}
+	}
+	return b.String()
+}
+
+// The services in the gitops repository, found by the `gitops.path` layout.
+func (m *Migrator) gitopsServices(root string) (map[string]string, error) {
+	i := strings.Count(strings.Split(filepath.ToSlash(m.Config.Gitops.Path), "{service}")[0], "/")
+	matches, err := filepath.Glob(filepath.Join(root, m.Config.Gitops.servicePath(m.Project.Name, "*")))
+	if err != nil {
+		return nil, err
+	}
+	services := map[string]string{}
+	for _, match := range matches {
+		rel, err := filepath.Rel(root, match)
+		if err != nil {
+			return nil, err
+		}
+		service := strings.Split(filepath.ToSlash(rel), "/")[i]
+		if strings.HasPrefix(service, ".") {
+			continue
+		}
+		if dirs, err := kustomizedDirs(match); err == nil && len(dirs) > 0 {
+			services[service] = match
+		}
+	}
+	return services, nil
+}
+
+// The service whose directory the file (relative to the repository) is in.
+func servicePathOf(file string, paths map[string]string) (string, bool) {
+	for service, path := range paths {
+		if strings.HasPrefix(file, path+"/") {
+			return service, true
+		}
+	}
+	return "", false
+}
+
+func copyDir(src, dest string) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dest, rel)
+		if d.IsDir() {
+			return os.MkdirAll(target, os.ModePerm)
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(target, b, 0644)
+	})
+}
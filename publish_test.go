@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+func writeTestFile(t *testing.T, filename, contents string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(filename), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filename, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// A bare repository with a commit on `master`, like the gitops repository.
+func newGitopsRemote(t *testing.T) string {
+	t.Helper()
+	seedDir := filepath.Join(t.TempDir(), "seed")
+	seed, err := git.PlainInit(seedDir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, filepath.Join(seedDir, "README.md"), "# gitops\n")
+	wt, err := seed.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := wt.Add("README.md"); err != nil {
+		t.Fatal(err)
+	}
+	_, err = wt.Commit("Initial commit", &git.CommitOptions{
+		Author: &object.Signature{Name: "test", Email: "test@example.com", When: time.Now()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bareDir := filepath.Join(t.TempDir(), "gitops.git")
+	if _, err := git.PlainClone(bareDir, true, &git.CloneOptions{URL: seedDir}); err != nil {
+		t.Fatal(err)
+	}
+	return bareDir
+}
+
+// A migrator with the `aion-foo` service in its output.
+func newPublishMigrator(t *testing.T) *Migrator {
+	t.Helper()
+	buildDir := t.TempDir()
+	projectDir := filepath.Join(buildDir, "aion")
+	writeTestFile(t, filepath.Join(projectDir, "aion-foo", "base", "kustomization.yaml"), "resources:\n  - aionfoo-deployment.yaml\n")
+	writeTestFile(t, filepath.Join(projectDir, "aion-foo", "overlays", "production", "kustomization.yaml"), "resources:\n  - ../../base\n")
+	config := defaultConfig()
+	config.Gitops.AuthorName = "Migrator"
+	config.Gitops.AuthorEmail = "migrator@example.com"
+	return &Migrator{
+		Project: &Project{Name: "aion", Auth: &AuthConfig{Method: AuthNone}},
+		Config:  config,
+		Retry:   &RetryPolicy{},
+		Dirs: &BuildDirs{
+			Build:   buildDir,
+			Project: projectDir,
+			Sources: filepath.Join(buildDir, "cloned", "aion"),
+		},
+	}
+}
+
+func TestPublishClonesCommitsAndPushes(t *testing.T) {
+	remote := newGitopsRemote(t)
+	m := newPublishMigrator(t)
+	m.Project.GitopsURL = remote
+	m.Project.Push = true
+
+	p, err := m.publish(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(p.Services, ",") != "aion-foo" || !p.Pushed {
+		t.Fatalf("got services %v (pushed %t), want aion-foo (pushed)", p.Services, p.Pushed)
+	}
+	if !strings.HasPrefix(p.Branch, "migrator/aion-") {
+		t.Errorf("got branch %s, want migrator/aion-*", p.Branch)
+	}
+
+	repo, err := git.PlainOpen(remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := repo.Reference(plumbing.NewBranchReferenceName(p.Branch), true)
+	if err != nil {
+		t.Fatalf("the branch wasn't pushed: %s", err)
+	}
+	commit, err := repo.CommitObject(ref.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(commit.Message, "Migrate 1 aion service\n") || !strings.Contains(commit.Message, "- aion-foo") {
+		t.Errorf("got message %q", commit.Message)
+	}
+	for _, file := range []string{"README.md", "aion/aion-foo/base/kustomization.yaml", "aion/aion-foo/overlays/production/kustomization.yaml"} {
+		if _, err := commit.File(file); err != nil {
+			t.Errorf("%s isn't in the commit: %s", file, err)
+		}
+	}
+	master, err := repo.Reference(plumbing.NewBranchReferenceName("master"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parent, err := commit.Parent(0); err != nil || parent.Hash != master.Hash() {
+		t.Errorf("the branch doesn't start from master")
+	}
+}
+
+func TestPublishWorkingCopy(t *testing.T) {
+	tests := []struct {
+		name string
+		// Make the working copy dirty, returning the file that mustn't be lost.
+		dirty   func(t *testing.T, dir string, wt *git.Worktree) string
+		refused bool
+	}{
+		{
+			name: "untracked file in a service's directory",
+			dirty: func(t *testing.T, dir string, wt *git.Worktree) string {
+				filename := filepath.Join(dir, "aion", "aion-foo", "notes.txt")
+				writeTestFile(t, filename, "work in progress\n")
+				return filename
+			},
+			refused: true,
+		},
+		{
+			name: "staged change elsewhere",
+			dirty: func(t *testing.T, dir string, wt *git.Worktree) string {
+				filename := filepath.Join(dir, "README.md")
+				writeTestFile(t, filename, "# gitops, edited\n")
+				if _, err := wt.Add("README.md"); err != nil {
+					t.Fatal(err)
+				}
+				return filename
+			},
+			refused: true,
+		},
+		{
+			name: "untracked file elsewhere",
+			dirty: func(t *testing.T, dir string, wt *git.Worktree) string {
+				filename := filepath.Join(dir, "scratch.txt")
+				writeTestFile(t, filename, "scratch\n")
+				return filename
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := filepath.Join(t.TempDir(), "gitops")
+			repo, err := git.PlainClone(dir, false, &git.CloneOptions{URL: newGitopsRemote(t)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			wt, err := repo.Worktree()
+			if err != nil {
+				t.Fatal(err)
+			}
+			filename := tt.dirty(t, dir, wt)
+			m := newPublishMigrator(t)
+			m.Project.GitopsDir = dir
+
+			p, err := m.publish(context.Background())
+			if tt.refused && err == nil {
+				t.Fatal("published to a dirty working copy")
+			}
+			if !tt.refused && err != nil {
+				t.Fatal(err)
+			}
+			if !checkFileExists(filename) {
+				t.Errorf("%s was deleted", filename)
+			}
+			if tt.refused {
+				return
+			}
+			head, err := repo.Head()
+			if err != nil {
+				t.Fatal(err)
+			}
+			commit, err := repo.CommitObject(head.Hash())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if head.Name().Short() != p.Branch {
+				t.Errorf("got %s checked out, want %s", head.Name().Short(), p.Branch)
+			}
+			rel, _ := filepath.Rel(dir, filename)
+			if _, err := commit.File(filepath.ToSlash(rel)); err == nil {
+				t.Errorf("%s was committed", rel)
+			}
+		})
+	}
+}
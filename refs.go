@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	gitconfig "github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/storage/memory"
+)
+
+// The refs that are tried, in order, when cloning a service's repository.  A
+// ref is a branch name, `tag:NAME`, `commit:SHA` (a full or abbreviated commit
+// to pin the repository to) or `HEAD`, i.e., whatever branch the remote's HEAD
+// points to.  The default is the original `development`, then `master`, then
+// the default branch:
+//
+//	refs: [development, main, master, HEAD]
+//	repository_refs:
+//	  aion-nginx: ["tag:v2.3.1"]
+//	  aion-legacy: ["commit:1a2b3c4"]
+var defaultRefs = []string{"development", "master", RefHEAD}
+
+const (
+	RefHEAD   = "HEAD"
+	RefBranch = "branch"
+	RefTag    = "tag"
+	RefCommit = "commit"
+)
+
+type CloneRef struct {
+	Kind string
+	Name string
+}
+
+func parseRef(s string) (*CloneRef, error) {
+	s = strings.TrimSpace(s)
+	kind, name, ok := strings.Cut(s, ":")
+	switch {
+	case s == RefHEAD:
+		return &CloneRef{Kind: RefBranch, Name: RefHEAD}, nil
+	case !ok:
+		return &CloneRef{Kind: RefBranch, Name: strings.TrimPrefix(s, "refs/heads/")}, nil
+	case kind == RefBranch || kind == RefTag:
+		if name != "" {
+			return &CloneRef{Kind: kind, Name: name}, nil
+		}
+	case kind == RefCommit:
+		if len(name) >= 4 && len(name) <= 40 && strings.Trim(strings.ToLower(name), "0123456789abcdef") == "" {
+			return &CloneRef{Kind: kind, Name: strings.ToLower(name)}, nil
+		}
+		return nil, fmt.Errorf("`%s` isn't a commit SHA", name)
+	}
+	return nil, fmt.Errorf("Invalid ref `%s`, expected a branch, `tag:NAME`, `commit:SHA` or `HEAD`", s)
+}
+
+func parseRefs(refs []string) ([]*CloneRef, error) {
+	if len(refs) == 0 {
+		return nil, errors.New("There must be at least one ref to clone")
+	}
+	parsed := []*CloneRef{}
+	for _, ref := range refs {
+		r, err := parseRef(ref)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, r)
+	}
+	return parsed, nil
+}
+
+func (r *CloneRef) String() string {
+	switch {
+	case r.Kind == RefTag:
+		return fmt.Sprintf("the `%s` tag", r.Name)
+	case r.Kind == RefCommit:
+		return fmt.Sprintf("the `%s` commit", r.Name)
+	case r.Name == RefHEAD:
+		return "the default branch"
+	}
+	return fmt.Sprintf("the `%s` branch", r.Name)
+}
+
+// The refs for the repository, the ones for the repository in the project config
+// taking precedence over the project's.
+func (m *Migrator) refs(repository string) []*CloneRef {
+	if refs, ok := m.RepositoryRefs[repository]; ok {
+		return refs
+	}
+	return m.Refs
+}
+
+// What the remote has, listed once so that the clone is only done for a ref that
+// exists instead of trying each of them in turn.
+type remoteRefs map[plumbing.ReferenceName]*plumbing.Reference
+
+func listRemoteRefs(ctx context.Context, url string, auth transport.AuthMethod) (remoteRefs, error) {
+	remote := git.NewRemote(memory.NewStorage(), &gitconfig.RemoteConfig{
+		Name: "origin",
+		URLs: []string{url},
+	})
+	list, err := remote.ListContext(ctx, &git.ListOptions{Auth: auth})
+	if err != nil {
+		return nil, err
+	}
+	refs := remoteRefs{}
+	for _, ref := range list {
+		refs[ref.Name()] = ref
+	}
+	return refs, nil
+}
+
+// The branch that the remote's HEAD points to.  If the remote doesn't say, it's
+// the branch at the same commit, if there's only one.
+func (refs remoteRefs) head() string {
+	head, ok := refs[plumbing.HEAD]
+	if !ok {
+		return ""
+	}
+	if head.Type() == plumbing.SymbolicReference {
+		return head.Target().Short()
+	}
+	var branches []string
+	for name, ref := range refs {
+		if name.IsBranch() && ref.Hash() == head.Hash() {
+			branches = append(branches, name.Short())
+		}
+	}
+	if len(branches) == 1 {
+		return branches[0]
+	}
+	return ""
+}
+
+// The reference to clone for the ref, and whether the remote has it.  Commits are
+// cloned from the default branch and then checked out, since they can't be listed.
+func (refs remoteRefs) resolve(ref *CloneRef, defaultBranch func() (string, error)) (plumbing.ReferenceName, bool) {
+	switch ref.Kind {
+	case RefTag:
+		name := plumbing.NewTagReferenceName(ref.Name)
+		_, ok := refs[name]
+		return name, ok
+	case RefCommit:
+		return "", true
+	}
+	branch := ref.Name
+	if branch == RefHEAD {
+		branch = refs.head()
+		if branch == "" {
+			if b, err := defaultBranch(); err == nil {
+				branch = b
+			}
+		}
+		if branch == "" {
+			return "", false
+		}
+	}
+	name := plumbing.NewBranchReferenceName(branch)
+	_, ok := refs[name]
+	return name, ok
+}
+
+// Check out the pinned commit in the clone (or only the `sparse` directories of
+// it), if the ref is one, and return the commit that's checked out.
+func checkoutRef(repo *git.Repository, ref *CloneRef, sparse []string) (plumbing.Hash, error) {
+	if ref.Kind != RefCommit {
+		head, err := repo.Head()
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		return head.Hash(), nil
+	}
+	hash, err := repo.ResolveRevision(plumbing.Revision(ref.Name))
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("Could not find the `%s` commit: %w", ref.Name, err)
+	}
+	wt, err := repo.Worktree()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return *hash, wt.Checkout(&git.CheckoutOptions{
+		Hash:                      *hash,
+		Force:                     true,
+		SparseCheckoutDirectories: sparse,
+	})
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// The outcome of cloning a single repository.
+type CloneResult struct {
+	Repository string `json:"-"`
+	// The branch that was cloned, if it was one, the full ref (or the SHA of a
+	// pinned commit) and the commit that was checked out.
+	Branch string `json:"branch,omitempty"`
+	Ref    string `json:"ref,omitempty"`
+	Commit string `json:"commit,omitempty"`
+	Error  string `json:"error,omitempty"`
+	// Whether the error might go away if it's run again, e.g., a timeout, as
+	// opposed to a repository that doesn't exist.
+	Retryable bool `json:"retryable,omitempty"`
+	// The number of times that the listing or the clone had to be retried.
+	Retries int `json:"retries,omitempty"`
+}
+
+// An expression that couldn't be resolved when rendering, and is still in the
+// output as `{{ expression }}`.
+type UnresolvedExpression struct {
+	File       string `json:"file"`
+	Line       int    `json:"line"`
+	Expression string `json:"expression"`
+}
+
+type RenderError struct {
+	File  string `json:"file"`
+	Error string `json:"error"`
+}
+
+// The report of a run, written to `build/report.json` (see `--report`).  It has
+// everything that used to go into the `error`, `master`, `noKube`, etc. files,
+// e.g.:
+//
+//	jq -r '.repositories[] | select(.clone.branch == "master") | .name' build/report.json
+//	jq -r '.repositories[] | select(.kustomize.no_kube) | .name' build/report.json
+type Report struct {
+	Project      string    `json:"project"`
+	StartedAt    time.Time `json:"started_at"`
+	FinishedAt   time.Time `json:"finished_at"`
+	Environments []string  `json:"environments"`
+	// It was stopped before it was done, so only what was done is in the report.
+	Interrupted bool `json:"interrupted,omitempty"`
+	// Only there if it couldn't be cloned, in which case nothing else was done.
+	AnsibleDeployers *CloneResult        `json:"ansible_deployers,omitempty"`
+	Summary          ReportSummary       `json:"summary"`
+	Repositories     []*RepositoryReport `json:"repositories"`
+}
+
+type ReportSummary struct {
+	Repositories int `json:"repositories"`
+	Cloned       int `json:"cloned"`
+	CloneErrors  int `json:"clone_errors"`
+	// The clone errors that might go away if it's run again.
+	Retryable  int `json:"retryable"`
+	Kustomized int `json:"kustomized"`
+	NoKube     int `json:"no_kube"`
+	Failed     int `json:"failed"`
+	// The files that couldn't be rendered or written, the overlays that couldn't
+	// be built, and the fields of what they were built into that aren't valid (of
+	// the failed services).
+	RenderErrors int `json:"render_errors"`
+	WriteErrors  int `json:"write_errors"`
+	BuildErrors  int `json:"build_errors"`
+	SchemaErrors int `json:"schema_errors"`
+	// The API versions that are deprecated but still served, which aren't errors.
+	Deprecations int `json:"deprecations"`
+	Unresolved   int `json:"unresolved"`
+	Warnings     int `json:"warnings"`
+}
+
+// A repository may only have been cloned (`--clone-only`) or only kustomized
+// (when it was cloned by an earlier run).
+type RepositoryReport struct {
+	Name      string         `json:"name"`
+	Clone     *CloneResult   `json:"clone,omitempty"`
+	Kustomize *ServiceResult `json:"kustomize,omitempty"`
+}
+
+func (m *Migrator) report(startedAt time.Time) *Report {
+	r := &Report{
+		Project:      m.Project.Name,
+		StartedAt:    startedAt,
+		FinishedAt:   time.Now(),
+		Repositories: []*RepositoryReport{},
+		// `ansible-deployers` is only in the report when it couldn't be cloned.
+		AnsibleDeployers: m.AnsibleDeployersClone,
+	}
+	for _, env := range m.Environments {
+		r.Environments = append(r.Environments, env.Name)
+	}
+
+	repositories := map[string]*RepositoryReport{}
+	get := func(name string) *RepositoryReport {
+		if _, ok := repositories[name]; !ok {
+			repositories[name] = &RepositoryReport{Name: name}
+		}
+		return repositories[name]
+	}
+	for _, clone := range m.Clones {
+		get(clone.Repository).Clone = clone
+		if clone.Error != "" {
+			r.Summary.CloneErrors += 1
+			if clone.Retryable {
+				r.Summary.Retryable += 1
+			}
+		} else {
+			r.Summary.Cloned += 1
+		}
+	}
+	for _, result := range m.Results {
+		get(result.Repository).Kustomize = result
+		switch {
+		case result.NoKube:
+			r.Summary.NoKube += 1
+		case result.Success:
+			r.Summary.Kustomized += 1
+		default:
+			r.Summary.Failed += 1
+		}
+		r.Summary.RenderErrors += len(result.RenderErrors)
+		r.Summary.WriteErrors += len(result.WriteErrors)
+		r.Summary.BuildErrors += len(result.BuildErrors)
+		r.Summary.SchemaErrors += invalid(result.SchemaErrors)
+		r.Summary.Deprecations += len(result.SchemaErrors) - invalid(result.SchemaErrors)
+		r.Summary.Unresolved += len(result.Unmatched)
+		r.Summary.Warnings += len(result.Warnings)
+	}
+	for _, name := range sortedKeys(repositories) {
+		r.Repositories = append(r.Repositories, repositories[name])
+	}
+	r.Summary.Repositories = len(r.Repositories)
+	return r
+}
+
+func readReport(filename string) (*Report, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	r := &Report{}
+	if err := json.Unmarshal(b, r); err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	// The names aren't in the JSON twice.
+	for _, repository := range r.Repositories {
+		if repository.Clone != nil {
+			repository.Clone.Repository = repository.Name
+		}
+		if repository.Kustomize != nil {
+			repository.Kustomize.Repository = repository.Name
+		}
+	}
+	return r, nil
+}
+
+func (r *Report) write(filename string) error {
+	b, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, append(b, '\n'), 0644)
+}
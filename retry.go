@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/btoll/migrator/color"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+)
+
+// How the clones and the provider's API requests are retried when they fail for
+// a reason that might go away, e.g., a timeout or a 503, but not when the
+// repository doesn't exist or the credentials are wrong.
+type RetryPolicy struct {
+	// The number of times to retry after the first attempt fails.
+	Retries int `yaml:"retries"`
+	// How long to wait before the first retry.  It's doubled for every retry after
+	// that, up to `max_backoff`, and each wait is randomly shortened by up to half
+	// so that the jobs don't all retry at once.
+	Backoff    time.Duration `yaml:"backoff"`
+	MaxBackoff time.Duration `yaml:"max_backoff"`
+	// How long a single attempt (a clone or a request) can take.
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+func defaultRetryPolicy() *RetryPolicy {
+	return &RetryPolicy{
+		Retries:    3,
+		Backoff:    time.Second,
+		MaxBackoff: 30 * time.Second,
+		Timeout:    5 * time.Minute,
+	}
+}
+
+// Fill in whatever isn't set from `defaults`.  A negative number of retries means
+// it isn't set, since 0 is no retries.
+func (p *RetryPolicy) merge(defaults *RetryPolicy) *RetryPolicy {
+	merged := *p
+	if merged.Retries < 0 {
+		merged.Retries = defaults.Retries
+	}
+	if merged.Backoff == 0 {
+		merged.Backoff = defaults.Backoff
+	}
+	if merged.MaxBackoff == 0 {
+		merged.MaxBackoff = defaults.MaxBackoff
+	}
+	if merged.Timeout == 0 {
+		merged.Timeout = defaults.Timeout
+	}
+	return &merged
+}
+
+func (p *RetryPolicy) validate() error {
+	if p.Retries < 0 || p.Backoff < 0 || p.MaxBackoff < 0 || p.Timeout < 0 {
+		return errors.New("`retry` can't have negative values")
+	}
+	return nil
+}
+
+// How long to wait before the retry, where the first retry is 1.
+func (p *RetryPolicy) backoff(retry int) time.Duration {
+	d := p.Backoff
+	for i := 1; i < retry && d < p.MaxBackoff; i++ {
+		d *= 2
+	}
+	d = min(d, p.MaxBackoff)
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// An error that retrying won't fix.
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PermanentError) Unwrap() error {
+	return e.Err
+}
+
+func isRetryable(err error) bool {
+	var permanent *PermanentError
+	var httpErr *HTTPError
+	switch {
+	case err == nil, errors.As(err, &permanent), errors.Is(err, context.Canceled):
+		return false
+	case errors.As(err, &httpErr):
+		return httpErr.StatusCode == http.StatusTooManyRequests || httpErr.StatusCode >= 500
+	case errors.Is(err, transport.ErrRepositoryNotFound),
+		errors.Is(err, transport.ErrEmptyRemoteRepository),
+		errors.Is(err, transport.ErrAuthenticationRequired),
+		errors.Is(err, transport.ErrAuthorizationFailed),
+		errors.Is(err, transport.ErrInvalidAuthMethod),
+		errors.Is(err, plumbing.ErrReferenceNotFound):
+		return false
+	}
+	// Timeouts, connections that were refused or reset, etc.
+	return true
+}
+
+// Try `f` until it succeeds, fails for good or runs out of retries, giving each
+// attempt its own timeout.  The retries are written to `w`.
+func retry(ctx context.Context, p *RetryPolicy, w io.Writer, what string, f func(ctx context.Context) error) (int, error) {
+	attempts := 0
+	for {
+		attempts += 1
+		err := func() error {
+			ctx := ctx
+			if p.Timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, p.Timeout)
+				defer cancel()
+			}
+			err := f(ctx)
+			if p.Timeout > 0 && err != nil && ctx.Err() == context.DeadlineExceeded {
+				return fmt.Errorf("Timed out after %s: %w", p.Timeout, err)
+			}
+			return err
+		}()
+		if err == nil || !isRetryable(err) || attempts > p.Retries || ctx.Err() != nil {
+			return attempts, err
+		}
+		d := p.backoff(attempts)
+		// The server may say how long to wait, but not for longer than the
+		// longest backoff.
+		var httpErr *HTTPError
+		if errors.As(err, &httpErr) && httpErr.RetryAfter > 0 {
+			d = min(httpErr.RetryAfter, p.MaxBackoff)
+		}
+		fmt.Fprintln(w, fmt.Sprintf("%s Could not %s: %s, retrying in %s (%d of %d)...", color.Warning(), what, err, d.Round(time.Millisecond), attempts, p.Retries))
+		select {
+		case <-time.After(d):
+		case <-ctx.Done():
+			return attempts, ctx.Err()
+		}
+	}
+}
+
+// Retries the provider's API requests.  They're all GETs, so it's always safe.
+type retryTransport struct {
+	policy *RetryPolicy
+	next   http.RoundTripper
+	w      io.Writer
+}
+
+func newHTTPClient(policy *RetryPolicy, w io.Writer) *http.Client {
+	if policy == nil {
+		return http.DefaultClient
+	}
+	return &http.Client{
+		Transport: &retryTransport{
+			policy: policy,
+			next:   http.DefaultTransport,
+			w:      w,
+		},
+	}
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// The timeout is for each attempt, and it can't be cancelled until the body
+	// has been read, so it's done here rather than by `retry`.
+	policy := *t.policy
+	policy.Timeout = 0
+	var res *http.Response
+	_, err := retry(req.Context(), &policy, t.w, fmt.Sprintf("reach `%s`", req.URL.Host), func(ctx context.Context) error {
+		if res != nil {
+			res.Body.Close()
+		}
+		cancel := context.CancelFunc(func() {})
+		if t.policy.Timeout > 0 {
+			ctx, cancel = context.WithTimeout(ctx, t.policy.Timeout)
+		}
+		var err error
+		res, err = t.next.RoundTrip(req.Clone(ctx))
+		if err != nil {
+			cancel()
+			var netErr net.Error
+			if errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) || errors.Is(err, context.DeadlineExceeded) {
+				return err
+			}
+			return &PermanentError{Err: err}
+		}
+		res.Body = &cancelBody{ReadCloser: res.Body, cancel: cancel}
+		if res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500 {
+			httpErr := &HTTPError{URL: req.URL.Redacted(), StatusCode: res.StatusCode}
+			if s, err := strconv.Atoi(res.Header.Get("Retry-After")); err == nil && s > 0 {
+				httpErr.RetryAfter = time.Duration(s) * time.Second
+			}
+			return httpErr
+		}
+		return nil
+	})
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) {
+		// Out of retries, so the caller gets the last response.
+		return res, nil
+	}
+	if err != nil {
+		// E.g., it was cancelled while waiting to retry a response that's still open.
+		if res != nil {
+			res.Body.Close()
+		}
+		return nil, err
+	}
+	return res, nil
+}
+
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	defer b.cancel()
+	return b.ReadCloser.Close()
+}
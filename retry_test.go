@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryTransport(t *testing.T) {
+	tests := []struct {
+		name string
+		// The responses, in order, with the last one repeated.
+		statuses   []int
+		retryAfter string
+		policy     *RetryPolicy
+		// How long until the request is cancelled, if it is.
+		cancel     time.Duration
+		wantStatus int
+		wantErr    error
+		wantCalls  int32
+	}{
+		{
+			name:       "retried",
+			statuses:   []int{http.StatusServiceUnavailable, http.StatusOK},
+			policy:     &RetryPolicy{Retries: 3, Backoff: time.Millisecond, MaxBackoff: time.Millisecond},
+			wantStatus: http.StatusOK,
+			wantCalls:  2,
+		},
+		{
+			name:       "out of retries",
+			statuses:   []int{http.StatusBadGateway},
+			policy:     &RetryPolicy{Retries: 2, Backoff: time.Millisecond, MaxBackoff: time.Millisecond},
+			wantStatus: http.StatusBadGateway,
+			wantCalls:  3,
+		},
+		{
+			name:       "Retry-After in place of the backoff",
+			statuses:   []int{http.StatusTooManyRequests, http.StatusOK},
+			retryAfter: "1",
+			policy:     &RetryPolicy{Retries: 1, Backoff: time.Hour, MaxBackoff: time.Hour},
+			wantStatus: http.StatusOK,
+			wantCalls:  2,
+		},
+		{
+			name:      "cancelled while waiting",
+			statuses:  []int{http.StatusServiceUnavailable},
+			policy:    &RetryPolicy{Retries: 1, Backoff: time.Hour, MaxBackoff: time.Hour},
+			cancel:    50 * time.Millisecond,
+			wantErr:   context.Canceled,
+			wantCalls: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				i := int(calls.Add(1)) - 1
+				status := tt.statuses[min(i, len(tt.statuses)-1)]
+				if tt.retryAfter != "" {
+					w.Header().Set("Retry-After", tt.retryAfter)
+				}
+				w.WriteHeader(status)
+			}))
+			defer server.Close()
+
+			ctx := context.Background()
+			if tt.cancel > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithCancel(ctx)
+				time.AfterFunc(tt.cancel, cancel)
+				defer cancel()
+			}
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			start := time.Now()
+			res, err := newHTTPClient(tt.policy, io.Discard).Do(req)
+			if elapsed := time.Since(start); elapsed > 5*time.Second {
+				t.Errorf("took %s", elapsed)
+			}
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("got error %v, want %v", err, tt.wantErr)
+				}
+				if res != nil {
+					t.Errorf("got a response along with the error")
+				}
+			} else {
+				if err != nil {
+					t.Fatal(err)
+				}
+				res.Body.Close()
+				if res.StatusCode != tt.wantStatus {
+					t.Errorf("got status %d, want %d", res.StatusCode, tt.wantStatus)
+				}
+			}
+			if got := calls.Load(); got != tt.wantCalls {
+				t.Errorf("got %d requests, want %d", got, tt.wantCalls)
+			}
+		})
+	}
+}
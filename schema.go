@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// The OpenAPI schemas of the kinds that are validated, for every Kubernetes
+// version that can be targeted, see `openapi/generate.sh`.
+//
+//go:embed openapi/*.json.gz
+var openAPIFiles embed.FS
+
+var reKubernetesVersion = regexp.MustCompile(`^v?(1)\.(\d+)(\.\d+)?$`)
+
+// The API versions that are on their way out (or gone), by the Kubernetes
+// version that deprecated them and the one that stopped serving them.
+type apiDeprecation struct {
+	APIVersion  string
+	Kind        string
+	Deprecated  int
+	Removed     int
+	Replacement string
+}
+
+var apiDeprecations = []*apiDeprecation{
+	{"extensions/v1beta1", "Deployment", 9, 16, "apps/v1"},
+	{"apps/v1beta1", "Deployment", 9, 16, "apps/v1"},
+	{"apps/v1beta2", "Deployment", 9, 16, "apps/v1"},
+	{"extensions/v1beta1", "Ingress", 14, 22, "networking.k8s.io/v1"},
+	{"networking.k8s.io/v1beta1", "Ingress", 19, 22, "networking.k8s.io/v1"},
+}
+
+// A field of a built resource that the API server would reject (or drop), or a
+// resource whose API version is deprecated.
+type SchemaError struct {
+	Environment string `json:"environment"`
+	// E.g. `Deployment/aion-nginx`.
+	Resource string `json:"resource"`
+	// E.g. `spec.template.spec.containers[0].ports[0].containerPort`.
+	Field string `json:"field,omitempty"`
+	Error string `json:"error"`
+	// It's still served, so it isn't an error (yet).
+	Deprecated bool `json:"deprecated,omitempty"`
+}
+
+// The number of errors that aren't only deprecations.
+func invalid(errs []*SchemaError) int {
+	n := 0
+	for _, e := range errs {
+		if !e.Deprecated {
+			n++
+		}
+	}
+	return n
+}
+
+func (e *SchemaError) String() string {
+	if e.Field == "" {
+		return fmt.Sprintf("%s: %s", e.Resource, e.Error)
+	}
+	return fmt.Sprintf("%s: %s: %s", e.Resource, e.Field, e.Error)
+}
+
+type openAPISchema struct {
+	Ref                  string                    `json:"$ref"`
+	Type                 string                    `json:"type"`
+	Format               string                    `json:"format"`
+	Properties           map[string]*openAPISchema `json:"properties"`
+	AdditionalProperties *openAPISchema            `json:"additionalProperties"`
+	Items                *openAPISchema            `json:"items"`
+	Required             []string                  `json:"required"`
+	PreserveUnknown      bool                      `json:"x-kubernetes-preserve-unknown-fields"`
+	GroupVersionKinds    []struct {
+		Group   string `json:"group"`
+		Version string `json:"version"`
+		Kind    string `json:"kind"`
+	} `json:"x-kubernetes-group-version-kind"`
+}
+
+// The schemas of a single Kubernetes version.
+type KubernetesSchema struct {
+	Version     string
+	minor       int
+	definitions map[string]*openAPISchema
+	// The definition of each `apiVersion` and `kind`, e.g. `apps/v1 Deployment`,
+	// and the kinds that there's a schema for (in any API version).
+	kinds     map[string]string
+	validated map[string]bool
+}
+
+// The versions that have schemas, oldest first.
+func kubernetesVersions() []string {
+	files, _ := fs.Glob(openAPIFiles, "openapi/kubernetes-*.json.gz")
+	var versions []string
+	for _, file := range files {
+		versions = append(versions, strings.TrimSuffix(strings.TrimPrefix(file, "openapi/kubernetes-"), ".json.gz"))
+	}
+	slices.SortFunc(versions, func(a, b string) int {
+		return minorVersion(a) - minorVersion(b)
+	})
+	return versions
+}
+
+func minorVersion(version string) int {
+	matches := reKubernetesVersion.FindStringSubmatch(version)
+	if matches == nil {
+		return -1
+	}
+	minor, _ := strconv.Atoi(matches[2])
+	return minor
+}
+
+// The version can be given as `1.29`, `v1.29` or `1.29.3` (the patch doesn't
+// matter).  Without one, it's the latest that there's a schema for.
+func loadKubernetesSchema(version string) (*KubernetesSchema, error) {
+	versions := kubernetesVersions()
+	if version == "" {
+		version = versions[len(versions)-1]
+	}
+	minor := minorVersion(version)
+	i := slices.IndexFunc(versions, func(v string) bool {
+		return minorVersion(v) == minor
+	})
+	if minor == -1 || i == -1 {
+		return nil, fmt.Errorf("There's no schema for Kubernetes `%s`, only for %s", version, strings.Join(versions, ", "))
+	}
+	f, err := openAPIFiles.Open(fmt.Sprintf("openapi/kubernetes-%s.json.gz", versions[i]))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	var spec struct {
+		Definitions map[string]*openAPISchema `json:"definitions"`
+	}
+	if err := json.NewDecoder(r).Decode(&spec); err != nil {
+		return nil, err
+	}
+	s := &KubernetesSchema{
+		Version:     versions[i],
+		minor:       minor,
+		definitions: spec.Definitions,
+		kinds:       map[string]string{},
+		validated:   map[string]bool{},
+	}
+	for name, definition := range s.definitions {
+		for _, gvk := range definition.GroupVersionKinds {
+			apiVersion := gvk.Version
+			if gvk.Group != "" {
+				apiVersion = fmt.Sprintf("%s/%s", gvk.Group, gvk.Version)
+			}
+			s.kinds[fmt.Sprintf("%s %s", apiVersion, gvk.Kind)] = name
+			s.validated[gvk.Kind] = true
+		}
+	}
+	return s, nil
+}
+
+// Check a (built) resource.  The kinds that there isn't a schema for at all,
+// e.g. ConfigMaps, aren't checked.
+func (s *KubernetesSchema) check(manifest []byte) ([]*SchemaError, error) {
+	var doc yaml.Node
+	if err := yaml.NewDecoder(bytes.NewReader(manifest)).Decode(&doc); err != nil {
+		return nil, err
+	}
+	if len(doc.Content) == 0 {
+		return nil, nil
+	}
+	root := doc.Content[0]
+	apiVersion := scalarValue(mappingGet(root, "apiVersion"))
+	kind := scalarValue(mappingGet(root, "kind"))
+	resource := fmt.Sprintf("%s/%s", kind, scalarValue(mappingGet(mappingGet(root, "metadata"), "name")))
+
+	var errs []*SchemaError
+	for _, d := range apiDeprecations {
+		if d.APIVersion != apiVersion || d.Kind != kind || s.minor < d.Deprecated {
+			continue
+		}
+		if s.minor >= d.Removed {
+			errs = append(errs, &SchemaError{
+				Resource: resource,
+				Error:    fmt.Sprintf("`%s` %s isn't served since Kubernetes 1.%d, use `%s`", apiVersion, kind, d.Removed, d.Replacement),
+			})
+			return errs, nil
+		}
+		errs = append(errs, &SchemaError{
+			Resource:   resource,
+			Error:      fmt.Sprintf("`%s` %s is deprecated since Kubernetes 1.%d and isn't served since 1.%d, use `%s`", apiVersion, kind, d.Deprecated, d.Removed, d.Replacement),
+			Deprecated: true,
+		})
+	}
+	name, ok := s.kinds[fmt.Sprintf("%s %s", apiVersion, kind)]
+	if !ok {
+		if s.validated[kind] && len(errs) == 0 {
+			errs = append(errs, &SchemaError{
+				Resource: resource,
+				Error:    fmt.Sprintf("`%s` %s isn't served by Kubernetes %s", apiVersion, kind, s.Version),
+			})
+		}
+		return errs, nil
+	}
+	s.checkNode(root, &openAPISchema{Ref: name}, "", func(field, format string, a ...interface{}) {
+		errs = append(errs, &SchemaError{Resource: resource, Field: field, Error: fmt.Sprintf(format, a...)})
+	})
+	return errs, nil
+}
+
+func (s *KubernetesSchema) resolve(schema *openAPISchema) *openAPISchema {
+	for schema.Ref != "" {
+		definition, ok := s.definitions[strings.TrimPrefix(schema.Ref, "#/definitions/")]
+		if !ok {
+			return &openAPISchema{PreserveUnknown: true}
+		}
+		schema = definition
+	}
+	return schema
+}
+
+func nodeType(node *yaml.Node) string {
+	switch node.Kind {
+	case yaml.MappingNode:
+		return "an object"
+	case yaml.SequenceNode:
+		return "a list"
+	}
+	switch node.Tag {
+	case "!!int":
+		return "an integer"
+	case "!!float":
+		return "a number"
+	case "!!bool":
+		return "a boolean"
+	}
+	return "a string"
+}
+
+func (s *KubernetesSchema) checkNode(node *yaml.Node, schema *openAPISchema, field string, problem func(field, format string, a ...interface{})) {
+	if node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	// A null is the same as leaving it out.
+	if node.Kind == yaml.ScalarNode && node.Tag == "!!null" {
+		return
+	}
+	quantity := strings.HasSuffix(schema.Ref, ".resource.Quantity")
+	schema = s.resolve(schema)
+	if schema.PreserveUnknown {
+		return
+	}
+
+	wrongType := func(expected string) {
+		if node.Kind == yaml.ScalarNode {
+			problem(field, "expected %s, not %s `%s`", expected, nodeType(node), node.Value)
+		} else {
+			problem(field, "expected %s, not %s", expected, nodeType(node))
+		}
+	}
+	switch {
+	case schema.Format == "int-or-string":
+		if node.Kind != yaml.ScalarNode || !slices.Contains([]string{"!!str", "!!int"}, node.Tag) {
+			wrongType("an integer or a string")
+		}
+	case quantity:
+		if node.Kind != yaml.ScalarNode || !slices.Contains([]string{"!!str", "!!int", "!!float"}, node.Tag) {
+			wrongType("a quantity")
+		}
+	case schema.Type == "string":
+		if node.Kind != yaml.ScalarNode || node.Tag != "!!str" {
+			wrongType("a string")
+		}
+	case schema.Type == "integer":
+		if node.Kind != yaml.ScalarNode || node.Tag != "!!int" {
+			wrongType("an integer")
+		}
+	case schema.Type == "number":
+		if node.Kind != yaml.ScalarNode || (node.Tag != "!!int" && node.Tag != "!!float") {
+			wrongType("a number")
+		}
+	case schema.Type == "boolean":
+		if node.Kind != yaml.ScalarNode || node.Tag != "!!bool" {
+			wrongType("a boolean")
+		}
+	case schema.Type == "array":
+		if node.Kind != yaml.SequenceNode {
+			wrongType("a list")
+			return
+		}
+		if schema.Items == nil {
+			return
+		}
+		for i, item := range node.Content {
+			s.checkNode(item, schema.Items, fmt.Sprintf("%s[%d]", field, i), problem)
+		}
+	case schema.Type == "object" || schema.Properties != nil:
+		if node.Kind != yaml.MappingNode {
+			wrongType("an object")
+			return
+		}
+		child := func(key string) string {
+			if field == "" {
+				return key
+			}
+			return fmt.Sprintf("%s.%s", field, key)
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i].Value, node.Content[i+1]
+			if property, ok := schema.Properties[key]; ok {
+				s.checkNode(value, property, child(key), problem)
+			} else if schema.AdditionalProperties != nil {
+				s.checkNode(value, schema.AdditionalProperties, child(key), problem)
+			} else if schema.Properties != nil {
+				problem(child(key), "unknown field")
+			}
+		}
+		for _, key := range schema.Required {
+			if mappingGet(node, key) == nil {
+				problem(child(key), "missing required field")
+			}
+		}
+	}
+}
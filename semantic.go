@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Kustomize appends a hash of the contents to the names of the ConfigMaps and
+// Secrets that it generates, e.g. `env-aion-nginx-5h2mk9dt47`, and the hash only
+// has these characters (see the `hasher` package).
+var reNameHash = regexp.MustCompile(`^(.+)-[2456789bcdfghkmt]{10}$`)
+
+// A field that's different in two versions of an object, with the same statuses
+// as the files (`FileAdded`, etc.).  The values are flattened onto one line.
+type FieldDiff struct {
+	Path   string `json:"path"`
+	Status string `json:"status"`
+	From   string `json:"from,omitempty"`
+	To     string `json:"to,omitempty"`
+}
+
+func (d *FieldDiff) String() string {
+	switch d.Status {
+	case FileAdded:
+		return fmt.Sprintf("%s %s: %s", d.Status, d.Path, d.To)
+	case FileRemoved:
+		return fmt.Sprintf("%s %s: %s", d.Status, d.Path, d.From)
+	}
+	return fmt.Sprintf("%s %s: %s -> %s", d.Status, d.Path, d.From, d.To)
+}
+
+// An object, e.g. `Deployment/aion-nginx`, that's only in one version, or the
+// fields that are different.
+type ObjectDiff struct {
+	Object string       `json:"object"`
+	Status string       `json:"status"`
+	Fields []*FieldDiff `json:"fields,omitempty"`
+}
+
+// The objects in a manifest by `Kind/name`.  The namespace is left out, since
+// it's usually whatever `kubectl` (or Kustomize) was told.
+type objects map[string]*yaml.Node
+
+func objectKey(n *yaml.Node) string {
+	return fmt.Sprintf("%s/%s", scalarValue(mappingGet(n, "kind")), scalarValue(mappingPath(n, "metadata", "name")))
+}
+
+// Parse the (possibly multi-document) manifest.  Anything that couldn't be
+// resolved when it was rendered is kept as it is, like `rewriteManifest` does.
+func (o objects) parse(manifest []byte) error {
+	placeholders := map[string]string{}
+	protected := reUnresolved.ReplaceAllStringFunc(string(manifest), func(s string) string {
+		placeholder := fmt.Sprintf("__migrator_unresolved_%d__", len(placeholders))
+		placeholders[placeholder] = s
+		return placeholder
+	})
+	decoder := yaml.NewDecoder(strings.NewReader(fixTabIndentation(protected)))
+	for {
+		doc := &yaml.Node{}
+		err := decoder.Decode(doc)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+			continue
+		}
+		root := doc.Content[0]
+		walkScalars(root, func(n *yaml.Node) {
+			for placeholder, s := range placeholders {
+				n.Value = strings.ReplaceAll(n.Value, placeholder, s)
+			}
+		})
+		o[objectKey(root)] = root
+	}
+}
+
+// Take the hashes off the names of the generated ConfigMaps and Secrets (and
+// everywhere that they're referenced), returning the names that they had.  Only
+// the `generated` names are looked at, since any other name could end in
+// something that looks like a hash, e.g. `nginx-production`.
+func (o objects) unhash(generated []string) map[string]string {
+	names := map[string]string{}
+	for _, key := range sortedKeys(o) {
+		object := o[key]
+		kind := scalarValue(mappingGet(object, "kind"))
+		if kind != "ConfigMap" && kind != "Secret" {
+			continue
+		}
+		nameNode := mappingPath(object, "metadata", "name")
+		if matches := reNameHash.FindStringSubmatch(nameNode.Value); matches != nil && slices.Contains(generated, matches[1]) {
+			names[nameNode.Value] = matches[1]
+			delete(o, key)
+			nameNode.Value = matches[1]
+			o[objectKey(object)] = object
+		}
+	}
+	for _, object := range o {
+		walkScalars(object, func(n *yaml.Node) {
+			if name, ok := names[n.Value]; ok {
+				n.Value = name
+			}
+		})
+	}
+	return names
+}
+
+func walkScalars(n *yaml.Node, f func(*yaml.Node)) {
+	if n.Kind == yaml.ScalarNode {
+		f(n)
+	}
+	for _, child := range n.Content {
+		walkScalars(child, f)
+	}
+}
+
+// Nulls, empty lists and empty objects are the same as leaving them out.
+func pruneEmpty(n *yaml.Node) {
+	if n.Kind == yaml.MappingNode {
+		var content []*yaml.Node
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			value := n.Content[i+1]
+			pruneEmpty(value)
+			if !isEmptyNode(value) {
+				content = append(content, n.Content[i], value)
+			}
+		}
+		n.Content = content
+	}
+	if n.Kind == yaml.SequenceNode {
+		for _, item := range n.Content {
+			pruneEmpty(item)
+		}
+	}
+}
+
+func isEmptyNode(n *yaml.Node) bool {
+	switch n.Kind {
+	case yaml.MappingNode, yaml.SequenceNode:
+		return len(n.Content) == 0
+	case yaml.ScalarNode:
+		return n.Tag == "!!null"
+	}
+	return false
+}
+
+// Compare the objects in `to` with those in `from`, ordered by object.
+func diffObjects(from, to objects) []*ObjectDiff {
+	var diffs []*ObjectDiff
+	keys := sortedKeys(from)
+	for _, key := range sortedKeys(to) {
+		if _, ok := from[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		a, b := from[key], to[key]
+		switch {
+		case a == nil:
+			diffs = append(diffs, &ObjectDiff{Object: key, Status: FileAdded})
+		case b == nil:
+			diffs = append(diffs, &ObjectDiff{Object: key, Status: FileRemoved})
+		default:
+			if fields := diffNodes(a, b, ""); len(fields) > 0 {
+				diffs = append(diffs, &ObjectDiff{Object: key, Status: FileModified, Fields: fields})
+			}
+		}
+	}
+	return diffs
+}
+
+// The fields that are different.  Scalars are compared by value, so `1` and
+// `"1"` are the same, and lists of objects that all have a (unique) `name`, e.g.
+// containers and env vars, are compared by name rather than by position.
+func diffNodes(from, to *yaml.Node, path string) []*FieldDiff {
+	switch {
+	case from == nil && to == nil:
+		return nil
+	case from == nil:
+		return []*FieldDiff{{Path: path, Status: FileAdded, To: flatten(to)}}
+	case to == nil:
+		return []*FieldDiff{{Path: path, Status: FileRemoved, From: flatten(from)}}
+	case from.Kind != to.Kind:
+		return []*FieldDiff{{Path: path, Status: FileModified, From: flatten(from), To: flatten(to)}}
+	}
+
+	child := func(key string) string {
+		if path == "" {
+			return key
+		}
+		return fmt.Sprintf("%s.%s", path, key)
+	}
+	var diffs []*FieldDiff
+	switch from.Kind {
+	case yaml.ScalarNode:
+		if from.Value != to.Value {
+			diffs = append(diffs, &FieldDiff{Path: path, Status: FileModified, From: flatten(from), To: flatten(to)})
+		}
+	case yaml.MappingNode:
+		var keys []string
+		for _, n := range []*yaml.Node{from, to} {
+			for i := 0; i+1 < len(n.Content); i += 2 {
+				if !slices.Contains(keys, n.Content[i].Value) {
+					keys = append(keys, n.Content[i].Value)
+				}
+			}
+		}
+		for _, key := range keys {
+			diffs = append(diffs, diffNodes(mappingGet(from, key), mappingGet(to, key), child(key))...)
+		}
+	case yaml.SequenceNode:
+		fromNames, fromOk := itemNames(from)
+		toNames, toOk := itemNames(to)
+		if fromOk && toOk {
+			names := append([]string{}, fromNames...)
+			for _, name := range toNames {
+				if !slices.Contains(names, name) {
+					names = append(names, name)
+				}
+			}
+			for _, name := range names {
+				var a, b *yaml.Node
+				if i := slices.Index(fromNames, name); i != -1 {
+					a = from.Content[i]
+				}
+				if i := slices.Index(toNames, name); i != -1 {
+					b = to.Content[i]
+				}
+				diffs = append(diffs, diffNodes(a, b, fmt.Sprintf("%s[%s]", path, name))...)
+			}
+			break
+		}
+		for i := 0; i < max(len(from.Content), len(to.Content)); i++ {
+			var a, b *yaml.Node
+			if i < len(from.Content) {
+				a = from.Content[i]
+			}
+			if i < len(to.Content) {
+				b = to.Content[i]
+			}
+			diffs = append(diffs, diffNodes(a, b, fmt.Sprintf("%s[%d]", path, i))...)
+		}
+	}
+	return diffs
+}
+
+// The names of the items in the list, if they're all objects with a unique name.
+func itemNames(n *yaml.Node) ([]string, bool) {
+	var names []string
+	for _, item := range n.Content {
+		name := scalarValue(mappingGet(item, "name"))
+		if name == "" || slices.Contains(names, name) {
+			return nil, false
+		}
+		names = append(names, name)
+	}
+	return names, len(names) > 0
+}
+
+// The value on one line, e.g. `{name: FOO, value: bar}`.
+func flatten(n *yaml.Node) string {
+	if n.Kind == yaml.ScalarNode {
+		return n.Value
+	}
+	var flow func(n *yaml.Node) *yaml.Node
+	flow = func(n *yaml.Node) *yaml.Node {
+		c := *n
+		if n.Kind != yaml.ScalarNode {
+			c.Style = yaml.FlowStyle
+		}
+		c.HeadComment, c.LineComment, c.FootComment = "", "", ""
+		c.Content = nil
+		for _, child := range n.Content {
+			c.Content = append(c.Content, flow(child))
+		}
+		return &c
+	}
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(flow(n)); err != nil {
+		return "?"
+	}
+	return strings.TrimSpace(buf.String())
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestUnhash(t *testing.T) {
+	manifest := `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: env-aion-nginx-5h2mk9dt47
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: nginx-production
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: aion-nginx
+spec:
+  template:
+    spec:
+      containers:
+        - name: aion-nginx
+          envFrom:
+            - configMapRef:
+                name: env-aion-nginx-5h2mk9dt47
+            - configMapRef:
+                name: nginx-production
+`
+	tests := []struct {
+		name      string
+		generated []string
+		want      map[string]string
+		objects   []string
+	}{
+		{
+			name:      "generated",
+			generated: []string{"env-aion-nginx"},
+			want:      map[string]string{"env-aion-nginx-5h2mk9dt47": "env-aion-nginx"},
+			objects:   []string{"ConfigMap/env-aion-nginx", "ConfigMap/nginx-production", "Deployment/aion-nginx"},
+		},
+		{
+			name:      "looks hashed but isn't generated",
+			generated: []string{"env-aion-nginx", "nginx"},
+			want:      map[string]string{"env-aion-nginx-5h2mk9dt47": "env-aion-nginx"},
+			objects:   []string{"ConfigMap/env-aion-nginx", "ConfigMap/nginx-production", "Deployment/aion-nginx"},
+		},
+		{
+			name:    "nothing generated",
+			want:    map[string]string{},
+			objects: []string{"ConfigMap/env-aion-nginx-5h2mk9dt47", "ConfigMap/nginx-production", "Deployment/aion-nginx"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := objects{}
+			if err := o.parse([]byte(manifest)); err != nil {
+				t.Fatal(err)
+			}
+			got := o.unhash(tt.generated)
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+			for hashed, name := range tt.want {
+				if got[hashed] != name {
+					t.Errorf("got %v, want %v", got, tt.want)
+				}
+			}
+			keys := sortedKeys(o)
+			if len(keys) != len(tt.objects) {
+				t.Fatalf("got objects %v, want %v", keys, tt.objects)
+			}
+			for i := range keys {
+				if keys[i] != tt.objects[i] {
+					t.Errorf("got objects %v, want %v", keys, tt.objects)
+				}
+			}
+			var refs []string
+			for _, container := range podContainers(o["Deployment/aion-nginx"]) {
+				for _, item := range mappingGet(container, "envFrom").Content {
+					refs = append(refs, scalarValue(mappingPath(item, "configMapRef", "name")))
+				}
+			}
+			for _, ref := range refs {
+				if _, ok := o["ConfigMap/"+ref]; !ok {
+					t.Errorf("the Deployment refers to `%s`, which isn't one of the objects", ref)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,23 @@
+# The resources of the (first) container, which isn't patched by name since
+# the name isn't known here.
+- op: add
+  path: /spec/template/spec/containers/0/resources
+  value:
+    {{- if or .RequestsMemory .RequestsCPU }}
+    requests:
+      {{- with .RequestsMemory }}
+      memory: "{{ . }}"
+      {{- end }}
+      {{- with .RequestsCPU }}
+      cpu: "{{ . }}"
+      {{- end }}
+    {{- end }}
+    {{- if or .LimitsMemory .LimitsCPU }}
+    limits:
+      {{- with .LimitsMemory }}
+      memory: "{{ . }}"
+      {{- end }}
+      {{- with .LimitsCPU }}
+      cpu: "{{ . }}"
+      {{- end }}
+    {{- end }}
@@ -1,9 +1,10 @@
 namespace: default
-commonLabels:
-  app: {{ .Name }}
+labels:
+- pairs:
+    app: {{ .Name }}
+  includeSelectors: true
 
 resources:
   {{ range .ResourceManifests -}}
   - {{ . }}
   {{ end }}
-
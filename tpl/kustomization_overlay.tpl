@@ -1,3 +1,11 @@
+{{- if .Environment.Namespace }}namespace: {{ .Environment.Namespace }}
+
+{{ end -}}
+{{- if .Environment.Cluster }}labels:
+- pairs:
+    cluster: {{ .Environment.Cluster }}
+
+{{ end -}}
 resources:
   - ../../base
   {{- if .HasIngress }}
@@ -16,8 +24,8 @@ configMapGenerator:
 images:
 - name: {{ .Image.Name }}
   newName: {{ .Image.NewName }}
-  newTag: {{ .Image.NewTag }}
-{{ if and (ne .Environment "development") .Resources }}
+  newTag: "{{ .Image.NewTag }}"
+{{ if and .Environment.ResourcePatches .Resources }}
 patches:
 - path: deployment_patch.yaml
   target:
@@ -1,61 +1,38 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"errors"
-	"fmt"
 	"io"
 	"os"
 	"reflect"
-	"regexp"
-	"strconv"
-	"strings"
+	"sort"
+	"sync"
 
+	"github.com/btoll/migrator/jinja"
 	"gopkg.in/yaml.v3"
 )
 
-var reToken = regexp.MustCompile(`{{\s*[^{}][a-zA-Z_]*\s*}}`)
-
 func checkFileExists(filePath string) bool {
 	_, err := os.Stat(filePath)
 	return !errors.Is(err, os.ErrNotExist)
 }
 
-func getCertificateValues(mergedValues map[string]interface{}) (string, string, error) {
-	apexDomain, ok := mergedValues["apex_domain"]
-	if ok {
-		applicationRegion, ok := mergedValues["application_region"]
-		if ok {
-			return apexDomain.(string), applicationRegion.(string), nil
-		}
-	}
-	return "", "", errors.New("Unable to retrieve certificate values")
-}
-
-func getManifestValues(filename string) ManifestValues {
+// The values in the YAML file, or none if there isn't one.
+func getManifestValues(filename string) (ManifestValues, error) {
 	base := make(ManifestValues)
-	if checkFileExists(filename) {
-		b, err := os.ReadFile(filename)
-		if err != nil {
-			panic(err)
-		}
-		err = yaml.Unmarshal(b, &base)
-		if err != nil {
-			panic(err)
-		}
+	if !checkFileExists(filename) {
+		return base, nil
 	}
-	return base
-}
-
-func getTokensFromManifest(manifest string) map[string]int {
-	tokenMap := make(map[string]int)
-	matches := reToken.FindAllString(manifest, -1)
-	for _, match := range matches {
-		if _, ok := tokenMap[match]; !ok {
-			tokenMap[match] = 0
-		}
-		tokenMap[match] += 1
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if err := yaml.Unmarshal(b, &base); err != nil {
+		return nil, err
 	}
-	return tokenMap
+	return base, nil
 }
 
 func mapMerge(maps ...map[string]interface{}) map[string]interface{} {
@@ -85,36 +62,70 @@ func replaceMerge(envvars map[string]string, vs ...T) {
 	}
 }
 
-func tokenizeManifests(data map[string]interface{}, manifest string) (string, map[string]int) {
-	tokenMap := getTokensFromManifest(manifest)
-	templated := manifest
-	for k, v := range data {
-		// TODO should log these key/values
-		var s string
-		switch v.(type) {
-		case string:
-			s = v.(string)
-		case int:
-			s = strconv.Itoa(v.(int))
-		}
-		var token string = fmt.Sprintf("{{ %s }}", k)
-		if strings.Contains(templated, token) {
-			templated = strings.ReplaceAll(templated, token, s)
-			tokenMap[token] = 0
-		}
-	}
-	return templated, tokenMap
+// Evaluate the Jinja manifest template with the given values.  Any expression that
+// couldn't be resolved is left in the rendered manifest and returned so it can be
+// logged.
+func renderManifest(filename, manifest string, values map[string]interface{}) (string, []jinja.Undefined, error) {
+	return jinja.Render(filename, manifest, values)
 }
 
-func writeManifestFile(filename, contents, appDir string) {
-	f, err := os.Create(fmt.Sprintf("%s/base/%s", appDir, filename))
+func writeFile(filename, contents string) error {
+	f, err := os.Create(filename)
 	if err != nil {
-		fmt.Println(err)
+		return err
 	}
-	defer f.Close()
-
 	_, err = io.WriteString(f, contents)
-	if err != nil {
-		fmt.Println(err)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Run `work` for each of the `n` items using a pool of `jobs` workers.  Each item
+// writes its output to its own buffer, and the buffers are copied to `out` in the
+// order of the items as soon as they are done.  Once `ctx` is cancelled, the items
+// that haven't been started are skipped, and the ones that have are waited for.
+func runOrdered(ctx context.Context, n, jobs int, out io.Writer, work func(i int, w io.Writer)) {
+	jobs = max(jobs, 1)
+	output := make([]bytes.Buffer, n)
+	done := make([]chan struct{}, n)
+	for i := range done {
+		done[i] = make(chan struct{})
+	}
+
+	queue := make(chan int)
+	var wg sync.WaitGroup
+	for j := 0; j < jobs; j++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range queue {
+				if ctx.Err() == nil {
+					work(i, &output[i])
+				}
+				close(done[i])
+			}
+		}()
+	}
+	go func() {
+		for i := 0; i < n; i++ {
+			queue <- i
+		}
+		close(queue)
+	}()
+
+	for i := 0; i < n; i++ {
+		<-done[i]
+		out.Write(output[i].Bytes())
 	}
+	wg.Wait()
 }
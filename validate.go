@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+type ValidationProblem struct {
+	Path    string `json:"path"`
+	Message string `json:"message"`
+	// A deprecated API version is reported, but it isn't invalid (yet).
+	Deprecated bool `json:"deprecated,omitempty"`
+}
+
+func (p *ValidationProblem) String() string {
+	return fmt.Sprintf("%s: %s", p.Path, p.Message)
+}
+
+type kustomization struct {
+	Resources []string `yaml:"resources"`
+}
+
+// Every directory under `root` that has a `base/kustomization.yaml`.  A service
+// with more than one Deployment has a directory for each of them.
+func kustomizedDirs(root string) ([]string, error) {
+	var dirs []string
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && checkFileExists(filepath.Join(path, "base", "kustomization.yaml")) {
+			dirs = append(dirs, path)
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	return dirs, err
+}
+
+// Check that the kustomized output is complete, that every manifest is valid YAML
+// without anything left to render and that every overlay can be built into what
+// the target Kubernetes version accepts.
+func (m *Migrator) validate() ([]*ValidationProblem, error) {
+	dirs, err := kustomizedDirs(m.Dirs.Project)
+	if err != nil {
+		return nil, err
+	}
+	if len(dirs) == 0 {
+		return nil, fmt.Errorf("There aren't any kustomized services in `%s`", m.Dirs.Project)
+	}
+	var problems []*ValidationProblem
+	for _, dir := range dirs {
+		problems = append(problems, m.validateService(dir)...)
+	}
+	return problems, nil
+}
+
+func (m *Migrator) validateService(dir string) []*ValidationProblem {
+	var problems []*ValidationProblem
+	problem := func(path, format string, a ...interface{}) {
+		problems = append(problems, &ValidationProblem{Path: path, Message: fmt.Sprintf(format, a...)})
+	}
+
+	base := filepath.Join(dir, "base", "kustomization.yaml")
+	b, err := os.ReadFile(base)
+	if err != nil {
+		problem(base, "%s", err)
+	} else {
+		var k kustomization
+		if err := yaml.Unmarshal(b, &k); err != nil {
+			problem(base, "%s", err)
+		}
+		for _, resource := range k.Resources {
+			if !checkFileExists(filepath.Join(dir, "base", resource)) {
+				problem(base, "the resource `%s` doesn't exist", resource)
+			}
+		}
+	}
+	for _, env := range m.Environments {
+		overlay := filepath.Join(dir, "overlays", env.Name, "kustomization.yaml")
+		if !checkFileExists(overlay) {
+			problem(overlay, "the `%s` overlay is missing", env.Name)
+		}
+	}
+	// The overlays that are missing were reported above.
+	for _, overlay := range m.buildOverlays(dir) {
+		if overlay.Err != nil {
+			problem(overlay.Dir, "the `%s` overlay can't be built: %s", overlay.Environment, overlay.Err)
+			continue
+		}
+		schemaErrs, err := m.checkSchemas(overlay)
+		if err != nil {
+			problem(overlay.Dir, "%s", err)
+			continue
+		}
+		for _, schemaErr := range schemaErrs {
+			if schemaErr.Deprecated {
+				problems = append(problems, &ValidationProblem{Path: overlay.Dir, Message: schemaErr.String(), Deprecated: true})
+				continue
+			}
+			problem(overlay.Dir, "%s (Kubernetes %s)", schemaErr, m.Schema.Version)
+		}
+	}
+
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || filepath.Ext(path) != ".yaml" {
+			return err
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			problem(path, "%s", err)
+			return nil
+		}
+		if reUnresolved.Match(b) {
+			problem(path, "there are unresolved expressions, e.g. `%s`", reUnresolved.Find(b))
+			return nil
+		}
+		decoder := yaml.NewDecoder(bytes.NewReader(b))
+		for {
+			var doc yaml.Node
+			err := decoder.Decode(&doc)
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				problem(path, "%s", strings.TrimPrefix(err.Error(), "yaml: "))
+				break
+			}
+		}
+		return nil
+	})
+	return problems
+}
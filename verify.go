@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/btoll/migrator/color"
+	"gopkg.in/yaml.v3"
+)
+
+// How a service's overlay differs from what `ansible-deployers` would have
+// deployed to that environment.
+type Drift struct {
+	Repository  string        `json:"repository"`
+	Environment string        `json:"environment"`
+	Dir         string        `json:"dir"`
+	Objects     []*ObjectDiff `json:"objects,omitempty"`
+	// The overlay couldn't be built or the templates couldn't be rendered.
+	Error string `json:"error,omitempty"`
+}
+
+// Render the manifest templates of every service the way `ansible-deployers`
+// would (with the defaults, the environment's values and the overrides) and
+// compare the objects with those that its overlays are built into.  The
+// differences that are intended aren't drift, i.e.:
+//
+//   - the env vars are in a generated ConfigMap (`envFrom`) instead of inline,
+//   - the generated ConfigMap's name has a hash,
+//   - the namespace and the `app` and `cluster` labels are set by Kustomize,
+//   - the `nodeSelector` and the ingress class are set by the transformation,
+//     so they're left out on both sides (`ansible-deployers` injected its own
+//     `nodeSelector`).
+func (m *Migrator) verify(ctx context.Context, w io.Writer) ([]*Drift, error) {
+	dirs, err := os.ReadDir(m.Dirs.Sources)
+	if err != nil {
+		return nil, fmt.Errorf("Could not list contents of the sources directory `%s`: %w", m.Dirs.Sources, err)
+	}
+	shared := m.sharedValues()
+	var drifts []*Drift
+	for _, dir := range dirs {
+		if ctx.Err() != nil {
+			return drifts, ctx.Err()
+		}
+		if !dir.IsDir() || strings.HasPrefix(dir.Name(), ".") {
+			continue
+		}
+		kubeDir := fmt.Sprintf("%s/%s/%s", m.Dirs.Sources, dir.Name(), m.Config.KubeDir)
+		files, err := os.ReadDir(kubeDir)
+		if err != nil {
+			continue
+		}
+		appDir := fmt.Sprintf("%s/%s", m.Dirs.Project, dir.Name())
+		if !checkFileExists(appDir) {
+			fmt.Fprintln(w, fmt.Sprintf("%s `%s` hasn't been transformed", color.Warning(), dir.Name()))
+			continue
+		}
+		for _, unit := range m.serviceUnits(appDir, files) {
+			for _, env := range m.Environments {
+				drift := m.verifyOverlay(dir.Name(), kubeDir, unit, env, shared)
+				if drift.Error != "" || len(drift.Objects) > 0 {
+					drifts = append(drifts, drift)
+				}
+			}
+		}
+	}
+	return drifts, nil
+}
+
+func (m *Migrator) verifyOverlay(repo, kubeDir string, unit *serviceUnit, env *Environment, shared *sharedValues) *Drift {
+	overlayDir := fmt.Sprintf("%s/overlays/%s", unit.dir, env.Name)
+	drift := &Drift{Repository: repo, Environment: env.Name, Dir: overlayDir}
+
+	built, generated, err := buildObjects(overlayDir)
+	if err != nil {
+		drift.Error = err.Error()
+		return drift
+	}
+
+	rendered, name, err := m.renderAnsible(repo, kubeDir, unit, env, shared)
+	if err != nil {
+		drift.Error = err.Error()
+		return drift
+	}
+
+	inlineGeneratedEnv(built, rendered, generated)
+	for _, o := range []objects{rendered, built} {
+		for _, object := range o {
+			normalizeObject(object, name, env)
+		}
+	}
+	drift.Objects = diffObjects(rendered, built)
+	return drift
+}
+
+// Render the unit's templates with everything that `ansible-deployers` merged
+// for the environment, returning the objects and the service name.
+func (m *Migrator) renderAnsible(repo, kubeDir string, unit *serviceUnit, env *Environment, shared *sharedValues) (objects, string, error) {
+	rendered := objects{}
+	var name string
+	for _, filename := range unit.files {
+		f := fmt.Sprintf("%s/%s", kubeDir, filename)
+		content, err := os.ReadFile(f)
+		if err != nil {
+			return nil, "", err
+		}
+		prefix, _, _ := strings.Cut(filename, "-")
+		defaultsFile := fmt.Sprintf("%s/%s/%s", kubeDir, m.Config.ValuesDir, m.Config.defaultsFile(prefix))
+		defaultValues, err := getManifestValues(defaultsFile)
+		if err != nil {
+			return nil, "", fmt.Errorf("Could not read `%s`: %w", defaultsFile, err)
+		}
+		if name == "" {
+			name = repo
+			if svcName, ok := defaultValues["service_name"].(string); ok {
+				name = svcName
+			}
+		}
+		envFile := fmt.Sprintf("%s/%s/%s", kubeDir, m.Config.ValuesDir, env.valuesFile(prefix))
+		overridesFile := fmt.Sprintf("%s/%s/%s/%s", m.Dirs.AnsibleDeployerOverrides, repo, m.Config.ValuesDir, env.valuesFile(prefix))
+		envValues, err := getManifestValues(envFile)
+		if err != nil {
+			return nil, "", fmt.Errorf("Could not read `%s`: %w", envFile, err)
+		}
+		overridesValues, err := getManifestValues(overridesFile)
+		if err != nil {
+			return nil, "", fmt.Errorf("Could not read `%s`: %w", overridesFile, err)
+		}
+		if shared.certificatesErr != nil {
+			return nil, "", fmt.Errorf("Could not read the certificates: %w", shared.certificatesErr)
+		}
+		values := mapMerge(
+			m.Config.Vars,
+			shared.certificates,
+			defaultValues,
+			envValues,
+			overridesValues,
+			ManifestValues{"application_environment": env.Name},
+		)
+		// `mapMerge` leaves these out, since they're merged by name.
+		values["environment_variables"] = environmentVariables(envFile, overridesFile)
+		manifest, _, err := renderManifest(f, string(content), values)
+		if err != nil {
+			return nil, "", fmt.Errorf("Could not render `%s`: %w", f, err)
+		}
+		if err := rendered.parse([]byte(manifest)); err != nil {
+			return nil, "", fmt.Errorf("Could not parse `%s`: %w", f, err)
+		}
+	}
+	return rendered, name, nil
+}
+
+// The env vars from the environment's values file and the overrides, the same
+// ones that go into the overlay's `env` file.
+func environmentVariables(filenames ...string) []interface{} {
+	var vs []T
+	for _, filename := range filenames {
+		content, _ := os.ReadFile(filename)
+		v := T{}
+		if yaml.Unmarshal(content, &v) == nil {
+			vs = append(vs, v)
+		}
+	}
+	envvars := map[string]string{}
+	replaceMerge(envvars, vs...)
+	var list []interface{}
+	for _, key := range sortedKeys(envvars) {
+		list = append(list, map[string]interface{}{"name": key, "value": envvars[key]})
+	}
+	return list
+}
+
+// Swap the `envFrom` of the generated ConfigMaps (by their hashed names) that
+// aren't in `rendered` for the env vars in them.
+func inlineGeneratedEnv(built, rendered objects, hashed map[string]string) {
+	generated := map[string]*yaml.Node{}
+	for _, name := range hashed {
+		key := fmt.Sprintf("ConfigMap/%s", name)
+		if configMap, ok := built[key]; ok && rendered[key] == nil {
+			generated[name] = configMap
+			delete(built, key)
+		}
+	}
+	for _, object := range built {
+		for _, container := range podContainers(object) {
+			envFrom := mappingGet(container, "envFrom")
+			if envFrom == nil {
+				continue
+			}
+			var env []*yaml.Node
+			envFrom.Content = slices.DeleteFunc(envFrom.Content, func(item *yaml.Node) bool {
+				configMap, ok := generated[scalarValue(mappingPath(item, "configMapRef", "name"))]
+				if !ok {
+					return false
+				}
+				data := mappingGet(configMap, "data")
+				for i := 0; data != nil && i+1 < len(data.Content); i += 2 {
+					v := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+					mappingSet(v, "name", scalarNode(data.Content[i].Value))
+					mappingSet(v, "value", scalarNode(data.Content[i+1].Value))
+					env = append(env, v)
+				}
+				return true
+			})
+			if len(env) == 0 {
+				continue
+			}
+			existing := mappingGet(container, "env")
+			if existing == nil || existing.Kind != yaml.SequenceNode {
+				existing = &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+				mappingSet(container, "env", existing)
+			}
+			existing.Content = append(existing.Content, env...)
+		}
+	}
+}
+
+func podContainers(object *yaml.Node) []*yaml.Node {
+	containers := mappingPath(object, "spec", "template", "spec", "containers")
+	if containers == nil || containers.Kind != yaml.SequenceNode {
+		return nil
+	}
+	return containers.Content
+}
+
+// Leave out what's set by Kustomize (or doesn't matter), see `verify`.
+func normalizeObject(object *yaml.Node, name string, env *Environment) {
+	if metadata := mappingGet(object, "metadata"); metadata != nil {
+		mappingDelete(metadata, "namespace")
+	}
+	if labels := mappingPath(object, "metadata", "labels"); env.Cluster != "" && scalarValue(mappingGet(labels, "cluster")) == env.Cluster {
+		mappingDelete(labels, "cluster")
+	}
+	for _, labels := range []*yaml.Node{
+		mappingPath(object, "metadata", "labels"),
+		mappingPath(object, "spec", "template", "metadata", "labels"),
+		mappingPath(object, "spec", "selector", "matchLabels"),
+	} {
+		if labels != nil && scalarValue(mappingGet(labels, "app")) == name {
+			mappingDelete(labels, "app")
+		}
+	}
+	if scalarValue(mappingGet(object, "kind")) == "Service" {
+		if selector := mappingPath(object, "spec", "selector"); scalarValue(mappingGet(selector, "app")) == name {
+			mappingDelete(selector, "app")
+		}
+	}
+	// These are set by the transformation, whatever they were before.
+	switch scalarValue(mappingGet(object, "kind")) {
+	case "Deployment":
+		mappingDelete(mappingPath(object, "spec", "template", "spec"), "nodeSelector")
+	case "Ingress":
+		mappingDelete(mappingGet(object, "spec"), "ingressClassName")
+		mappingDelete(mappingPath(object, "metadata", "annotations"), "kubernetes.io/ingress.class")
+	}
+	for _, container := range podContainers(object) {
+		if env := mappingGet(container, "env"); env != nil && env.Kind == yaml.SequenceNode {
+			slices.SortStableFunc(env.Content, func(a, b *yaml.Node) int {
+				return strings.Compare(scalarValue(mappingGet(a, "name")), scalarValue(mappingGet(b, "name")))
+			})
+		}
+	}
+	pruneEmpty(object)
+}